@@ -0,0 +1,599 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"git.mills.io/prologic/tube/app/middleware"
+	"git.mills.io/prologic/tube/media"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// apiPrefix is the path prefix of the JSON API, versioned so that it can
+// change without breaking existing clients.
+const apiPrefix = "/api/v1"
+
+// apiParam is a path or query parameter of a route of the JSON API.
+type apiParam struct {
+	Name        string
+	In          string // "path" or "query"
+	Type        string // "string" or "integer"
+	Description string
+	Required    bool
+}
+
+// apiRoute is a route of the JSON API, from which both the router and the
+// OpenAPI document describing it are generated.
+type apiRoute struct {
+	Method string
+	// Path is relative to apiPrefix, with the syntax of mux.
+	Path    string
+	ID      string
+	Tag     string
+	Summary string
+	// Role is required to use the route (none if empty), and Scope for the
+	// requests made with an API token.
+	Role   middleware.Role
+	Scope  string
+	Params []apiParam
+	// Body is the zero value of the request body, sent as ContentType, and
+	// Response that of the response sent with the Status (none if nil).
+	Body        interface{}
+	ContentType string
+	Status      int
+	Response    interface{}
+	Handler     http.HandlerFunc
+}
+
+// apiError is the body of the error responses of the JSON API.
+type apiError struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// apiVideoPage is a page of videos, with the cursor of the next one.
+type apiVideoPage struct {
+	Videos []*apiVideo `json:"videos"`
+	Next   string      `json:"next,omitempty" doc:"cursor of the next page (absent on the last one)"`
+}
+
+// apiUpload is the (multipart) request body uploading a video.
+type apiUpload struct {
+	File        string `json:"file" format:"binary"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Tags        string `json:"tags,omitempty" doc:"comma separated tags"`
+	Category    string `json:"category,omitempty"`
+	Visibility  string `json:"visibility,omitempty" enum:"public,unlisted,private"`
+	Library     string `json:"library,omitempty" doc:"path of the collection to upload to (the first writable one by default)"`
+}
+
+// apiImport is the request body importing a video.
+type apiImport struct {
+	URL        string `json:"url"`
+	Visibility string `json:"visibility,omitempty" enum:"public,unlisted,private"`
+	Library    string `json:"library,omitempty" doc:"path of the collection to import to (the first writable one by default)"`
+}
+
+// apiVideoChanges is the request body editing a video: only the fields
+// present are changed.
+type apiVideoChanges struct {
+	Title       *string   `json:"title,omitempty"`
+	Description *string   `json:"description,omitempty"`
+	Tags        *[]string `json:"tags,omitempty"`
+	Category    *string   `json:"category,omitempty"`
+	Visibility  *string   `json:"visibility,omitempty" enum:"public,unlisted,private"`
+}
+
+// apiCollection is a library path, whose videos make up a collection.
+type apiCollection struct {
+	Path        string `json:"path"`
+	Prefix      string `json:"prefix,omitempty" doc:"prefix of the IDs of its videos, filtering them with collection"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ReadOnly    bool   `json:"read_only"`
+	Videos      int    `json:"videos" doc:"no. of videos listed to the user"`
+	URL         string `json:"url,omitempty"`
+	Cover       string `json:"cover,omitempty"`
+}
+
+var (
+	limitParam = apiParam{
+		Name: "limit", In: "query", Type: "integer",
+		Description: fmt.Sprintf("no. of videos per page (%d by default, at most %d)", playlistPageSize, maxPlaylistPageSize),
+	}
+	afterParam = apiParam{
+		Name: "after", In: "query", Type: "string",
+		Description: "cursor of the page, returned as next with the previous one",
+	}
+	collectionParam = apiParam{
+		Name: "collection", In: "query", Type: "string",
+		Description: "prefix of the collection the videos belong to",
+	}
+	videoParam = apiParam{Name: "id", In: "path", Type: "string", Required: true}
+)
+
+// apiRoutes returns the routes of the JSON API.
+func (a *App) apiRoutes() []*apiRoute {
+	return []*apiRoute{
+		{
+			Method: http.MethodGet, Path: "/videos", ID: "listVideos", Tag: "videos",
+			Summary: "List the videos, newest first by default",
+			Params: []apiParam{
+				limitParam, afterParam, collectionParam,
+				{Name: "sort", In: "query", Type: "string", Description: "timestamp (the default), views or duration"},
+				{Name: "tag", In: "query", Type: "string", Description: "tag the videos have"},
+			},
+			Status: http.StatusOK, Response: &apiVideoPage{},
+			Handler: a.apiListVideos,
+		},
+		{
+			Method: http.MethodGet, Path: "/search", ID: "searchVideos", Tag: "videos",
+			Summary: "Search the videos, best matches first",
+			Params: []apiParam{
+				{Name: "q", In: "query", Type: "string", Description: "search query"},
+				collectionParam, limitParam, afterParam,
+			},
+			Status: http.StatusOK, Response: &apiVideoPage{},
+			Handler: a.apiSearchVideos,
+		},
+		{
+			Method: http.MethodPost, Path: "/videos", ID: "uploadVideo", Tag: "videos",
+			Summary: "Upload a video, transcoded by the returned job",
+			Role:    middleware.RoleUploader, Scope: middleware.ScopeUpload,
+			Body: &apiUpload{}, ContentType: "multipart/form-data",
+			Status: http.StatusAccepted, Response: &JobStatus{},
+			Handler: a.apiUploadVideo,
+		},
+		{
+			Method: http.MethodGet, Path: "/videos/{id:.+}", ID: "getVideo", Tag: "videos",
+			Summary: "Get a video",
+			Params:  []apiParam{videoParam},
+			Status:  http.StatusOK, Response: &apiVideo{},
+			Handler: a.apiGetVideo,
+		},
+		{
+			Method: http.MethodPatch, Path: "/videos/{id:.+}", ID: "editVideo", Tag: "videos",
+			Summary: "Edit the metadata of a video",
+			Role:    middleware.RoleEditor, Scope: middleware.ScopeUpload,
+			Params: []apiParam{videoParam},
+			Body:   &apiVideoChanges{}, ContentType: "application/json",
+			Status: http.StatusOK, Response: &apiVideo{},
+			Handler: a.apiEditVideo,
+		},
+		{
+			Method: http.MethodDelete, Path: "/videos/{id:.+}", ID: "deleteVideo", Tag: "videos",
+			Summary: "Delete a video, moving it to the trash if enabled",
+			Role:    middleware.RoleEditor, Scope: middleware.ScopeUpload,
+			Params:  []apiParam{videoParam},
+			Status:  http.StatusNoContent,
+			Handler: a.apiDeleteVideo,
+		},
+		{
+			Method: http.MethodPost, Path: "/imports", ID: "importVideo", Tag: "videos",
+			Summary: "Import a video from a URL, downloaded by the returned job",
+			Role:    middleware.RoleUploader, Scope: middleware.ScopeImport,
+			Body: &apiImport{}, ContentType: "application/json",
+			Status: http.StatusAccepted, Response: &JobStatus{},
+			Handler: a.apiImportVideo,
+		},
+		{
+			Method: http.MethodGet, Path: "/collections", ID: "listCollections", Tag: "collections",
+			Summary: "List the collections (library paths)",
+			Status:  http.StatusOK, Response: []*apiCollection{},
+			Handler: a.apiListCollections,
+		},
+		{
+			Method: http.MethodGet, Path: "/jobs/{id}", ID: "getJob", Tag: "jobs",
+			Summary: "Get the status of an upload or import job",
+			Role:    middleware.RoleUploader, Scope: middleware.ScopeRead,
+			Params: []apiParam{{Name: "id", In: "path", Type: "string", Required: true}},
+			Status: http.StatusOK, Response: &JobStatus{},
+			Handler: a.apiGetJob,
+		},
+	}
+}
+
+// registerAPI adds the routes of the JSON API (and of its OpenAPI
+// document) to the router r.
+func (a *App) registerAPI(r *mux.Router) {
+	api := r.PathPrefix(apiPrefix).Subrouter()
+	for _, route := range a.apiRoutes() {
+		api.HandleFunc(route.Path, a.apiRequire(route.Role, route.Scope, route.Handler)).
+			Methods(route.Method, http.MethodOptions)
+	}
+	api.HandleFunc("/openapi.json", a.apiRequire("", "", a.openAPIHandler)).
+		Methods(http.MethodGet, http.MethodOptions)
+}
+
+// writeJSON sends the response v of the JSON API with the status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("error encoding API response")
+	}
+}
+
+// writeAPIError sends an error response of the JSON API.
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	res := &apiError{}
+	res.Error.Status = status
+	res.Error.Message = message
+	writeJSON(w, status, res)
+}
+
+// isAPI returns true if the request r is made to the JSON API.
+func isAPI(r *http.Request) bool {
+	return r.URL.Path == apiPrefix || strings.HasPrefix(r.URL.Path, apiPrefix+"/")
+}
+
+// notFoundHandler responds to the requests matching no route, with a JSON
+// error for those made to the JSON API.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	if isAPI(r) {
+		writeAPIError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// methodNotAllowedHandler responds to the requests matching a route with
+// another method, with a JSON error for those made to the JSON API.
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	if isAPI(r) {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+}
+
+// apiRequire protects the handler of an API route with the role (if any)
+// like requireScope, but with JSON errors, and without asking browsers for
+// credentials. Routes with a role always require an identity (even in the
+// basic auth mode without an auth_password), unless auth is disabled with
+// the none auth mode.
+func (a *App) apiRequire(role middleware.Role, scope string, handler http.HandlerFunc) http.HandlerFunc {
+	open := a.authDisabled()
+	return func(w http.ResponseWriter, r *http.Request) {
+		// For request needing CORS, send a 204.
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		id := middleware.GetIdentity(r)
+		switch {
+		case role == "", id == nil && open:
+		case id == nil:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tube"`)
+			writeAPIError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		case !id.Role.Allows(role):
+			writeAPIError(w, http.StatusForbidden, fmt.Sprintf("the %s role is required", role))
+			return
+		case !id.HasScope(scope):
+			writeAPIError(w, http.StatusForbidden, fmt.Sprintf("the %s scope is required", scope))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// apiLimit returns the page size requested with r.
+func apiLimit(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("limit")
+	if s == "" {
+		return playlistPageSize, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > maxPlaylistPageSize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", maxPlaylistPageSize)
+	}
+	return n, nil
+}
+
+// newAPIVideos returns the videos of the playlist pl as returned by the
+// JSON API.
+func newAPIVideos(pl media.Playlist) []*apiVideo {
+	videos := make([]*apiVideo, len(pl))
+	for i, v := range pl {
+		videos[i] = newAPIVideo(v)
+	}
+	return videos
+}
+
+// decodeJSON decodes the JSON request body of r into v.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, uploadParserBuffer))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %w", err)
+	}
+	return nil
+}
+
+// HTTP handler for GET /api/v1/videos
+func (a *App) apiListVideos(w http.ResponseWriter, r *http.Request) {
+	n, err := apiLimit(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sort := strings.ToLower(r.URL.Query().Get("sort"))
+	page, next, err := a.playlistPage(middleware.GetIdentity(r), parseFilter(r), sort, r.URL.Query().Get("after"), n)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, &apiVideoPage{Videos: newAPIVideos(page), Next: next})
+}
+
+// HTTP handler for GET /api/v1/search
+// The cursors of the pages of results are their offsets.
+func (a *App) apiSearchVideos(w http.ResponseWriter, r *http.Request) {
+	n, err := apiLimit(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	offset := 0
+	if s := r.URL.Query().Get("after"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("invalid cursor %q", s))
+			return
+		}
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	prefix := strings.Trim(r.URL.Query().Get("collection"), "/")
+	results := listed(middleware.GetIdentity(r), a.Library.Search(q, prefix))
+
+	res := &apiVideoPage{}
+	if offset < len(results) {
+		end := offset + n
+		if end < len(results) {
+			res.Next = strconv.Itoa(end)
+		} else {
+			end = len(results)
+		}
+		results = results[offset:end]
+		a.loadViews(results)
+		res.Videos = newAPIVideos(results)
+	} else {
+		res.Videos = []*apiVideo{}
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// HTTP handler for GET /api/v1/videos/id
+func (a *App) apiGetVideo(w http.ResponseWriter, r *http.Request) {
+	m, ok := a.video(r, mux.Vars(r)["id"])
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Video Not Found")
+		return
+	}
+	a.loadViews(media.Playlist{m})
+	writeJSON(w, http.StatusOK, newAPIVideo(m))
+}
+
+// HTTP handler for POST /api/v1/videos
+func (a *App) apiUploadVideo(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, a.Config.Server.MaxUploadSize+uploadParserBuffer)
+	if err := r.ParseMultipartForm(uploadParserBuffer); err != nil {
+		status := http.StatusBadRequest
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeAPIError(w, status, fmt.Sprintf("error processing form: %s", err))
+		return
+	}
+	file, handler, err := r.FormFile("file")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("error processing form: %s", err))
+		return
+	}
+	defer file.Close()
+
+	visibility, err := media.ParseVisibility(r.FormValue("visibility"))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	job := &Job{
+		Kind:        JobUpload,
+		Library:     r.FormValue("library"),
+		Filename:    handler.Filename,
+		Title:       r.FormValue("title"),
+		Description: r.FormValue("description"),
+		Tags:        media.ParseTags(r.FormValue("tags")),
+		Category:    strings.TrimSpace(r.FormValue("category")),
+		Owner:       owner(r),
+		Visibility:  visibility,
+	}
+	if job.Library == "" {
+		if job.Library, err = a.defaultLibrary(); err != nil {
+			writeAPIError(w, libraryErrorStatus(err), err.Error())
+			return
+		}
+	}
+	a.apiQueued(w, job, a.queueUpload(file, job))
+}
+
+// HTTP handler for POST /api/v1/imports
+func (a *App) apiImportVideo(w http.ResponseWriter, r *http.Request) {
+	var req apiImport
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	visibility, err := media.ParseVisibility(req.Visibility)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	job := &Job{
+		Kind:       JobImport,
+		Library:    req.Library,
+		URL:        strings.TrimSpace(req.URL),
+		Owner:      owner(r),
+		Visibility: visibility,
+	}
+	a.apiQueued(w, job, a.queueImport(job))
+}
+
+// apiQueued responds to a request queuing the job, with its status or the
+// error queuing it.
+func (a *App) apiQueued(w http.ResponseWriter, job *Job, err error) {
+	if err != nil {
+		status := libraryErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Error(err)
+		}
+		writeAPIError(w, status, err.Error())
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/jobs/%s", apiPrefix, job.ID))
+	writeJSON(w, http.StatusAccepted, job.Status())
+}
+
+// HTTP handler for PATCH /api/v1/videos/id
+func (a *App) apiEditVideo(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	m, ok := a.video(r, id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Video Not Found")
+		return
+	}
+	if !a.canEdit(r, m.Owner) {
+		writeAPIError(w, http.StatusForbidden, "only the owner of the video or an admin may edit it")
+		return
+	}
+	if m.Location.ReadOnly {
+		writeAPIError(w, http.StatusForbidden, media.ErrReadOnly.Error())
+		return
+	}
+
+	var req apiVideoChanges
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	changes := make(map[string]interface{})
+	for key, value := range map[string]*string{
+		"title":       req.Title,
+		"description": req.Description,
+		"category":    req.Category,
+	} {
+		if value != nil {
+			changes[key] = strings.TrimSpace(*value)
+		}
+	}
+	if req.Tags != nil {
+		changes["tags"] = media.ParseTags(strings.Join(*req.Tags, ","))
+	}
+	if req.Visibility != nil {
+		visibility, err := media.ParseVisibility(*req.Visibility)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		changes["visibility"] = visibility
+	}
+
+	m, err := a.updateVideo(m, changes)
+	if err != nil {
+		status := libraryErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.WithError(err).WithField("id", id).Error("error editing video")
+		}
+		writeAPIError(w, status, err.Error())
+		return
+	}
+	a.loadViews(media.Playlist{m})
+	writeJSON(w, http.StatusOK, newAPIVideo(m))
+}
+
+// HTTP handler for DELETE /api/v1/videos/id
+func (a *App) apiDeleteVideo(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	m, ok := a.video(r, id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "Video Not Found")
+		return
+	}
+	if !a.canEdit(r, m.Owner) {
+		writeAPIError(w, http.StatusForbidden, "only the owner of the video or an admin may delete it")
+		return
+	}
+	if _, err := a.deleteVideo(m); err != nil {
+		status := libraryErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.WithError(err).WithField("id", id).Error("error deleting video")
+		}
+		writeAPIError(w, status, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HTTP handler for GET /api/v1/collections
+func (a *App) apiListCollections(w http.ResponseWriter, r *http.Request) {
+	counts := make(map[string]int)
+	for _, v := range listed(middleware.GetIdentity(r), a.Library.Playlist()) {
+		if v.Location != nil {
+			counts[v.Location.Path]++
+		}
+	}
+
+	res := []*apiCollection{}
+	for _, pc := range a.Config.Library {
+		p, ok := a.Library.Paths[pc.Path]
+		if !ok {
+			continue
+		}
+		c := &apiCollection{
+			Path:        p.Path,
+			Prefix:      p.Prefix,
+			Title:       pc.Title,
+			Description: pc.Description,
+			ReadOnly:    p.ReadOnly,
+			Videos:      counts[p.Path],
+		}
+		if p.Prefix != "" {
+			c.Title = collectionTitle(pc)
+			c.URL = fmt.Sprintf("/c/%s", p.Prefix)
+			if pc.Cover != "" {
+				c.Cover = fmt.Sprintf("/c/%s/cover", p.Prefix)
+			}
+		}
+		res = append(res, c)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// HTTP handler for GET /api/v1/jobs/id
+func (a *App) apiGetJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	st, err := a.Jobs.Status(id)
+	if err != nil {
+		log.WithError(err).WithField("job", id).Debug("error retrieving job")
+		writeAPIError(w, http.StatusNotFound, "Job Not Found")
+		return
+	}
+	if !canFollowJob(middleware.GetIdentity(r), st) {
+		writeAPIError(w, http.StatusNotFound, "Job Not Found")
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
@@ -2,9 +2,14 @@
 package app
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -13,20 +18,18 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 
 	"git.mills.io/prologic/tube/app/middleware"
 	"git.mills.io/prologic/tube/importers"
 	"git.mills.io/prologic/tube/media"
 	"git.mills.io/prologic/tube/static"
 	"git.mills.io/prologic/tube/templates"
-	"git.mills.io/prologic/tube/utils"
 
-	securejoin "github.com/cyphar/filepath-securejoin"
 	"github.com/dustin/go-humanize"
 	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	shortuuid "github.com/lithammer/shortuuid/v3"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -35,6 +38,14 @@ type App struct {
 	Config    *Config
 	Library   *media.Library
 	Store     Store
+	Views     *Views
+	Jobs      *JobQueue
+	Live      *LiveTranscoder
+	Trash     *Trash
+	Users     *Users
+	OIDC      *OIDC
+	Tokens    *Tokens
+	Shares    *Shares
 	Watcher   *fsnotify.Watcher
 	Templates *templateStore
 	Feed      []byte
@@ -45,11 +56,22 @@ type App struct {
 // 1MB buffer in RAM seems enough
 const uploadParserBuffer = 1_048_576
 
+var (
+	errInvalidLibrary    = errors.New("invalid library path")
+	errReadOnlyLibrary   = errors.New("read-only library path")
+	errNoWritableLibrary = errors.New("error, every library path is read-only")
+	errNoURL             = errors.New("error, no url supplied")
+	errInvalidImport     = errors.New("error creating video importer")
+)
+
 // NewApp returns a new instance of App from Config.
 func NewApp(cfg *Config) (*App, error) {
 	if cfg == nil {
 		cfg = DefaultConfig()
 	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
 	a := &App{
 		Config: cfg,
 	}
@@ -62,6 +84,32 @@ func NewApp(cfg *Config) (*App, error) {
 		return nil, err
 	}
 	a.Store = store
+	// Setup View Counter
+	a.Views = newViews(store)
+	// Setup Job Queue
+	a.Jobs = newJobQueue(cfg.Jobs, store)
+	a.Jobs.Handle(JobUpload, a.processUpload)
+	a.Jobs.Handle(JobImport, a.processImport)
+	// Setup Live Transcoder
+	if cfg.Transcoder.Live.Enabled {
+		a.Live = newLiveTranscoder(cfg.Transcoder)
+	}
+	// Setup Trash
+	a.Trash = newTrash(cfg.Trash, store)
+	// Setup Users
+	if cfg.Auth.Mode == authModeUsers {
+		a.Users = newUsers(cfg.Auth, store)
+		if cfg.Auth.OIDC != nil {
+			a.OIDC = newOIDC(cfg.Auth.OIDC)
+		}
+	}
+	if a.unprotected() {
+		log.Warn("app: no auth_password is set, editing and deleting videos and the trash are disabled")
+	}
+	// Setup API Tokens
+	a.Tokens = newTokens(store, a.tokenRole)
+	// Setup Share Links
+	a.Shares = newShares(store)
 	// Setup Watcher
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -80,7 +128,12 @@ func NewApp(cfg *Config) (*App, error) {
 	a.Templates = newTemplateStore("base")
 
 	templateFuncs := map[string]interface{}{
-		"bytes": func(size int64) string { return humanize.Bytes(uint64(size)) },
+		"bytes":        func(size int64) string { return humanize.Bytes(uint64(size)) },
+		"contenttype":  a.videoContentType,
+		"duration":     formatDuration,
+		"collections":  cfg.collections,
+		"title":        collectionTitle,
+		"visibilities": func() []media.Visibility { return media.Visibilities },
 	}
 
 	indexTemplate := template.New("index").Funcs(templateFuncs)
@@ -98,25 +151,102 @@ func NewApp(cfg *Config) (*App, error) {
 	template.Must(importTemplate.Parse(templates.MustGetTemplate("base.html")))
 	a.Templates.Add("import", importTemplate)
 
+	editTemplate := template.New("edit").Funcs(templateFuncs)
+	template.Must(editTemplate.Parse(templates.MustGetTemplate("edit.html")))
+	template.Must(editTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("edit", editTemplate)
+
+	searchTemplate := template.New("search").Funcs(templateFuncs)
+	template.Must(searchTemplate.Parse(templates.MustGetTemplate("search.html")))
+	template.Must(searchTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("search", searchTemplate)
+
+	videosTemplate := template.New("videos").Funcs(templateFuncs)
+	template.Must(videosTemplate.Parse(templates.MustGetTemplate("videos.html")))
+	template.Must(videosTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("videos", videosTemplate)
+
+	loginTemplate := template.New("login").Funcs(templateFuncs)
+	template.Must(loginTemplate.Parse(templates.MustGetTemplate("login.html")))
+	template.Must(loginTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("login", loginTemplate)
+
+	usersTemplate := template.New("users").Funcs(templateFuncs)
+	template.Must(usersTemplate.Parse(templates.MustGetTemplate("users.html")))
+	template.Must(usersTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("users", usersTemplate)
+
+	sharesTemplate := template.New("shares").Funcs(templateFuncs)
+	template.Must(sharesTemplate.Parse(templates.MustGetTemplate("shares.html")))
+	template.Must(sharesTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("shares", sharesTemplate)
+
+	tokensTemplate := template.New("tokens").Funcs(templateFuncs)
+	template.Must(tokensTemplate.Parse(templates.MustGetTemplate("tokens.html")))
+	template.Must(tokensTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("tokens", tokensTemplate)
+
+	sharedTemplate := template.New("shared").Funcs(templateFuncs)
+	template.Must(sharedTemplate.Parse(templates.MustGetTemplate("shared.html")))
+	template.Must(sharedTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("shared", sharedTemplate)
+
 	// Setup Router
-	authPassword := os.Getenv("auth_password")
-	isSandstorm := os.Getenv("SANDSTORM")
+	viewer := middleware.RoleViewer
+	uploader := middleware.RoleUploader
+	admin := middleware.RoleAdmin
 
 	r := mux.NewRouter().StrictSlash(true)
 	r.HandleFunc("/", a.indexHandler).Methods("GET", "OPTIONS")
-	if isSandstorm == "1" {
-		r.HandleFunc("/upload", middleware.RequireSandstormPermission(a.uploadHandler, "upload")).Methods("GET", "OPTIONS", "POST")
-	} else {
-		r.HandleFunc("/upload", middleware.OptionallyRequireAdminAuth(a.uploadHandler, authPassword)).Methods("GET", "OPTIONS", "POST")
-	}
-	r.HandleFunc("/import", a.importHandler).Methods("GET", "OPTIONS", "POST")
-	r.HandleFunc("/v/{id}.mp4", a.videoHandler).Methods("GET")
-	r.HandleFunc("/v/{prefix}/{id}.mp4", a.videoHandler).Methods("GET")
-	r.HandleFunc("/t/{id}", a.thumbHandler).Methods("GET")
-	r.HandleFunc("/t/{prefix}/{id}", a.thumbHandler).Methods("GET")
-	r.HandleFunc("/v/{id}", a.pageHandler).Methods("GET")
-	r.HandleFunc("/v/{prefix}/{id}", a.pageHandler).Methods("GET")
+	r.HandleFunc("/upload", a.requireRole(uploader, a.uploadHandler)).Methods("GET", "OPTIONS", "POST")
+	r.HandleFunc("/import", a.requireScope(uploader, middleware.ScopeImport, a.importHandler)).Methods("GET", "OPTIONS", "POST")
+	r.HandleFunc("/edit/{id:.+}", a.requireEditor(a.editHandler)).Methods("GET", "OPTIONS", "POST")
+	r.HandleFunc("/trash", a.requireEditor(a.trashHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/trash/{id}/restore", a.requireEditor(a.trashEntryHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/trash/{id}", a.requireEditor(a.trashEntryHandler)).Methods("DELETE", "OPTIONS")
+	if a.Users != nil {
+		r.HandleFunc("/login", a.loginHandler).Methods("GET", "POST")
+		r.HandleFunc("/logout", a.logoutHandler).Methods("POST")
+		if a.OIDC != nil {
+			r.HandleFunc("/login/oidc", a.oidcLoginHandler).Methods("GET")
+			r.HandleFunc("/login/oidc/callback", a.oidcCallbackHandler).Methods("GET")
+		}
+		r.HandleFunc("/account", a.requireRole(viewer, a.accountHandler)).Methods("POST")
+		r.HandleFunc("/users", a.requireRole(admin, a.usersHandler)).Methods("GET", "POST")
+		r.HandleFunc("/users/{name}/delete", a.requireRole(admin, a.userHandler)).Methods("POST")
+		r.HandleFunc("/users/{name}", a.requireRole(admin, a.userHandler)).Methods("POST", "DELETE", "OPTIONS")
+	}
+	// API tokens aren't accepted on Sandstorm, which authenticates the users
+	if os.Getenv("SANDSTORM") != "1" {
+		r.HandleFunc("/tokens", a.requireRole(viewer, a.tokensHandler)).Methods("GET", "OPTIONS", "POST")
+		r.HandleFunc("/tokens/{id}/revoke", a.requireRole(viewer, a.tokenHandler)).Methods("POST", "OPTIONS")
+		r.HandleFunc("/tokens/{id}", a.requireRole(viewer, a.tokenHandler)).Methods("DELETE", "OPTIONS")
+	}
+	r.HandleFunc("/shares", a.requireRole(uploader, a.sharesHandler)).Methods("GET", "OPTIONS", "POST")
+	r.HandleFunc("/shares/rotate", a.requireRole(admin, a.shareRotateHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/shares/{id}/revoke", a.requireRole(uploader, a.shareHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/shares/{id}", a.requireRole(uploader, a.shareHandler)).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/search", a.searchHandler).Methods("GET")
+	r.HandleFunc("/playlist", a.playlistHandler).Methods("GET")
+	r.HandleFunc("/tag/{name}/feed.xml", a.tagFeedHandler).Methods("GET")
+	r.HandleFunc("/tag/{name}", a.tagHandler).Methods("GET")
+	r.HandleFunc("/category/{name}", a.categoryHandler).Methods("GET")
+	r.HandleFunc("/c/{prefix:.+}/feed.xml", a.collectionFeedHandler).Methods("GET")
+	r.HandleFunc("/c/{prefix:.+}/cover", a.collectionCoverHandler).Methods("GET")
+	r.HandleFunc("/c/{prefix:.+}", a.collectionHandler).Methods("GET")
+	r.HandleFunc("/jobs/{id}", a.requireScope(uploader, middleware.ScopeRead, a.jobHandler)).Methods("GET")
+	// stream files come first, as the HLS init segment ends in .mp4
+	r.HandleFunc("/v/{id:.+}/hls/{file}", a.shared(a.hlsHandler)).Methods("GET")
+	r.HandleFunc("/v/{id:.+}/dash/{file}", a.shared(a.dashHandler)).Methods("GET")
+	r.HandleFunc("/v/{id:.+}.mpd", a.shared(a.dashHandler)).Methods("GET")
+	r.HandleFunc("/v/{id:.+}.mp4", a.shared(a.videoHandler)).Methods("GET")
+	r.HandleFunc("/t/{id:.+}", a.shared(a.thumbHandler)).Methods("GET")
+	r.HandleFunc("/v/{id:.+}", a.requireEditor(a.deleteHandler)).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/v/{id:.+}", a.shared(a.pageHandler)).Methods("GET")
 	r.HandleFunc("/feed.xml", a.rssHandler).Methods("GET")
+	a.registerAPI(r)
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
 	// Static file handler
 	fsHandler := http.StripPrefix(
 		"/static",
@@ -134,6 +264,8 @@ func NewApp(cfg *Config) (*App, error) {
 			"GET",
 			"POST",
 			"PUT",
+			"PATCH",
+			"DELETE",
 			"HEAD",
 			"OPTIONS",
 		}),
@@ -142,6 +274,7 @@ func NewApp(cfg *Config) (*App, error) {
 	)
 
 	r.Use(cors)
+	r.Use(middleware.Authenticate(a.authenticator()))
 
 	a.Router = r
 	return a, nil
@@ -149,14 +282,30 @@ func NewApp(cfg *Config) (*App, error) {
 
 // Run imports the library and starts server.
 func (a *App) Run() error {
+	a.Library.Index = a.Store
 	for _, pc := range a.Config.Library {
 		pc.Path = filepath.Clean(pc.Path)
+		storage, err := pc.Storage.storage(pc.Path)
+		if err != nil {
+			return err
+		}
 		p := &media.Path{
 			Path:                   pc.Path,
 			Prefix:                 pc.Prefix,
 			PreserveUploadFilename: pc.PreserveUploadFilename,
+			DASH:                   pc.DASH,
+			Extensions:             pc.Extensions,
+			Recursive:              pc.Recursive,
+			Storage:                storage,
+			ReadOnly:               pc.ReadOnly,
+		}
+		if pc.SidecarPath != "" {
+			if err := os.MkdirAll(pc.SidecarPath, 0o755); err != nil {
+				return fmt.Errorf("error creating sidecar path %s: %w", pc.SidecarPath, err)
+			}
+			p.Sidecars = media.NewLocalStorage(pc.SidecarPath)
 		}
-		err := a.Library.AddPath(p)
+		err = a.Library.AddPath(p)
 		if err != nil {
 			return err
 		}
@@ -164,7 +313,12 @@ func (a *App) Run() error {
 		if err != nil {
 			return err
 		}
-		a.Watcher.Add(p.Path)
+		if p.Local() {
+			a.watch(p.Path)
+		}
+	}
+	if err := a.Library.PruneIndex(); err != nil {
+		log.WithError(err).Warn("error pruning library index")
 	}
 	if _, err := os.Stat(a.Config.Server.UploadPath); err != nil && os.IsNotExist(err) {
 		log.Warn(
@@ -176,11 +330,41 @@ func (a *App) Run() error {
 				a.Config.Server.UploadPath, err)
 		}
 	}
+	if err := a.Jobs.Start(); err != nil {
+		return err
+	}
+	if a.Live != nil {
+		if err := a.Live.Start(); err != nil {
+			return err
+		}
+	}
+	if a.Config.Trash.Enabled {
+		if err := a.Trash.Start(); err != nil {
+			return err
+		}
+	}
+	if a.Users != nil {
+		if err := a.Users.Start(); err != nil {
+			return err
+		}
+	}
+	if err := a.Shares.Start(); err != nil {
+		return err
+	}
+	a.Views.Start(a.Config.Server.ViewsFlushInterval)
 	buildFeed(a)
 	go startWatcher(a)
 	return http.Serve(a.Listener, a.Router)
 }
 
+// Close writes the pending view counts back to the store and closes it.
+func (a *App) Close() error {
+	if err := a.Views.Flush(); err != nil {
+		log.WithError(err).Error("error flushing views")
+	}
+	return a.Store.Close()
+}
+
 func (a *App) render(name string, w http.ResponseWriter, ctx interface{}) {
 	buf, err := a.Templates.Exec(name, ctx)
 	if err != nil {
@@ -196,7 +380,8 @@ func (a *App) render(name string, w http.ResponseWriter, ctx interface{}) {
 // HTTP handler for /
 func (a *App) indexHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("/")
-	pl := a.Library.Playlist()
+	filter := parseFilter(r)
+	pl := listed(middleware.GetIdentity(r), filter.Apply(a.Library.Playlist()))
 	if len(pl) > 0 {
 		http.Redirect(w, r, fmt.Sprintf("/v/%s?%s", pl[0].ID, r.URL.RawQuery), 302)
 	} else {
@@ -204,27 +389,132 @@ func (a *App) indexHandler(w http.ResponseWriter, r *http.Request) {
 		quality := strings.ToLower(r.URL.Query().Get("quality"))
 		ctx := &struct {
 			Sort     string
+			Filter   playlistFilter
 			Quality  string
+			HLS      bool
 			Config   *Config
 			Playing  *media.Video
 			Playlist media.Playlist
 		}{
 			Sort:     sort,
+			Filter:   filter,
 			Quality:  quality,
 			Config:   a.Config,
 			Playing:  &media.Video{ID: ""},
-			Playlist: a.Library.Playlist(),
+			Playlist: pl,
 		}
 
 		a.render("index", w, ctx)
 	}
 }
 
+// formatDuration formats d as [h:]mm:ss
+func formatDuration(d time.Duration) string {
+	s := int(d.Round(time.Second).Seconds())
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
 func filenameWithoutExtension(path string) (stem string) {
 	basename := filepath.Base(path)
 	return basename[0 : len(basename)-len(filepath.Ext(basename))]
 }
 
+// queueUpload saves the uploaded file and queues the job transcoding it
+// into its library path.
+func (a *App) queueUpload(file io.Reader, job *Job) error {
+	p, exists := a.Library.Paths[job.Library]
+	if !exists {
+		return fmt.Errorf("uploading to %w: %s", errInvalidLibrary, job.Library)
+	}
+	if p.ReadOnly {
+		return fmt.Errorf("uploading to %w: %s", errReadOnlyLibrary, job.Library)
+	}
+
+	uf, err := ioutil.TempFile(
+		a.Config.Server.UploadPath,
+		fmt.Sprintf("tube-upload-*%s", filepath.Ext(job.Filename)),
+	)
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for uploading: %w", err)
+	}
+	defer uf.Close()
+
+	if _, err := io.Copy(uf, file); err != nil {
+		os.Remove(uf.Name())
+		return fmt.Errorf("error writing file: %w", err)
+	}
+
+	job.Source = uf.Name()
+	if err := a.Jobs.Enqueue(job); err != nil {
+		os.Remove(uf.Name())
+		return fmt.Errorf("error queuing video for transcoding: %w", err)
+	}
+	return nil
+}
+
+// defaultLibrary returns the library path videos are added to when none is
+// given: the first writable one (sorted).
+func (a *App) defaultLibrary() (string, error) {
+	keys := make([]string, 0, len(a.Library.Paths))
+	for k, p := range a.Library.Paths {
+		if !p.ReadOnly {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return "", errNoWritableLibrary
+	}
+	sort.Strings(keys)
+	return keys[0], nil
+}
+
+// queueImport queues the job importing the video at its URL into its
+// library path, defaulting to the defaultLibrary.
+func (a *App) queueImport(job *Job) error {
+	if job.URL == "" {
+		return errNoURL
+	}
+
+	if job.Library == "" {
+		library, err := a.defaultLibrary()
+		if err != nil {
+			return err
+		}
+		job.Library = library
+	} else if p, exists := a.Library.Paths[job.Library]; !exists {
+		return fmt.Errorf("importing to %w: %s", errInvalidLibrary, job.Library)
+	} else if p.ReadOnly {
+		return fmt.Errorf("importing to %w: %s", errReadOnlyLibrary, job.Library)
+	}
+
+	if _, err := importers.NewImporter(job.URL); err != nil {
+		return fmt.Errorf("%w for %s: %w", errInvalidImport, job.URL, err)
+	}
+
+	if err := a.Jobs.Enqueue(job); err != nil {
+		return fmt.Errorf("error queuing video for importing: %w", err)
+	}
+	return nil
+}
+
+// libraryErrorStatus returns the HTTP status of an error adding or
+// changing videos of the library.
+func libraryErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidLibrary), errors.Is(err, errNoURL), errors.Is(err, errInvalidImport):
+		return http.StatusBadRequest
+	case errors.Is(err, errReadOnlyLibrary), errors.Is(err, errNoWritableLibrary), errors.Is(err, media.ErrReadOnly):
+		return http.StatusForbidden
+	case errors.Is(err, errVideoExists):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 // HTTP handler for /upload
 func (a *App) uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
@@ -248,179 +538,33 @@ func (a *App) uploadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer file.Close()
 
-		title := r.FormValue("video_title")
-		description := r.FormValue("video_description")
-		if _, exists := a.Library.Paths[r.FormValue("target_library_path")]; !exists {
-			err := fmt.Errorf("uploading to invalid library path: %s", r.FormValue("target_library_path"))
-			log.Error(err)
-			return
-		}
-		targetLibraryPath := r.FormValue("target_library_path")
-
-		uf, err := ioutil.TempFile(
-			a.Config.Server.UploadPath,
-			fmt.Sprintf("tube-upload-*%s", filepath.Ext(handler.Filename)),
-		)
-		if err != nil {
-			err := fmt.Errorf("error creating temporary file for uploading: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer os.Remove(uf.Name())
-
-		_, err = io.Copy(uf, file)
-		if err != nil {
-			err := fmt.Errorf("error writing file: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		tf, err := ioutil.TempFile(
-			a.Config.Server.UploadPath,
-			fmt.Sprintf("tube-transcode-*.mp4"),
-		)
-		if err != nil {
-			err := fmt.Errorf("error creating temporary file for transcoding: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// Here we set the final filename for the video file after transcoding.
-		var vf string
-		if a.Config.Server.PreserveUploadFilename ||
-			a.Library.Paths[targetLibraryPath].PreserveUploadFilename {
-			vf, err = securejoin.SecureJoin(
-				a.Library.Paths[targetLibraryPath].Path,
-				fmt.Sprintf("%s.mp4", filenameWithoutExtension(handler.Filename)),
-			)
-		} else {
-			vf, err = securejoin.SecureJoin(
-				a.Library.Paths[targetLibraryPath].Path,
-				fmt.Sprintf("%s.mp4", shortuuid.New()),
-			)
-		}
+		visibility, err := media.ParseVisibility(r.FormValue("video_visibility"))
 		if err != nil {
-			err := fmt.Errorf("error creating file name in target library: %w", err)
 			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// If the (sanitized) original filename collides with an existing file,
-		// we try to add a shortuuid() to it until we find one that doesn't exist.
-		for _, err := os.Stat(vf); !os.IsNotExist(err); _, err = os.Stat(vf) {
-			if err != nil {
-				log.Error(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			log.Warn("File '" + vf + "' already exists.")
-			vf, err = securejoin.SecureJoin(
-				a.Library.Paths[targetLibraryPath].Path,
-				fmt.Sprintf("%s_%s.mp4", filenameWithoutExtension(vf), shortuuid.New()),
-			)
-			if err != nil {
-				err := fmt.Errorf("error creating file name in target library: %w", err)
-				log.Error(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			log.Warn("Using filename '" + vf + "' instead.")
-		}
-
-		thumbFn1 := fmt.Sprintf("%s.jpg", strings.TrimSuffix(tf.Name(), filepath.Ext(tf.Name())))
-		thumbFn2 := fmt.Sprintf("%s.jpg", strings.TrimSuffix(vf, filepath.Ext(vf)))
-
-		// TODO: Use a proper Job Queue and make this async
-		if err := utils.RunCmd(
-			a.Config.Transcoder.Timeout,
-			"ffmpeg",
-			"-y",
-			"-i", uf.Name(),
-			"-vcodec", "h264",
-			"-acodec", "aac",
-			"-strict", "-2",
-			"-loglevel", "quiet",
-			"-metadata", fmt.Sprintf("title=%s", title),
-			"-metadata", fmt.Sprintf("comment=%s", description),
-			tf.Name(),
-		); err != nil {
-			err := fmt.Errorf("error transcoding video: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if err := utils.RunCmd(
-			a.Config.Thumbnailer.Timeout,
-			"ffmpeg",
-			"-i", uf.Name(),
-			"-y",
-			"-vf", "thumbnail",
-			"-t", fmt.Sprint(a.Config.Thumbnailer.PositionFromStart),
-			"-vframes", "1",
-			"-strict", "-2",
-			"-loglevel", "quiet",
-			thumbFn1,
-		); err != nil {
-			err := fmt.Errorf("error generating thumbnail: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if err := os.Rename(thumbFn1, thumbFn2); err != nil {
-			err := fmt.Errorf("error renaming generated thumbnail: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		job := &Job{
+			Kind:        JobUpload,
+			Library:     r.FormValue("target_library_path"),
+			Filename:    handler.Filename,
+			Title:       r.FormValue("video_title"),
+			Description: r.FormValue("video_description"),
+			Tags:        media.ParseTags(r.FormValue("video_tags")),
+			Category:    strings.TrimSpace(r.FormValue("video_category")),
+			Owner:       owner(r),
+			Visibility:  visibility,
 		}
-
-		if err := os.Rename(tf.Name(), vf); err != nil {
-			err := fmt.Errorf("error renaming transcoded video: %w", err)
+		if err := a.queueUpload(file, job); err != nil {
 			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), libraryErrorStatus(err))
 			return
 		}
 
-		// TODO: Make this a background job
-		// Resize for lower quality options
-		for size, suffix := range a.Config.Transcoder.Sizes {
-			log.
-				WithField("size", size).
-				WithField("vf", filepath.Base(vf)).
-				Info("resizing video for lower quality playback")
-			sf := fmt.Sprintf(
-				"%s#%s.mp4",
-				strings.TrimSuffix(vf, filepath.Ext(vf)),
-				suffix,
-			)
-
-			if err := utils.RunCmd(
-				a.Config.Transcoder.Timeout,
-				"ffmpeg",
-				"-y",
-				"-i", vf,
-				"-s", size,
-				"-c:v", "libx264",
-				"-c:a", "aac",
-				"-crf", "18",
-				"-strict", "-2",
-				"-loglevel", "quiet",
-				"-metadata", fmt.Sprintf("title=%s", title),
-				"-metadata", fmt.Sprintf("comment=%s", description),
-				sf,
-			); err != nil {
-				err := fmt.Errorf("error transcoding video: %w", err)
-				log.Error(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}
-
-		fmt.Fprintf(w, "Video successfully uploaded!")
+		w.Header().Set("Location", fmt.Sprintf("/jobs/%s", job.ID))
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Video successfully uploaded! Processing as job %s", job.ID)
 	} else {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 	}
@@ -440,186 +584,106 @@ func (a *App) importHandler(w http.ResponseWriter, r *http.Request) {
 	} else if r.Method == "POST" {
 		r.ParseMultipartForm(1024)
 
-		url := r.FormValue("url")
-		if url == "" {
-			err := fmt.Errorf("error, no url supplied")
+		visibility, err := media.ParseVisibility(r.FormValue("visibility"))
+		if err != nil {
 			log.Error(err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		// TODO: Make collection user selectable from drop-down in Form
-		// XXX: Assume we can put uploaded videos into the first collection (sorted) we find
-		keys := make([]string, 0, len(a.Library.Paths))
-		for k := range a.Library.Paths {
-			keys = append(keys, k)
+		job := &Job{
+			Kind:       JobImport,
+			URL:        r.FormValue("url"),
+			Owner:      owner(r),
+			Visibility: visibility,
 		}
-		sort.Strings(keys)
-		collection := keys[0]
-
-		videoImporter, err := importers.NewImporter(url)
-		if err != nil {
-			err := fmt.Errorf("error creating video importer for %s: %w", url, err)
+		if err := a.queueImport(job); err != nil {
 			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), libraryErrorStatus(err))
 			return
 		}
 
-		videoInfo, err := videoImporter.GetVideoInfo(url)
-		if err != nil {
-			err := fmt.Errorf("error retriving video info for %s: %w", url, err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		uf, err := ioutil.TempFile(
-			a.Config.Server.UploadPath,
-			fmt.Sprintf("tube-import-*.mp4"),
-		)
-		if err != nil {
-			err := fmt.Errorf("error creating temporary file for importing: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer os.Remove(uf.Name())
+		w.Header().Set("Location", fmt.Sprintf("/jobs/%s", job.ID))
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "Video successfully queued for importing as job %s", job.ID)
+	} else {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
 
-		log.WithField("video_url", videoInfo.VideoURL).Info("requesting video size")
+// HTTP handler for /jobs/id
+// Responds with the JobStatus as JSON, or as a stream of Server-Sent Events
+// (one per update, until the job is finished) if the client accepts them.
+func (a *App) jobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
 
-		res, err := http.Head(videoInfo.VideoURL)
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		st, err := a.Jobs.Status(id)
 		if err != nil {
-			err := fmt.Errorf("error getting size of video %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		contentLength := utils.SafeParseInt64(res.Header.Get("Content-Length"), -1)
-		if contentLength == -1 {
-			err := fmt.Errorf("error calculating size of video")
-			log.WithField("contentLength", contentLength).Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if contentLength > a.Config.Server.MaxUploadSize {
-			err := fmt.Errorf(
-				"imported video would exceed maximum upload size of %s",
-				humanize.Bytes(uint64(a.Config.Server.MaxUploadSize)),
-			)
-			log.
-				WithField("contentLength", contentLength).
-				WithField("max_upload_size", a.Config.Server.MaxUploadSize).
-				Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.WithError(err).WithField("job", id).Warn("error retrieving job")
+			http.Error(w, "Job Not Found", http.StatusNotFound)
 			return
 		}
-
-		log.WithField("contentLength", contentLength).Info("downloading video")
-
-		if err := utils.Download(videoInfo.VideoURL, uf.Name()); err != nil {
-			err := fmt.Errorf("error downloading video %s: %w", url, err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if !canFollowJob(middleware.GetIdentity(r), st) {
+			http.Error(w, "Job Not Found", http.StatusNotFound)
 			return
 		}
-
-		tf, err := ioutil.TempFile(
-			a.Config.Server.UploadPath,
-			fmt.Sprintf("tube-transcode-*.mp4"),
-		)
-		if err != nil {
-			err := fmt.Errorf("error creating temporary file for transcoding: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if err := json.NewEncoder(w).Encode(st); err != nil {
+			log.WithError(err).WithField("job", id).Error("error encoding job status")
 		}
+		return
+	}
 
-		vf := filepath.Join(
-			a.Library.Paths[collection].Path,
-			fmt.Sprintf("%s.mp4", shortuuid.New()),
-		)
-		thumbFn1 := fmt.Sprintf("%s.jpg", strings.TrimSuffix(tf.Name(), filepath.Ext(tf.Name())))
-		thumbFn2 := fmt.Sprintf("%s.jpg", strings.TrimSuffix(vf, filepath.Ext(vf)))
-
-		if err := utils.Download(videoInfo.ThumbnailURL, thumbFn1); err != nil {
-			err := fmt.Errorf("error downloading thumbnail: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming Not Supported", http.StatusInternalServerError)
+		return
+	}
 
-		// TODO: Use a proper Job Queue and make this async
-		if err := utils.RunCmd(
-			a.Config.Transcoder.Timeout,
-			"ffmpeg",
-			"-y",
-			"-i", uf.Name(),
-			"-vcodec", "h264",
-			"-acodec", "aac",
-			"-strict", "-2",
-			"-loglevel", "quiet",
-			"-metadata", fmt.Sprintf("title=%s", videoInfo.Title),
-			"-metadata", fmt.Sprintf("comment=%s", videoInfo.Description),
-			tf.Name(),
-		); err != nil {
-			err := fmt.Errorf("error transcoding video: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	// Subscribe before reading the current status so no update is missed.
+	updates, cancel := a.Jobs.Subscribe(id)
+	defer cancel()
 
-		if err := os.Rename(thumbFn1, thumbFn2); err != nil {
-			err := fmt.Errorf("error renaming generated thumbnail: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	st, err := a.Jobs.Status(id)
+	if err != nil {
+		log.WithError(err).WithField("job", id).Warn("error retrieving job")
+		http.Error(w, "Job Not Found", http.StatusNotFound)
+		return
+	}
+	if !canFollowJob(middleware.GetIdentity(r), st) {
+		http.Error(w, "Job Not Found", http.StatusNotFound)
+		return
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		log.WithError(err).WithField("job", id).Error("error encoding job status")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		if err := os.Rename(tf.Name(), vf); err != nil {
-			err := fmt.Errorf("error renaming transcoded video: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	flusher.Flush()
+	if st.State == JobDone || st.State == JobFailed {
+		return
+	}
 
-		// TODO: Make this a background job
-		// Resize for lower quality options
-		for size, suffix := range a.Config.Transcoder.Sizes {
-			log.
-				WithField("size", size).
-				WithField("vf", filepath.Base(vf)).
-				Info("resizing video for lower quality playback")
-			sf := fmt.Sprintf(
-				"%s#%s.mp4",
-				strings.TrimSuffix(vf, filepath.Ext(vf)),
-				suffix,
-			)
-
-			if err := utils.RunCmd(
-				a.Config.Transcoder.Timeout,
-				"ffmpeg",
-				"-y",
-				"-i", vf,
-				"-s", size,
-				"-c:v", "libx264",
-				"-c:a", "aac",
-				"-crf", "18",
-				"-strict", "-2",
-				"-loglevel", "quiet",
-				"-metadata", fmt.Sprintf("title=%s", videoInfo.Title),
-				"-metadata", fmt.Sprintf("comment=%s", videoInfo.Description),
-				sf,
-			); err != nil {
-				err := fmt.Errorf("error transcoding video: %w", err)
-				log.Error(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+	for {
+		select {
+		case data, ok := <-updates:
+			if !ok {
 				return
 			}
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
 		}
-
-		fmt.Fprintf(w, "Video successfully imported!")
-	} else {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 	}
 }
 
@@ -627,18 +691,15 @@ func (a *App) importHandler(w http.ResponseWriter, r *http.Request) {
 func (a *App) pageHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	prefix, ok := vars["prefix"]
-	if ok {
-		id = path.Join(prefix, id)
-	}
 	log.Printf("/v/%s", id)
-	playing, ok := a.Library.Videos[id]
+	playing, ok := a.video(r, id)
 	if !ok {
 		sort := strings.ToLower(r.URL.Query().Get("sort"))
 		quality := strings.ToLower(r.URL.Query().Get("quality"))
 		ctx := &struct {
 			Sort     string
 			Quality  string
+			HLS      bool
 			Config   *Config
 			Playing  *media.Video
 			Playlist media.Playlist
@@ -647,47 +708,37 @@ func (a *App) pageHandler(w http.ResponseWriter, r *http.Request) {
 			Quality:  quality,
 			Config:   a.Config,
 			Playing:  &media.Video{ID: ""},
-			Playlist: a.Library.Playlist(),
+			Playlist: listed(middleware.GetIdentity(r), a.Library.Playlist()),
 		}
 		a.render("upload", w, ctx)
 		return
 	}
 
-	views, err := a.Store.GetViews(id)
+	if share := middleware.GetShare(r); share != nil && share.Video == id {
+		a.renderShared(w, r, playing)
+		return
+	}
+
+	views, err := a.Views.Get(id)
 	if err != nil {
-		err := fmt.Errorf("error retrieving views for %s: %w", id, err)
 		log.Warn(err)
 	}
 
 	playing.Views = views
 
-	playlist := a.Library.Playlist()
-
-	// TODO: Optimize this? Bitcask has no concept of MultiGet / MGET
-	for _, video := range playlist {
-		views, err := a.Store.GetViews(video.ID)
-		if err != nil {
-			err := fmt.Errorf("error retrieving views for %s: %w", video.ID, err)
-			log.Warn(err)
-		}
-		video.Views = views
-	}
-
+	// The playlist can be filtered by tag and collection, and only its
+	// first page (or the one following the cursor after) is rendered.
+	filter := parseFilter(r)
 	sort := strings.ToLower(r.URL.Query().Get("sort"))
-	switch sort {
-	case "views":
-		media.By(media.SortByViews).Sort(playlist)
-	case "", "timestamp":
-		media.By(media.SortByTimestamp).Sort(playlist)
-	default:
-		// By default the playlist is sorted by Timestamp
-		log.Warnf("invalid sort critiera: %s", sort)
+	viewer := middleware.GetIdentity(r)
+	playlist, next, err := a.playlistPage(viewer, filter, sort, r.URL.Query().Get("after"), playlistPageSize)
+	if err != nil {
+		log.WithError(err).Warn("invalid playlist cursor")
+		playlist, next, _ = a.playlistPage(viewer, filter, sort, "", playlistPageSize)
 	}
 
 	quality := strings.ToLower(r.URL.Query().Get("quality"))
-	switch quality {
-	case "", "720p", "480p", "360p", "240p":
-	default:
+	if quality != "" && !a.Config.Transcoder.HasQuality(quality) {
 		log.WithField("quality", quality).Warn("invalid quality")
 		quality = ""
 	}
@@ -695,16 +746,22 @@ func (a *App) pageHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	ctx := &struct {
 		Sort     string
+		Filter   playlistFilter
 		Quality  string
+		HLS      bool
 		Config   *Config
 		Playing  *media.Video
 		Playlist media.Playlist
+		Next     string
 	}{
 		Sort:     sort,
+		Filter:   filter,
 		Quality:  quality,
+		HLS:      hasHLS(playing),
 		Config:   a.Config,
 		Playing:  playing,
 		Playlist: playlist,
+		Next:     next,
 	}
 	a.render("index", w, ctx)
 }
@@ -714,56 +771,82 @@ func (a *App) videoHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 
-	prefix, ok := vars["prefix"]
-	if ok {
-		id = path.Join(prefix, id)
-	}
-
 	log.Printf("/v/%s", id)
 
-	m, ok := a.Library.Videos[id]
+	m, ok := a.video(r, id)
 	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
 		return
 	}
 
-	var videoPath string
+	name := m.Name
 
-	quality := strings.ToLower(r.URL.Query().Get("quality"))
-	switch quality {
-	case "720p", "480p", "360p", "240p":
-		videoPath = fmt.Sprintf(
-			"%s#%s.mp4",
-			strings.TrimSuffix(m.Path, filepath.Ext(m.Path)),
-			quality,
-		)
-		if !utils.FileExists(videoPath) {
+	// share links restricted to a quality never grant another one
+	share := middleware.GetShare(r)
+	restricted := share != nil && share.Quality != ""
+
+	quality := sharedQuality(r, strings.ToLower(r.URL.Query().Get("quality")))
+	switch {
+	case a.Config.Transcoder.HasQuality(quality):
+		name = renditionFile(m.Name, quality)
+		if _, err := m.Location.Files().Stat(name); err != nil {
+			if restricted {
+				http.Error(w, "Not Found", http.StatusNotFound)
+				return
+			}
 			log.
 				WithField("quality", quality).
-				WithField("videoPath", videoPath).
+				WithField("videoPath", path.Join(m.Location.Path, name)).
 				Warn("video with specified quality does not exist (defaulting to default quality)")
-			videoPath = m.Path
+			name = m.Name
 		}
-	case "":
-		videoPath = m.Path
+	case quality == "":
+	case restricted:
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
 	default:
 		log.WithField("quality", quality).Warn("invalid quality")
-		videoPath = m.Path
 	}
 
-	if err := a.Store.Migrate(prefix, id); err != nil {
-		err := fmt.Errorf("error migrating store data: %w", err)
+	if err := a.Views.Inc(id); err != nil {
 		log.Warn(err)
 	}
 
-	if err := a.Store.IncViews(id); err != nil {
-		err := fmt.Errorf("error updating view for %s: %w", id, err)
-		log.Warn(err)
+	title := m.Title
+
+	if name == m.Name && a.Live != nil && !a.Live.Playable(m) {
+		disposition := "attachment; filename=\"" + title + ".mp4\""
+		w.Header().Set("Content-Disposition", disposition)
+		a.Live.Serve(w, r, m)
+		return
 	}
 
-	title := m.Title
-	disposition := "attachment; filename=\"" + title + ".mp4\""
+	if !m.Location.Local() {
+		// Clients fetch the file straight from the storage backend, for no
+		// longer than the share link they may have is valid.
+		expires := media.PresignExpiry
+		if share != nil {
+			if remaining := time.Until(share.Expires); remaining < expires {
+				expires = remaining
+			}
+			if expires < time.Second {
+				expires = time.Second
+			}
+		}
+		u, err := m.Location.Files().Presign(name, expires)
+		if err != nil {
+			log.WithError(err).WithField("id", id).Error("error presigning video URL")
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, u, http.StatusFound)
+		return
+	}
+
+	videoPath := filepath.Join(m.Location.Path, filepath.FromSlash(name))
+	disposition := "attachment; filename=\"" + title + filepath.Ext(videoPath) + "\""
 	w.Header().Set("Content-Disposition", disposition)
-	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Type", media.ContentType(videoPath))
 	http.ServeFile(w, r, videoPath)
 }
 
@@ -771,23 +854,35 @@ func (a *App) videoHandler(w http.ResponseWriter, r *http.Request) {
 func (a *App) thumbHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	prefix, ok := vars["prefix"]
-	if ok {
-		id = path.Join(prefix, id)
-	}
 	log.Printf("/t/%s", id)
-	m, ok := a.Library.Videos[id]
+	m, ok := a.video(r, id)
 	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
 		return
 	}
-	w.Header().Set("Cache-Control", "public, max-age=7776000")
-	if m.ThumbType == "" {
-		w.Header().Set("Content-Type", "image/jpeg")
-		w.Write(static.MustGetFile("defaulticon.jpg"))
+	// Thumbnails can be edited, so clients must revalidate them. Those of
+	// private videos (or opened with share links) must not be kept by
+	// shared caches.
+	if m.Visibility == media.Private || middleware.GetShare(r) != nil {
+		w.Header().Set("Cache-Control", "private, no-cache")
 	} else {
-		w.Header().Set("Content-Type", m.ThumbType)
-		w.Write(m.Thumb)
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
+	f, modtime, thumbType, err := media.OpenThumbnail(m)
+	if errors.Is(err, fs.ErrNotExist) {
+		thumb := static.MustGetFile("defaulticon.jpg")
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha1.Sum(thumb)))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(thumb))
+		return
+	} else if err != nil {
+		log.WithError(err).WithField("id", id).Error("error reading thumbnail")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
+	defer f.Close()
+	w.Header().Set("Content-Type", thumbType)
+	http.ServeContent(w, r, "", modtime, f)
 }
 
 // HTTP handler for /feed.xml
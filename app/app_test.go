@@ -0,0 +1,64 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestApp returns an App listening on a random local port, with its
+// store in a temporary directory.
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.Port = 0
+	cfg.Server.StorePath = filepath.Join(t.TempDir(), "tube.db")
+	a, err := NewApp(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		a.Listener.Close()
+		a.Watcher.Close()
+		a.Close()
+	})
+	return a
+}
+
+func TestRoutes(t *testing.T) {
+	a := newTestApp(t)
+
+	tests := []struct {
+		path     string
+		template string
+		id, file string
+	}{
+		{"/v/cats/kitten.mp4", "/v/{id:.+}.mp4", "cats/kitten", ""},
+		{"/v/cats/kitten.mpd", "/v/{id:.+}.mpd", "cats/kitten", ""},
+		{"/v/cats/kitten/hls/master.m3u8", "/v/{id:.+}/hls/{file}", "cats/kitten", "master.m3u8"},
+		{"/v/cats/kitten/hls/720p.m3u8", "/v/{id:.+}/hls/{file}", "cats/kitten", "720p.m3u8"},
+		{"/v/cats/kitten/hls/720p_init.mp4", "/v/{id:.+}/hls/{file}", "cats/kitten", "720p_init.mp4"},
+		{"/v/cats/kitten/hls/720p_00001.m4s", "/v/{id:.+}/hls/{file}", "cats/kitten", "720p_00001.m4s"},
+		{"/v/cats/kitten/dash/init_0.m4s", "/v/{id:.+}/dash/{file}", "cats/kitten", "init_0.m4s"},
+		{"/v/cats/kitten/dash/chunk_0_00001.m4s", "/v/{id:.+}/dash/{file}", "cats/kitten", "chunk_0_00001.m4s"},
+		{"/v/cats/kitten", "/v/{id:.+}", "cats/kitten", ""},
+	}
+	for _, test := range tests {
+		var match mux.RouteMatch
+		if !a.Router.Match(httptest.NewRequest(http.MethodGet, test.path, nil), &match) || match.Route == nil {
+			t.Errorf("%s: no route", test.path)
+			continue
+		}
+		template, err := match.Route.GetPathTemplate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if template != test.template || match.Vars["id"] != test.id || match.Vars["file"] != test.file {
+			t.Errorf("%s: route %s with %v, want %s with the id %q and file %q", test.path, template, match.Vars, test.template, test.id, test.file)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+	"git.mills.io/prologic/tube/media"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// sandstormPermissions are the Sandstorm permissions (declared in the
+// pkgdef) granting the roles required by the routes: viewers need none,
+// only to be signed in.
+var sandstormPermissions = map[middleware.Role]string{
+	middleware.RoleViewer:   "",
+	middleware.RoleUploader: "upload",
+	middleware.RoleEditor:   "upload",
+	middleware.RoleAdmin:    "admin",
+}
+
+// roleScopes are the scopes of the API tokens granting the roles, named
+// like the Sandstorm permissions.
+var roleScopes = map[middleware.Role]string{
+	middleware.RoleViewer:   middleware.ScopeRead,
+	middleware.RoleUploader: middleware.ScopeUpload,
+	middleware.RoleEditor:   middleware.ScopeUpload,
+	middleware.RoleAdmin:    middleware.ScopeAdmin,
+}
+
+// requireRole protects the handler with the given role, and for API tokens
+// the scope matching it.
+func (a *App) requireRole(role middleware.Role, handler http.HandlerFunc) http.HandlerFunc {
+	return a.requireScope(role, roleScopes[role], handler)
+}
+
+// requireScope protects the handler with the given role: the role of the
+// logged in user in the users auth mode, the matching permission on
+// Sandstorm, and the password of the basic auth mode otherwise. Requests
+// made with an API token also need the scope.
+func (a *App) requireScope(role middleware.Role, scope string, handler http.HandlerFunc) http.HandlerFunc {
+	scoped := middleware.RequireScope(handler, scope)
+	switch {
+	case os.Getenv("SANDSTORM") == "1":
+		return middleware.RequireSandstormPermission(handler, sandstormPermissions[role])
+	case a.Users != nil:
+		return middleware.RequireRole(scoped, role, "/login")
+	default:
+		return middleware.AllowTokens(
+			middleware.OptionallyRequireAdminAuth(handler, a.authPassword()),
+			scoped,
+		)
+	}
+}
+
+// requireEditor protects the handler of a route editing or deleting videos
+// with the editor role like requireRole. Unless auth is disabled with the
+// none auth mode, it is refused in the basic mode without an auth_password,
+// which would let anyone use it.
+func (a *App) requireEditor(handler http.HandlerFunc) http.HandlerFunc {
+	if a.unprotected() {
+		return func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Forbidden: an auth_password or the users auth mode is required", http.StatusForbidden)
+		}
+	}
+	return a.requireRole(middleware.RoleEditor, handler)
+}
+
+// authDisabled returns true if auth is disabled with the none auth mode
+// (but not on Sandstorm), letting anyone do anything.
+func (a *App) authDisabled() bool {
+	return a.Config.Auth.Mode == authModeNone && os.Getenv("SANDSTORM") != "1"
+}
+
+// authPassword returns the password of the basic auth mode, from the
+// auth_password environment variable, and none if auth is disabled.
+func (a *App) authPassword() string {
+	if a.Config.Auth.Mode == authModeNone {
+		return ""
+	}
+	return os.Getenv("auth_password")
+}
+
+// unprotected returns true in the basic auth mode without an auth_password
+// (and outside of Sandstorm), where no one can be authenticated although
+// auth isn't disabled.
+func (a *App) unprotected() bool {
+	return a.Config.Auth.Mode == authModeBasic && os.Getenv("SANDSTORM") != "1" && os.Getenv("auth_password") == ""
+}
+
+// authenticator returns the Authenticator identifying the users of the
+// requests, by the API token of those sending one.
+func (a *App) authenticator() middleware.Authenticator {
+	var auth middleware.Authenticator
+	switch {
+	case os.Getenv("SANDSTORM") == "1":
+		return middleware.SandstormAuthenticator
+	case a.Users != nil:
+		auth = a.Users.Identify
+	default:
+		auth = middleware.BasicAuthenticator(a.authPassword())
+	}
+	return func(r *http.Request) *middleware.Identity {
+		if _, ok := bearerToken(r); ok {
+			return a.Tokens.Identify(r)
+		}
+		return auth(r)
+	}
+}
+
+// tokenRole returns the role of the user username of an API token: that
+// of their account in the users auth mode, and admin (that of the only
+// user) in the basic mode.
+func (a *App) tokenRole(username string) middleware.Role {
+	if a.Users != nil {
+		return a.Users.Role(username)
+	}
+	return middleware.RoleAdmin
+}
+
+// isSecure returns true if the request r was made over HTTPS (possibly
+// through a reverse proxy).
+func isSecure(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// setSessionCookie sets (or with an empty token, clears) the session cookie.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+	}
+	if token == "" {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = expires
+	}
+	http.SetCookie(w, cookie)
+}
+
+// safeRedirect returns the local path next to redirect to after logging
+// in, defaulting to /.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// renderLogin renders the login page, or the account of the logged in user.
+func (a *App) renderLogin(w http.ResponseWriter, r *http.Request, status int, message string) {
+	ctx := &struct {
+		Config   *Config
+		Playing  *media.Video
+		Identity *middleware.Identity
+		Admin    bool
+		Next     string
+		Message  string
+		SSO      string
+	}{
+		Config:   a.Config,
+		Playing:  &media.Video{ID: ""},
+		Identity: middleware.GetIdentity(r),
+		Next:     safeRedirect(r.FormValue("next")),
+		Message:  message,
+	}
+	ctx.Admin = ctx.Identity != nil && ctx.Identity.Role.Allows(middleware.RoleAdmin)
+	if a.OIDC != nil {
+		ctx.SSO = a.OIDC.cfg.Name
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	a.render("login", w, ctx)
+}
+
+// HTTP handler for /login
+// Shows the login form, or the account of the logged in user, and logs
+// users in.
+func (a *App) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		a.renderLogin(w, r, http.StatusOK, "")
+		return
+	}
+
+	username := strings.ToLower(strings.TrimSpace(r.FormValue("username")))
+	token, session, err := a.Users.Login(username, r.FormValue("password"))
+	if err != nil {
+		if !errors.Is(err, errInvalidLogin) {
+			log.WithError(err).Error("error logging in")
+		} else {
+			log.WithField("user", username).Warn("failed login")
+		}
+		a.renderLogin(w, r, http.StatusUnauthorized, errInvalidLogin.Error())
+		return
+	}
+	setSessionCookie(w, r, token, session.Expires)
+	http.Redirect(w, r, safeRedirect(r.FormValue("next")), http.StatusSeeOther)
+}
+
+// HTTP handler for /logout
+func (a *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil && cookie.Value != "" {
+		if err := a.Users.Logout(cookie.Value); err != nil {
+			log.WithError(err).Warn("error deleting session")
+		}
+	}
+	setSessionCookie(w, r, "", time.Time{})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// HTTP handler for /account
+// Changes the password of the logged in user (given their current one),
+// logging them in again with a new session.
+func (a *App) accountHandler(w http.ResponseWriter, r *http.Request) {
+	id := middleware.GetIdentity(r)
+	if _, _, err := a.Users.Login(id.Username, r.FormValue("password")); err != nil {
+		a.renderLogin(w, r, http.StatusUnauthorized, "invalid current password")
+		return
+	}
+	if _, err := a.Users.Update(id.Username, r.FormValue("new_password"), ""); err != nil {
+		a.renderLogin(w, r, userErrorStatus(err), err.Error())
+		return
+	}
+	token, session, err := a.Users.Login(id.Username, r.FormValue("new_password"))
+	if err != nil {
+		log.WithError(err).Error("error logging in")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, token, session.Expires)
+	a.renderLogin(w, r, http.StatusOK, "password changed")
+}
+
+// userErrorStatus returns the HTTP status of an error managing users.
+func userErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errUserExists), errors.Is(err, errUserTaken):
+		return http.StatusConflict
+	case errors.Is(err, errLastAdmin), errors.Is(err, errInvalidRole),
+		errors.Is(err, errShortPass), errors.Is(err, errInvalidName):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// apiUser is a user as returned by the users API, without its password.
+type apiUser struct {
+	Username string          `json:"username"`
+	Role     middleware.Role `json:"role"`
+	Created  time.Time       `json:"created"`
+}
+
+// HTTP handler for /users
+// Lists the users (as JSON or a page managing them), and creates users.
+func (a *App) usersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		user, err := a.Users.Create(
+			strings.ToLower(strings.TrimSpace(r.FormValue("username"))),
+			r.FormValue("password"),
+			middleware.Role(r.FormValue("role")),
+		)
+		a.userResponse(w, r, user, err)
+		return
+	}
+
+	users, err := a.Users.List()
+	if err != nil {
+		log.WithError(err).Error("error listing users")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := make([]*apiUser, len(users))
+	for i, user := range users {
+		res[i] = &apiUser{user.Username, user.Role, user.Created}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.WithError(err).Error("error encoding users")
+		}
+		return
+	}
+
+	ctx := &struct {
+		Config  *Config
+		Playing *media.Video
+		Users   []*apiUser
+		Roles   []middleware.Role
+		Self    string
+	}{
+		Config:  a.Config,
+		Playing: &media.Video{ID: ""},
+		Users:   res,
+		Roles:   middleware.Roles,
+		Self:    middleware.GetIdentity(r).Username,
+	}
+	a.render("users", w, ctx)
+}
+
+// HTTP handler for /users/name
+// Changes the password and/or role of a user (POST) or deletes it (DELETE,
+// or POST to /users/name/delete from the users page).
+func (a *App) userHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["name"]
+	if r.Method == http.MethodDelete || strings.HasSuffix(r.URL.Path, "/delete") {
+		a.userResponse(w, r, nil, a.Users.Delete(username))
+		return
+	}
+	user, err := a.Users.Update(username, r.FormValue("password"), middleware.Role(r.FormValue("role")))
+	a.userResponse(w, r, user, err)
+}
+
+// userResponse responds to a change of the user (nil if deleted) with it
+// as JSON, or by going back to the users page.
+func (a *App) userResponse(w http.ResponseWriter, r *http.Request, user *User, err error) {
+	if err != nil {
+		status := userErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.WithError(err).Error("error changing user")
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if r.Method == http.MethodPost && !wantsJSON(r) {
+		http.Redirect(w, r, "/users", http.StatusSeeOther)
+		return
+	}
+	if user == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&apiUser{user.Username, user.Role, user.Created}); err != nil {
+		log.WithError(err).Error("error encoding user")
+	}
+}
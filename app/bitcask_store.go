@@ -2,7 +2,11 @@ package app
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"strings"
+
+	"git.mills.io/prologic/tube/media"
 
 	log "github.com/sirupsen/logrus"
 
@@ -126,3 +130,549 @@ func (s *BitcaskStore) IncViews(id string) error {
 
 	return nil
 }
+
+// GetViewsBatch ...
+func (s *BitcaskStore) GetViewsBatch(ids []string) (map[string]int64, error) {
+	views := make(map[string]int64, len(ids))
+	for _, id := range ids {
+		rawViews, err := s.db.Get([]byte(fmt.Sprintf("/views/%s", id)))
+		if err == bitcask.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			err := fmt.Errorf("error getting views for %s: %w", id, err)
+			return nil, err
+		}
+		views[id] = int64(binary.BigEndian.Uint64(rawViews))
+	}
+
+	return views, nil
+}
+
+// PutViewsBatch ...
+func (s *BitcaskStore) PutViewsBatch(views map[string]int64) error {
+	batch := s.db.Batch()
+	for id, n := range views {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(n))
+		if _, err := batch.Put([]byte(fmt.Sprintf("/views/%s", id)), buf); err != nil {
+			err := fmt.Errorf("error storing views for %s: %w", id, err)
+			return err
+		}
+	}
+
+	if err := s.db.Write(batch); err != nil {
+		err := fmt.Errorf("error storing views: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteVideo ...
+func (s *BitcaskStore) DeleteVideo(id string) error {
+	if err := s.db.Delete([]byte(fmt.Sprintf("/views/%s", id))); err != nil && err != bitcask.ErrKeyNotFound {
+		err := fmt.Errorf("error deleting views for %s: %w", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// GetJob ...
+func (s *BitcaskStore) GetJob(id string) (*Job, error) {
+	data, err := s.db.Get([]byte(fmt.Sprintf("/jobs/%s", id)))
+	if err != nil {
+		err := fmt.Errorf("error getting job %s: %w", id, err)
+		return nil, err
+	}
+
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		err := fmt.Errorf("error decoding job %s: %w", id, err)
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+// PutJob ...
+func (s *BitcaskStore) PutJob(job *Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		err := fmt.Errorf("error encoding job %s: %w", job.ID, err)
+		return err
+	}
+
+	if err := s.db.Put([]byte(fmt.Sprintf("/jobs/%s", job.ID)), data); err != nil {
+		err := fmt.Errorf("error storing job %s: %w", job.ID, err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteJob ...
+func (s *BitcaskStore) DeleteJob(id string) error {
+	if err := s.db.Delete([]byte(fmt.Sprintf("/jobs/%s", id))); err != nil {
+		err := fmt.Errorf("error deleting job %s: %w", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListJobs ...
+func (s *BitcaskStore) ListJobs() ([]*Job, error) {
+	var jobs []*Job
+	err := s.db.Scan([]byte("/jobs/"), func(key bitcask.Key) error {
+		data, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			log.WithError(err).Warnf("error decoding job %s", key)
+			return nil
+		}
+		jobs = append(jobs, &job)
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("error listing jobs: %w", err)
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// GetTrash ...
+func (s *BitcaskStore) GetTrash(id string) (*TrashEntry, error) {
+	data, err := s.db.Get([]byte(fmt.Sprintf("/trash/%s", id)))
+	if err != nil {
+		err := fmt.Errorf("error getting trash entry %s: %w", id, err)
+		return nil, err
+	}
+
+	var entry TrashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		err := fmt.Errorf("error decoding trash entry %s: %w", id, err)
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// PutTrash ...
+func (s *BitcaskStore) PutTrash(entry *TrashEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		err := fmt.Errorf("error encoding trash entry %s: %w", entry.ID, err)
+		return err
+	}
+
+	if err := s.db.Put([]byte(fmt.Sprintf("/trash/%s", entry.ID)), data); err != nil {
+		err := fmt.Errorf("error storing trash entry %s: %w", entry.ID, err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteTrash ...
+func (s *BitcaskStore) DeleteTrash(id string) error {
+	if err := s.db.Delete([]byte(fmt.Sprintf("/trash/%s", id))); err != nil {
+		err := fmt.Errorf("error deleting trash entry %s: %w", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListTrash ...
+func (s *BitcaskStore) ListTrash() ([]*TrashEntry, error) {
+	var entries []*TrashEntry
+	err := s.db.Scan([]byte("/trash/"), func(key bitcask.Key) error {
+		data, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+
+		var entry TrashEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			log.WithError(err).Warnf("error decoding trash entry %s", key)
+			return nil
+		}
+		entries = append(entries, &entry)
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("error listing trash: %w", err)
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// GetUser ...
+func (s *BitcaskStore) GetUser(username string) (*User, error) {
+	data, err := s.db.Get([]byte(fmt.Sprintf("/users/%s", username)))
+	if err == bitcask.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		err := fmt.Errorf("error getting user %s: %w", username, err)
+		return nil, err
+	}
+
+	var user User
+	if err := json.Unmarshal(data, &user); err != nil {
+		err := fmt.Errorf("error decoding user %s: %w", username, err)
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// PutUser ...
+func (s *BitcaskStore) PutUser(user *User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		err := fmt.Errorf("error encoding user %s: %w", user.Username, err)
+		return err
+	}
+
+	if err := s.db.Put([]byte(fmt.Sprintf("/users/%s", user.Username)), data); err != nil {
+		err := fmt.Errorf("error storing user %s: %w", user.Username, err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteUser ...
+func (s *BitcaskStore) DeleteUser(username string) error {
+	if err := s.db.Delete([]byte(fmt.Sprintf("/users/%s", username))); err != nil {
+		err := fmt.Errorf("error deleting user %s: %w", username, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListUsers ...
+func (s *BitcaskStore) ListUsers() ([]*User, error) {
+	var users []*User
+	err := s.db.Scan([]byte("/users/"), func(key bitcask.Key) error {
+		data, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+
+		var user User
+		if err := json.Unmarshal(data, &user); err != nil {
+			log.WithError(err).Warnf("error decoding user %s", key)
+			return nil
+		}
+		users = append(users, &user)
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("error listing users: %w", err)
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// GetSession ...
+func (s *BitcaskStore) GetSession(id string) (*Session, error) {
+	data, err := s.db.Get([]byte(fmt.Sprintf("/sessions/%s", id)))
+	if err == bitcask.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		err := fmt.Errorf("error getting session %s: %w", id, err)
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		err := fmt.Errorf("error decoding session %s: %w", id, err)
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// PutSession ...
+func (s *BitcaskStore) PutSession(session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		err := fmt.Errorf("error encoding session %s: %w", session.ID, err)
+		return err
+	}
+
+	if err := s.db.Put([]byte(fmt.Sprintf("/sessions/%s", session.ID)), data); err != nil {
+		err := fmt.Errorf("error storing session %s: %w", session.ID, err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteSession ...
+func (s *BitcaskStore) DeleteSession(id string) error {
+	if err := s.db.Delete([]byte(fmt.Sprintf("/sessions/%s", id))); err != nil {
+		err := fmt.Errorf("error deleting session %s: %w", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListSessions ...
+func (s *BitcaskStore) ListSessions() ([]*Session, error) {
+	var sessions []*Session
+	err := s.db.Scan([]byte("/sessions/"), func(key bitcask.Key) error {
+		data, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+
+		var session Session
+		if err := json.Unmarshal(data, &session); err != nil {
+			log.WithError(err).Warnf("error decoding session %s", key)
+			return nil
+		}
+		sessions = append(sessions, &session)
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("error listing sessions: %w", err)
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// GetShareKey ...
+func (s *BitcaskStore) GetShareKey() ([]byte, error) {
+	key, err := s.db.Get([]byte("/sharekey"))
+	if err == bitcask.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		err := fmt.Errorf("error getting share key: %w", err)
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// PutShareKey ...
+func (s *BitcaskStore) PutShareKey(key []byte) error {
+	if err := s.db.Put([]byte("/sharekey"), key); err != nil {
+		err := fmt.Errorf("error storing share key: %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetShareLink ...
+func (s *BitcaskStore) GetShareLink(id string) (*ShareLink, error) {
+	data, err := s.db.Get([]byte(fmt.Sprintf("/shares/%s", id)))
+	if err == bitcask.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		err := fmt.Errorf("error getting share link %s: %w", id, err)
+		return nil, err
+	}
+
+	var link ShareLink
+	if err := json.Unmarshal(data, &link); err != nil {
+		err := fmt.Errorf("error decoding share link %s: %w", id, err)
+		return nil, err
+	}
+
+	return &link, nil
+}
+
+// PutShareLink ...
+func (s *BitcaskStore) PutShareLink(link *ShareLink) error {
+	data, err := json.Marshal(link)
+	if err != nil {
+		err := fmt.Errorf("error encoding share link %s: %w", link.ID, err)
+		return err
+	}
+
+	if err := s.db.Put([]byte(fmt.Sprintf("/shares/%s", link.ID)), data); err != nil {
+		err := fmt.Errorf("error storing share link %s: %w", link.ID, err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteShareLink ...
+func (s *BitcaskStore) DeleteShareLink(id string) error {
+	if err := s.db.Delete([]byte(fmt.Sprintf("/shares/%s", id))); err != nil {
+		err := fmt.Errorf("error deleting share link %s: %w", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListShareLinks ...
+func (s *BitcaskStore) ListShareLinks() ([]*ShareLink, error) {
+	var links []*ShareLink
+	err := s.db.Scan([]byte("/shares/"), func(key bitcask.Key) error {
+		data, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+
+		var link ShareLink
+		if err := json.Unmarshal(data, &link); err != nil {
+			log.WithError(err).Warnf("error decoding share link %s", key)
+			return nil
+		}
+		links = append(links, &link)
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("error listing share links: %w", err)
+		return nil, err
+	}
+
+	return links, nil
+}
+
+// GetAPIToken ...
+func (s *BitcaskStore) GetAPIToken(id string) (*APIToken, error) {
+	data, err := s.db.Get([]byte(fmt.Sprintf("/tokens/%s", id)))
+	if err == bitcask.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		err := fmt.Errorf("error getting API token %s: %w", id, err)
+		return nil, err
+	}
+
+	var token APIToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		err := fmt.Errorf("error decoding API token %s: %w", id, err)
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// PutAPIToken ...
+func (s *BitcaskStore) PutAPIToken(token *APIToken) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		err := fmt.Errorf("error encoding API token %s: %w", token.ID, err)
+		return err
+	}
+
+	if err := s.db.Put([]byte(fmt.Sprintf("/tokens/%s", token.ID)), data); err != nil {
+		err := fmt.Errorf("error storing API token %s: %w", token.ID, err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteAPIToken ...
+func (s *BitcaskStore) DeleteAPIToken(id string) error {
+	if err := s.db.Delete([]byte(fmt.Sprintf("/tokens/%s", id))); err != nil {
+		err := fmt.Errorf("error deleting API token %s: %w", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// ListAPITokens ...
+func (s *BitcaskStore) ListAPITokens() ([]*APIToken, error) {
+	var tokens []*APIToken
+	err := s.db.Scan([]byte("/tokens/"), func(key bitcask.Key) error {
+		data, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+
+		var token APIToken
+		if err := json.Unmarshal(data, &token); err != nil {
+			log.WithError(err).Warnf("error decoding API token %s", key)
+			return nil
+		}
+		tokens = append(tokens, &token)
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("error listing API tokens: %w", err)
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// GetIndexed ...
+func (s *BitcaskStore) GetIndexed(path string) (*media.IndexEntry, error) {
+	data, err := s.db.Get([]byte(fmt.Sprintf("/index/%s", path)))
+	if err == bitcask.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		err := fmt.Errorf("error getting index entry %s: %w", path, err)
+		return nil, err
+	}
+
+	var entry media.IndexEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		err := fmt.Errorf("error decoding index entry %s: %w", path, err)
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// PutIndexed ...
+func (s *BitcaskStore) PutIndexed(entry *media.IndexEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		err := fmt.Errorf("error encoding index entry %s: %w", entry.Path, err)
+		return err
+	}
+
+	if err := s.db.Put([]byte(fmt.Sprintf("/index/%s", entry.Path)), data); err != nil {
+		err := fmt.Errorf("error storing index entry %s: %w", entry.Path, err)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteIndexed ...
+func (s *BitcaskStore) DeleteIndexed(path string) error {
+	if err := s.db.Delete([]byte(fmt.Sprintf("/index/%s", path))); err != nil && err != bitcask.ErrKeyNotFound {
+		err := fmt.Errorf("error deleting index entry %s: %w", path, err)
+		return err
+	}
+
+	return nil
+}
+
+// IndexedPaths ...
+func (s *BitcaskStore) IndexedPaths() ([]string, error) {
+	var paths []string
+	err := s.db.Scan([]byte("/index/"), func(key bitcask.Key) error {
+		paths = append(paths, strings.TrimPrefix(string(key), "/index/"))
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("error listing index: %w", err)
+		return nil, err
+	}
+
+	return paths, nil
+}
@@ -0,0 +1,116 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"git.mills.io/prologic/tube/media"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// collections returns the library paths with a prefix, whose videos make
+// up the collections browsable at /c/<prefix>.
+func (c *Config) collections() []*PathConfig {
+	var res []*PathConfig
+	for _, pc := range c.Library {
+		if pc.Prefix != "" {
+			res = append(res, pc)
+		}
+	}
+	return res
+}
+
+// collection returns the library path with the given prefix.
+func (c *Config) collection(prefix string) (*PathConfig, bool) {
+	for _, pc := range c.collections() {
+		if pc.Prefix == prefix {
+			return pc, true
+		}
+	}
+	return nil, false
+}
+
+// collectionTitle returns the title of the collection of the library path
+// pc, defaulting to its prefix.
+func collectionTitle(pc *PathConfig) string {
+	if pc.Title != "" {
+		return pc.Title
+	}
+	return pc.Prefix
+}
+
+// isURL returns true if s is an absolute http(s) URL.
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// collectionVideos returns the videos of the collection with the given
+// prefix, newest first.
+func (a *App) collectionVideos(prefix string) media.Playlist {
+	return playlistFilter{Collection: prefix}.Apply(a.Library.Playlist())
+}
+
+// HTTP handler for /c/prefix
+func (a *App) collectionHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := mux.Vars(r)["prefix"]
+	log.Printf("/c/%s", prefix)
+	pc, ok := a.Config.collection(prefix)
+	if !ok {
+		http.Error(w, "Collection Not Found", http.StatusNotFound)
+		return
+	}
+
+	page := &videosPage{
+		Heading:     collectionTitle(pc),
+		Description: pc.Description,
+		Feed:        fmt.Sprintf("/c/%s/feed.xml", pc.Prefix),
+		Filter:      playlistFilter{Collection: pc.Prefix},
+	}
+	if pc.Cover != "" {
+		page.Cover = fmt.Sprintf("/c/%s/cover", pc.Prefix)
+	}
+	a.renderVideos(w, r, page, a.collectionVideos(pc.Prefix))
+}
+
+// HTTP handler for /c/prefix/cover
+// Serves the cover image file of the collection, or redirects to it if it
+// is a URL.
+func (a *App) collectionCoverHandler(w http.ResponseWriter, r *http.Request) {
+	pc, ok := a.Config.collection(mux.Vars(r)["prefix"])
+	if !ok || pc.Cover == "" {
+		http.Error(w, "Cover Not Found", http.StatusNotFound)
+		return
+	}
+	if isURL(pc.Cover) {
+		http.Redirect(w, r, pc.Cover, http.StatusFound)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, no-cache")
+	http.ServeFile(w, r, pc.Cover)
+}
+
+// HTTP handler for /c/prefix/feed.xml
+func (a *App) collectionFeedHandler(w http.ResponseWriter, r *http.Request) {
+	pc, ok := a.Config.collection(mux.Vars(r)["prefix"])
+	if !ok {
+		http.Error(w, "Collection Not Found", http.StatusNotFound)
+		return
+	}
+	feed, err := a.feed(
+		collectionTitle(pc),
+		pc.Description,
+		fmt.Sprintf("/c/%s", pc.Prefix),
+		a.collectionVideos(pc.Prefix),
+	)
+	if err != nil {
+		log.WithError(err).WithField("collection", pc.Prefix).Error("error building feed")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(feed)
+}
@@ -2,7 +2,17 @@ package app
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"git.mills.io/prologic/tube/app/middleware"
+	"git.mills.io/prologic/tube/media"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // Config settings for main App.
@@ -11,15 +21,42 @@ type Config struct {
 	Server      *ServerConfig      `json:"server"`
 	Thumbnailer *ThumbnailerConfig `json:"thumbnailer"`
 	Transcoder  *TranscoderConfig  `json:"transcoder"`
+	Jobs        *JobsConfig        `json:"jobs"`
+	Trash       *TrashConfig       `json:"trash"`
+	Auth        *AuthConfig        `json:"auth"`
 	Feed        *FeedConfig        `json:"feed"`
 	Copyright   *Copyright         `json:"copyright"`
 }
 
 // PathConfig settings for media library path.
 type PathConfig struct {
-	Path                   string `json:"path"`
-	Prefix                 string `json:"prefix"`
-	PreserveUploadFilename bool   `json:"preserve_upload_filename,omitempty"`
+	Path                   string         `json:"path"`
+	Prefix                 string         `json:"prefix"`
+	PreserveUploadFilename bool           `json:"preserve_upload_filename,omitempty"`
+	DASH                   bool           `json:"dash,omitempty"`
+	Extensions             []string       `json:"extensions,omitempty"`
+	Recursive              bool           `json:"recursive,omitempty"`
+	Storage                *StorageConfig `json:"storage,omitempty"`
+	ReadOnly               bool           `json:"read_only,omitempty"`
+	SidecarPath            string         `json:"sidecar_path,omitempty"`
+	// Title, Description and Cover (an image file or URL) describe the
+	// collection of videos of the path, shown at /c/<prefix>.
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Cover       string `json:"cover,omitempty"`
+}
+
+// StorageConfig settings for the storage backend of a library path.
+type StorageConfig struct {
+	// Type is either "local" (the default) or "s3".
+	Type      string `json:"type"`
+	Endpoint  string `json:"endpoint,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+	PathStyle bool   `json:"path_style,omitempty"`
 }
 
 // ServerConfig settings for App Server.
@@ -30,6 +67,9 @@ type ServerConfig struct {
 	UploadPath             string `json:"upload_path"`
 	PreserveUploadFilename bool   `json:"preserve_upload_filename,omitempty"`
 	MaxUploadSize          int64  `json:"max_upload_size"`
+	// ViewsFlushInterval is the no. of seconds between writes of the view
+	// counts (kept in memory) back to the store.
+	ViewsFlushInterval int `json:"views_flush_interval"`
 }
 
 // ThumbnailerConfig settings for Transcoder
@@ -39,12 +79,118 @@ type ThumbnailerConfig struct {
 }
 
 // Sizes a map of ffmpeg -s option to suffix. e.g: hd720 -> #720p
+//
+// Deprecated: Use Renditions and Profiles instead. Sizes are converted into
+// renditions with a matching profile by Validate.
 type Sizes map[string]string
 
+// Renditions a map of suffix to the name of the TranscodeProfile used to
+// render the lower quality video. e.g: 720p -> #720p using the "720p" profile
+type Renditions map[string]string
+
+// TranscodeProfile settings for encoding a video with ffmpeg.
+type TranscodeProfile struct {
+	VideoCodec   string   `json:"video_codec"`
+	AudioCodec   string   `json:"audio_codec"`
+	CRF          int      `json:"crf,omitempty"`
+	VideoBitrate string   `json:"video_bitrate,omitempty"`
+	Preset       string   `json:"preset,omitempty"`
+	AudioBitrate string   `json:"audio_bitrate,omitempty"`
+	MaxHeight    int      `json:"max_height,omitempty"`
+	Size         string   `json:"size,omitempty"`
+	ExtraArgs    []string `json:"extra_args,omitempty"`
+}
+
 // TranscoderConfig settings for Transcoder
 type TranscoderConfig struct {
-	Timeout int   `json:"timeout"`
-	Sizes   Sizes `json:"sizes"`
+	Timeout     int                          `json:"timeout"`
+	Sizes       Sizes                        `json:"sizes,omitempty"`
+	Profile     string                       `json:"profile"`
+	Profiles    map[string]*TranscodeProfile `json:"profiles"`
+	Renditions  Renditions                   `json:"renditions"`
+	HLS         *HLSConfig                   `json:"hls"`
+	Live        *LiveConfig                  `json:"live"`
+	Passthrough *PassthroughConfig           `json:"passthrough"`
+}
+
+// HLSConfig settings for HLS adaptive bitrate streaming output.
+type HLSConfig struct {
+	Enabled         bool   `json:"enabled"`
+	SegmentDuration int    `json:"segment_duration"`
+	SegmentType     string `json:"segment_type"`
+	PlayerScript    string `json:"player_script,omitempty"`
+}
+
+// PassthroughConfig settings for deciding whether uploaded and imported
+// videos that are already browser-compatible are only remuxed (or have
+// only their audio re-encoded) instead of being fully transcoded.
+type PassthroughConfig struct {
+	Enabled     bool     `json:"enabled"`
+	VideoCodecs []string `json:"video_codecs"`
+	AudioCodecs []string `json:"audio_codecs"`
+	MaxHeight   int      `json:"max_height,omitempty"`
+	MaxBitrate  int64    `json:"max_bitrate,omitempty"`
+}
+
+// LiveConfig settings for transcoding videos that aren't browser-playable
+// on the fly as they are streamed.
+type LiveConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Profile       string `json:"profile"`
+	MaxConcurrent int    `json:"max_concurrent"`
+	CachePath     string `json:"cache_path"`
+	CacheSize     int64  `json:"cache_size"`
+}
+
+// JobsConfig settings for the background job queue.
+type JobsConfig struct {
+	Workers      int `json:"workers"`
+	MaxAttempts  int `json:"max_attempts"`
+	RetryBackoff int `json:"retry_backoff"`
+	Retention    int `json:"retention"`
+}
+
+// TrashConfig settings for the trash deleted videos are moved to.
+type TrashConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Path      string `json:"path"`
+	Retention int    `json:"retention"`
+}
+
+// AuthConfig settings for authenticating uploaders, editors and admins.
+type AuthConfig struct {
+	// Mode is either "basic" (the default: a single password shared by
+	// uploaders, from the auth_password environment variable), "users"
+	// (accounts with roles stored in the store, who log in at /login) or
+	// "none" (no authentication at all, e.g: on a private network).
+	Mode string `json:"mode"`
+	// SessionTTL is the no. of hours users stay logged in.
+	SessionTTL int `json:"session_ttl"`
+	// OIDC optionally lets users of the users mode log in with an OpenID
+	// Connect identity provider.
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+}
+
+// OIDCConfig settings for logging in with an OpenID Connect provider.
+type OIDCConfig struct {
+	// Name is the name of the provider shown on the login page.
+	Name   string `json:"name"`
+	Issuer string `json:"issuer"`
+	// ClientSecret defaults to the oidc_client_secret environment variable.
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	// RedirectURL defaults to /login/oidc/callback of the host requested.
+	RedirectURL string   `json:"redirect_url"`
+	Scopes      []string `json:"scopes"`
+	// UsernameClaim and GroupsClaim are the claims of the ID token holding
+	// the username and the groups of users.
+	UsernameClaim string `json:"username_claim"`
+	GroupsClaim   string `json:"groups_claim"`
+	// Roles maps groups to the role of their members (the highest one for
+	// users of several groups), and DefaultRole is the role of the users of
+	// no mapped group, who can't log in if it is empty.
+	Roles       map[string]middleware.Role `json:"roles"`
+	DefaultRole middleware.Role            `json:"default_role"`
 }
 
 // FeedConfig settings for App Feed.
@@ -73,6 +219,8 @@ func DefaultConfig() *Config {
 				Path:                   "videos",
 				Prefix:                 "",
 				PreserveUploadFilename: false,
+				Extensions:             []string{".mp4"},
+				Storage:                &StorageConfig{Type: "local"},
 			},
 		},
 		Server: &ServerConfig{
@@ -82,6 +230,7 @@ func DefaultConfig() *Config {
 			UploadPath:             "uploads",
 			PreserveUploadFilename: false,
 			MaxUploadSize:          104857600,
+			ViewsFlushInterval:     30,
 		},
 		Thumbnailer: &ThumbnailerConfig{
 			Timeout:           60,
@@ -90,6 +239,46 @@ func DefaultConfig() *Config {
 		Transcoder: &TranscoderConfig{
 			Timeout: 300,
 			Sizes:   Sizes(nil),
+			Profile: "default",
+			Profiles: map[string]*TranscodeProfile{
+				"default": {
+					VideoCodec: "libx264",
+					AudioCodec: "aac",
+				},
+			},
+			Renditions: Renditions(nil),
+			HLS: &HLSConfig{
+				Enabled:         false,
+				SegmentDuration: 6,
+				SegmentType:     "fmp4",
+			},
+			Live: &LiveConfig{
+				Enabled:       false,
+				Profile:       "default",
+				MaxConcurrent: 2,
+				CachePath:     "cache",
+				CacheSize:     10737418240,
+			},
+			Passthrough: &PassthroughConfig{
+				Enabled:     true,
+				VideoCodecs: []string{"h264"},
+				AudioCodecs: []string{"aac", "mp3"},
+			},
+		},
+		Jobs: &JobsConfig{
+			Workers:      1,
+			MaxAttempts:  3,
+			RetryBackoff: 60,
+			Retention:    168,
+		},
+		Trash: &TrashConfig{
+			Enabled:   true,
+			Path:      "trash",
+			Retention: 720,
+		},
+		Auth: &AuthConfig{
+			Mode:       authModeBasic,
+			SessionTTL: 168,
 		},
 		Feed: &FeedConfig{
 			ExternalURL: "http://localhost:8000",
@@ -110,3 +299,278 @@ func (c *Config) ReadFile(path string) error {
 	d := json.NewDecoder(f)
 	return d.Decode(c)
 }
+
+// WritableLibrary returns the library paths videos can be uploaded or
+// imported to, i.e: those that aren't read-only.
+func (c *Config) WritableLibrary() []*PathConfig {
+	var paths []*PathConfig
+	for _, pc := range c.Library {
+		if !pc.ReadOnly {
+			paths = append(paths, pc)
+		}
+	}
+	return paths
+}
+
+// Validate checks the Config for errors that would otherwise only surface
+// when a video is uploaded or imported.
+func (c *Config) Validate() error {
+	for _, pc := range c.Library {
+		if len(pc.Extensions) == 0 {
+			pc.Extensions = []string{".mp4"}
+		}
+		for i, ext := range pc.Extensions {
+			ext = strings.ToLower(ext)
+			if !strings.HasPrefix(ext, ".") {
+				ext = "." + ext
+			}
+			if ext == ".jpg" || ext == ".yml" {
+				return fmt.Errorf("library %s: extension %s is reserved for thumbnails and metadata", pc.Path, ext)
+			}
+			pc.Extensions[i] = ext
+		}
+		if pc.SidecarPath != "" {
+			pc.SidecarPath = filepath.Clean(pc.SidecarPath)
+			if pc.SidecarPath == filepath.Clean(pc.Path) {
+				return fmt.Errorf("library %s: sidecar_path must differ from path", pc.Path)
+			}
+		}
+		if pc.Storage == nil {
+			pc.Storage = &StorageConfig{Type: "local"}
+		}
+		switch pc.Storage.Type {
+		case "", "local":
+			pc.Storage.Type = "local"
+		case "s3":
+			if pc.Storage.Endpoint == "" || pc.Storage.Bucket == "" {
+				return fmt.Errorf("library %s: s3 storage requires an endpoint and a bucket", pc.Path)
+			}
+			if pc.Storage.AccessKey == "" {
+				pc.Storage.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+			}
+			if pc.Storage.SecretKey == "" {
+				pc.Storage.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+			}
+		default:
+			return fmt.Errorf("library %s: unknown storage type %q", pc.Path, pc.Storage.Type)
+		}
+	}
+	if c.Auth == nil {
+		c.Auth = &AuthConfig{Mode: authModeBasic}
+	}
+	switch c.Auth.Mode {
+	case "", authModeBasic:
+		c.Auth.Mode = authModeBasic
+	case authModeNone:
+	case authModeUsers:
+		if c.Auth.SessionTTL <= 0 {
+			return fmt.Errorf("invalid auth config: session_ttl must be positive")
+		}
+	default:
+		return fmt.Errorf("invalid auth config: unknown mode %q", c.Auth.Mode)
+	}
+	if c.Auth.OIDC != nil {
+		if err := c.Auth.OIDC.validate(c.Auth.Mode); err != nil {
+			return fmt.Errorf("invalid auth config: oidc: %w", err)
+		}
+	}
+	if c.Server.ViewsFlushInterval <= 0 {
+		return fmt.Errorf("invalid server config: views_flush_interval must be positive")
+	}
+	if err := c.Transcoder.validate(); err != nil {
+		return fmt.Errorf("invalid transcoder config: %w", err)
+	}
+	// DASH segments are as long as HLS ones, even with HLS disabled.
+	for _, pc := range c.Library {
+		if pc.DASH && c.Transcoder.HLS.SegmentDuration < 1 {
+			return fmt.Errorf("library %s: dash requires a transcoder hls segment_duration of at least 1 second", pc.Path)
+		}
+	}
+	return nil
+}
+
+var (
+	validBitrate = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[kKmM]?$`)
+	validSuffix  = regexp.MustCompile(`^[a-z0-9_-]+$`)
+	x264Presets  = map[string]bool{
+		"ultrafast": true, "superfast": true, "veryfast": true,
+		"faster": true, "fast": true, "medium": true, "slow": true,
+		"slower": true, "veryslow": true, "placebo": true,
+	}
+)
+
+// validate checks the transcoding profiles and converts any (deprecated)
+// Sizes into Renditions.
+func (c *TranscoderConfig) validate() error {
+	if c.Profiles == nil {
+		c.Profiles = make(map[string]*TranscodeProfile)
+	}
+	if c.Renditions == nil {
+		c.Renditions = make(Renditions)
+	}
+	for size, suffix := range c.Sizes {
+		name := fmt.Sprintf("size:%s", suffix)
+		c.Profiles[name] = &TranscodeProfile{
+			VideoCodec: "libx264",
+			AudioCodec: "aac",
+			CRF:        18,
+			Size:       size,
+		}
+		if _, ok := c.Renditions[suffix]; !ok {
+			c.Renditions[suffix] = name
+		}
+	}
+
+	if _, ok := c.Profiles[c.Profile]; !ok {
+		return fmt.Errorf("profile %q not found", c.Profile)
+	}
+	for suffix, profile := range c.Renditions {
+		if !validSuffix.MatchString(suffix) {
+			return fmt.Errorf("rendition %q: invalid suffix", suffix)
+		}
+		if _, ok := c.Profiles[profile]; !ok {
+			return fmt.Errorf("rendition %q: profile %q not found", suffix, profile)
+		}
+	}
+
+	if c.HLS == nil {
+		c.HLS = &HLSConfig{}
+	} else if c.HLS.Enabled {
+		if c.HLS.SegmentDuration < 1 {
+			return fmt.Errorf("hls: segment_duration must be at least 1 second")
+		}
+		if c.HLS.SegmentType != "fmp4" && c.HLS.SegmentType != "mpegts" {
+			return fmt.Errorf("hls: segment_type must be one of fmp4 or mpegts")
+		}
+	}
+
+	if c.Live == nil {
+		c.Live = &LiveConfig{}
+	} else if c.Live.Enabled {
+		p, ok := c.Profiles[c.Live.Profile]
+		if !ok {
+			return fmt.Errorf("live: profile %q not found", c.Live.Profile)
+		}
+		if p.VideoCodec == "copy" {
+			return fmt.Errorf("live: profile %q must not copy the video stream", c.Live.Profile)
+		}
+		if c.Live.MaxConcurrent < 1 {
+			return fmt.Errorf("live: max_concurrent must be at least 1")
+		}
+		if c.Live.CachePath == "" {
+			return fmt.Errorf("live: cache_path is required")
+		}
+	}
+
+	if c.Passthrough == nil {
+		c.Passthrough = &PassthroughConfig{}
+	} else if c.Passthrough.Enabled {
+		if len(c.Passthrough.VideoCodecs) == 0 {
+			return fmt.Errorf("passthrough: video_codecs is required")
+		}
+		if c.Passthrough.MaxHeight < 0 || c.Passthrough.MaxBitrate < 0 {
+			return fmt.Errorf("passthrough: max_height and max_bitrate must be positive")
+		}
+		if c.Profiles[c.Profile].AudioCodec == "copy" {
+			return fmt.Errorf("passthrough: profile %q must not copy the audio stream", c.Profile)
+		}
+	}
+
+	encoders, err := ffmpegEncoders()
+	if err != nil {
+		log.WithError(err).Warn("unable to list ffmpeg encoders, codecs will not be validated")
+	}
+	for name, p := range c.Profiles {
+		if err := p.validate(encoders); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// validate checks the profile for errors. If encoders is non-nil the codecs
+// must be one of them.
+func (p *TranscodeProfile) validate(encoders map[string]bool) error {
+	if p.VideoCodec == "" || p.AudioCodec == "" {
+		return fmt.Errorf("video_codec and audio_codec are required")
+	}
+	for _, codec := range []string{p.VideoCodec, p.AudioCodec} {
+		if encoders != nil && codec != "copy" && !encoders[codec] {
+			return fmt.Errorf("unknown encoder %q", codec)
+		}
+	}
+	if p.CRF < 0 || p.CRF > 51 {
+		return fmt.Errorf("crf %d out of range (0-51)", p.CRF)
+	}
+	if p.CRF > 0 && p.VideoBitrate != "" {
+		return fmt.Errorf("crf and video_bitrate are mutually exclusive")
+	}
+	if p.VideoBitrate != "" && !validBitrate.MatchString(p.VideoBitrate) {
+		return fmt.Errorf("invalid video_bitrate %q", p.VideoBitrate)
+	}
+	if p.AudioBitrate != "" && !validBitrate.MatchString(p.AudioBitrate) {
+		return fmt.Errorf("invalid audio_bitrate %q", p.AudioBitrate)
+	}
+	if p.Preset != "" && (p.VideoCodec == "libx264" || p.VideoCodec == "libx265") && !x264Presets[p.Preset] {
+		return fmt.Errorf("invalid preset %q for %s", p.Preset, p.VideoCodec)
+	}
+	if p.MaxHeight < 0 {
+		return fmt.Errorf("max_height must be positive")
+	}
+	if p.MaxHeight > 0 && p.Size != "" {
+		return fmt.Errorf("max_height and size are mutually exclusive")
+	}
+	if p.VideoCodec == "copy" && (p.CRF > 0 || p.VideoBitrate != "" || p.MaxHeight > 0 || p.Size != "") {
+		return fmt.Errorf("video_codec copy cannot be combined with crf, video_bitrate, max_height or size")
+	}
+	return nil
+}
+
+// validate checks the OIDC settings (only used by the users auth mode) and
+// fills in their defaults.
+func (c *OIDCConfig) validate(mode string) error {
+	if mode != authModeUsers {
+		return fmt.Errorf("requires the %s mode", authModeUsers)
+	}
+	if c.Issuer == "" || c.ClientID == "" {
+		return fmt.Errorf("issuer and client_id are required")
+	}
+	c.Issuer = strings.TrimSuffix(c.Issuer, "/")
+	if c.ClientSecret == "" {
+		c.ClientSecret = os.Getenv("oidc_client_secret")
+	}
+	if c.Name == "" {
+		c.Name = "SSO"
+	}
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "profile", "email"}
+	} else if !slices.Contains(c.Scopes, "openid") {
+		c.Scopes = append([]string{"openid"}, c.Scopes...)
+	}
+	if c.UsernameClaim == "" {
+		c.UsernameClaim = "preferred_username"
+	}
+	if c.GroupsClaim == "" {
+		c.GroupsClaim = "groups"
+	}
+	for group, role := range c.Roles {
+		if !role.Valid() {
+			return fmt.Errorf("invalid role %q of group %s", role, group)
+		}
+	}
+	if c.DefaultRole != "" && !c.DefaultRole.Valid() {
+		return fmt.Errorf("invalid default_role %q", c.DefaultRole)
+	}
+	return nil
+}
+
+// storage returns the media.Storage of the library path at pth.
+func (c *StorageConfig) storage(pth string) (media.Storage, error) {
+	if c.Type == "s3" {
+		return media.NewS3Storage(
+			c.Endpoint, c.Region, c.Bucket, c.Prefix,
+			c.AccessKey, c.SecretKey, c.PathStyle,
+		)
+	}
+	return media.NewLocalStorage(pth), nil
+}
@@ -0,0 +1,175 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/utils"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// phaseDASH is the name of the job phase segmenting videos for DASH.
+	phaseDASH = "dash"
+
+	// dashManifest is the name of the MPD manifest referencing every
+	// rendition of a video.
+	dashManifest = "manifest.mpd"
+)
+
+// dashDir returns the directory the DASH manifest and segments of the video
+// file vf are stored in.
+func dashDir(vf string) string {
+	return fmt.Sprintf("%s#dash", strings.TrimSuffix(vf, filepath.Ext(vf)))
+}
+
+// dash segments vf and each of its renditions (without re-encoding) into a
+// single DASH presentation with one video representation per rendition.
+func (a *App) dash(job *Job, vf string) error {
+	a.Jobs.Phase(job, phaseDASH)
+
+	info, err := media.Probe(vf)
+	if err != nil {
+		return err
+	}
+
+	tmp := dashDir(vf) + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return fmt.Errorf("error removing stale DASH directory: %w", err)
+	}
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return fmt.Errorf("error creating DASH directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	args := []string{"-y"}
+	var maps []string
+	n := 0
+	for _, suffix := range append([]string{""}, a.Config.Transcoder.Qualities()...) {
+		src := renditionFile(vf, suffix)
+		if !utils.FileExists(src) {
+			continue
+		}
+		args = append(args, "-i", src)
+		maps = append(maps, "-map", fmt.Sprintf("%d:v:0", n))
+		n++
+	}
+	args = append(args, maps...)
+
+	// Every rendition carries the same audio, so only the master's is used.
+	adaptationSets := "id=0,streams=v"
+	if info.AudioCodec != "" {
+		args = append(args, "-map", "0:a:0")
+		adaptationSets += " id=1,streams=a"
+	}
+
+	args = append(args,
+		"-c", "copy",
+		"-loglevel", "quiet",
+		"-f", "dash",
+		"-seg_duration", fmt.Sprint(a.Config.Transcoder.HLS.SegmentDuration),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-init_seg_name", "init_$RepresentationID$.m4s",
+		"-media_seg_name", "chunk_$RepresentationID$_$Number%05d$.m4s",
+		"-adaptation_sets", adaptationSets,
+		filepath.Join(tmp, dashManifest),
+	)
+
+	if err := a.ffmpeg(job, a.Config.Transcoder.Timeout, vf, args...); err != nil {
+		return fmt.Errorf("error segmenting video for DASH: %w", err)
+	}
+
+	if err := os.RemoveAll(dashDir(vf)); err != nil {
+		return fmt.Errorf("error removing previous DASH directory: %w", err)
+	}
+	if err := os.Rename(tmp, dashDir(vf)); err != nil {
+		return fmt.Errorf("error renaming DASH directory: %w", err)
+	}
+
+	return nil
+}
+
+// hasDASH returns true if a DASH manifest has been generated for the video.
+func hasDASH(m *media.Video) bool {
+	_, err := m.Location.Files().Stat(path.Join(dashDir(m.Name), dashManifest))
+	return err == nil
+}
+
+// segmentTemplateURL matches the URL attributes of the segment templates
+// of DASH manifests.
+var segmentTemplateURL = regexp.MustCompile(`\b(initialization|media)="[^"]*"`)
+
+// serveDASHManifest serves the manifest of m at the stable /v/id.mpd URL,
+// with a BaseURL pointing segment requests at /v/id/dash/.
+func serveDASHManifest(w http.ResponseWriter, r *http.Request, id string, m *media.Video) {
+	fn := path.Join(dashDir(m.Name), dashManifest)
+	data, err := media.ReadFile(m.Location.Files(), fn)
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	// The BaseURL must be the first child of the MPD element.
+	if i := bytes.Index(data, []byte("<MPD")); i >= 0 {
+		if j := bytes.IndexByte(data[i:], '>'); j >= 0 {
+			base := fmt.Sprintf("\n\t<BaseURL>/v/%s/dash/</BaseURL>", id)
+			at := i + j + 1
+			data = append(data[:at:at], append([]byte(base), data[at:]...)...)
+		}
+	}
+
+	// Segment URLs are resolved without the query of the manifest, so the
+	// token of its share link is appended to their templates.
+	if middleware.GetShare(r) != nil {
+		query := "?" + middleware.ShareParam + "=" + url.QueryEscape(r.URL.Query().Get(middleware.ShareParam))
+		data = segmentTemplateURL.ReplaceAllFunc(data, func(attr []byte) []byte {
+			return append(bytes.TrimSuffix(attr, []byte(`"`)), query+`"`...)
+		})
+	}
+
+	modtime := time.Time{}
+	if fi, err := m.Location.Files().Stat(fn); err == nil {
+		modtime = fi.ModTime
+	}
+	w.Header().Set("Content-Type", streamMimeTypes[".mpd"])
+	w.Header().Set("Cache-Control", streamCache(r, m)+", no-cache")
+	http.ServeContent(w, r, dashManifest, modtime, bytes.NewReader(data))
+}
+
+// HTTP handler for /v/id.mpd and /v/id/dash/file
+func (a *App) dashHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	file, segment := vars["file"]
+
+	// share links restricted to a quality don't grant the other renditions
+	m, ok := a.video(r, id)
+	if !ok || sharedQuality(r, "") != "" {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if segment {
+		serveStreamFile(w, r, m, dashDir(m.Name), file)
+		return
+	}
+
+	log.Printf("/v/%s.mpd", id)
+	if err := a.Views.Inc(id); err != nil {
+		log.Warn(err)
+	}
+	serveDASHManifest(w, r, id, m)
+}
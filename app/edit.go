@@ -0,0 +1,265 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/utils"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxThumbnailSize is the maximum size of uploaded thumbnails.
+const maxThumbnailSize = 10 << 20
+
+// parseTimestamp parses a position in a video given in seconds (e.g: 90.5)
+// or as [hh:]mm:ss (e.g: 1:30).
+func parseTimestamp(s string) (time.Duration, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	var seconds float64
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 || (i > 0 && n >= 60) {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		seconds = seconds*60 + n
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// frame grabs the frame of the video m at the position at as a JPEG.
+func (a *App) frame(m *media.Video, at time.Duration) ([]byte, error) {
+	src, err := m.Location.Source(m.Name)
+	if err != nil {
+		return nil, err
+	}
+	tf, err := ioutil.TempFile(a.Config.Server.UploadPath, "tube-frame-*.jpg")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file for thumbnail: %w", err)
+	}
+	tf.Close()
+	defer os.Remove(tf.Name())
+
+	if err := utils.RunCmd(
+		a.Config.Thumbnailer.Timeout,
+		"ffmpeg",
+		"-ss", fmt.Sprintf("%.3f", at.Seconds()),
+		"-i", src,
+		"-y",
+		"-vframes", "1",
+		"-loglevel", "quiet",
+		tf.Name(),
+	); err != nil {
+		return nil, fmt.Errorf("error generating thumbnail: %w", err)
+	}
+	return os.ReadFile(tf.Name())
+}
+
+// toJPEG returns the uploaded image data as a JPEG, converting other
+// formats (e.g: PNG) with ffmpeg.
+func (a *App) toJPEG(data []byte) ([]byte, error) {
+	ct := http.DetectContentType(data)
+	if ct == "image/jpeg" {
+		return data, nil
+	}
+	if !strings.HasPrefix(ct, "image/") {
+		return nil, fmt.Errorf("thumbnail is not an image (%s)", ct)
+	}
+
+	src, err := ioutil.TempFile(a.Config.Server.UploadPath, "tube-thumb-*")
+	if err != nil {
+		return nil, fmt.Errorf("error creating temporary file for thumbnail: %w", err)
+	}
+	defer os.Remove(src.Name())
+	if _, err := src.Write(data); err != nil {
+		src.Close()
+		return nil, err
+	}
+	src.Close()
+
+	dst := src.Name() + ".jpg"
+	defer os.Remove(dst)
+	if err := utils.RunCmd(
+		a.Config.Thumbnailer.Timeout,
+		"ffmpeg",
+		"-i", src.Name(),
+		"-y",
+		"-vframes", "1",
+		"-loglevel", "quiet",
+		dst,
+	); err != nil {
+		return nil, fmt.Errorf("error converting thumbnail: %w", err)
+	}
+	return os.ReadFile(dst)
+}
+
+// editThumbnail returns the new thumbnail of the video m from the edit
+// form: the uploaded image or the frame at the chosen position, or nil if
+// the thumbnail is unchanged.
+func (a *App) editThumbnail(r *http.Request, m *media.Video) ([]byte, error) {
+	file, _, err := r.FormFile("thumbnail")
+	if err == nil {
+		defer file.Close()
+		data, err := ioutil.ReadAll(io.LimitReader(file, maxThumbnailSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("error reading thumbnail: %w", err)
+		}
+		if len(data) > maxThumbnailSize {
+			return nil, fmt.Errorf("thumbnail exceeds maximum size of %d bytes", maxThumbnailSize)
+		}
+		return a.toJPEG(data)
+	} else if err != http.ErrMissingFile && err != http.ErrNotMultipart {
+		return nil, fmt.Errorf("error reading thumbnail: %w", err)
+	}
+
+	if s := r.FormValue("thumbnail_at"); s != "" {
+		at, err := parseTimestamp(s)
+		if err != nil {
+			return nil, err
+		}
+		if m.Duration > 0 && at >= m.Duration {
+			return nil, fmt.Errorf("timestamp %s is past the end of the video (%s)", s, formatDuration(m.Duration))
+		}
+		return a.frame(m, at)
+	}
+
+	return nil, nil
+}
+
+// updateVideo writes the changes of the metadata of the video m (title,
+// description, tags, category and/or visibility) to its sidecar, and
+// returns it reloaded.
+func (a *App) updateVideo(m *media.Video, changes map[string]interface{}) (*media.Video, error) {
+	if visibility, ok := changes["visibility"].(media.Visibility); ok && visibility == media.Public {
+		// the default, removed from the sidecar
+		changes["visibility"] = ""
+	}
+	if len(changes) > 0 {
+		if err := media.WriteMetadata(m.Location, m.Name, changes); err != nil {
+			return nil, fmt.Errorf("error writing metadata: %w", err)
+		}
+	}
+
+	// Reparse the video so that the changes are visible immediately.
+	if err := a.Library.Add(m.Path); err != nil {
+		return nil, fmt.Errorf("error reloading video: %w", err)
+	}
+	buildFeed(a)
+
+	log.WithField("id", m.ID).Info("edited video")
+	return a.Library.Videos[m.ID], nil
+}
+
+// HTTP handler for /edit/id
+func (a *App) editHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	m, ok := a.video(r, id)
+	if !ok {
+		http.Error(w, "Video Not Found", http.StatusNotFound)
+		return
+	}
+	if !a.canEdit(r, m.Owner) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		ctx := &struct {
+			Config  *Config
+			Playing *media.Video
+		}{
+			Config:  a.Config,
+			Playing: m,
+		}
+		a.render("edit", w, ctx)
+		return
+	case http.MethodPost:
+	default:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if m.Location.ReadOnly {
+		http.Error(w, media.ErrReadOnly.Error(), http.StatusForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxThumbnailSize+uploadParserBuffer)
+	if err := r.ParseMultipartForm(uploadParserBuffer); err != nil && err != http.ErrNotMultipart {
+		err := fmt.Errorf("error processing form: %w", err)
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	thumb, err := a.editThumbnail(r, m)
+	if err != nil {
+		log.WithError(err).WithField("id", id).Warn("error editing thumbnail")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if thumb != nil {
+		if err := media.WriteThumbnail(m.Location, m.Name, thumb); err != nil {
+			log.WithError(err).WithField("id", id).Error("error writing thumbnail")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Only the fields that were submitted are changed.
+	changes := make(map[string]interface{})
+	for _, key := range []string{"title", "description", "category"} {
+		if _, ok := r.Form[key]; ok {
+			changes[key] = strings.TrimSpace(r.FormValue(key))
+		}
+	}
+	if _, ok := r.Form["tags"]; ok {
+		changes["tags"] = media.ParseTags(r.FormValue("tags"))
+	}
+	if _, ok := r.Form["visibility"]; ok {
+		visibility, err := media.ParseVisibility(r.FormValue("visibility"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		changes["visibility"] = visibility
+	}
+	m, err = a.updateVideo(m, changes)
+	if errors.Is(err, media.ErrReadOnly) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.WithError(err).WithField("id", id).Error("error editing video")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", fmt.Sprintf("/v/%s", id))
+	if err := json.NewEncoder(w).Encode(&struct {
+		ID          string           `json:"id"`
+		Title       string           `json:"title"`
+		Description string           `json:"description"`
+		Tags        media.Tags       `json:"tags"`
+		Category    string           `json:"category"`
+		Owner       string           `json:"owner,omitempty"`
+		Visibility  media.Visibility `json:"visibility"`
+	}{m.ID, m.Title, m.Description, m.Tags, m.Category, m.Owner, m.Visibility}); err != nil {
+		log.WithError(err).WithField("id", id).Error("error encoding video")
+	}
+}
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"encoding/xml"
 	"fmt"
 	"net/url"
 	"os"
@@ -8,13 +9,62 @@ import (
 	"strconv"
 	"time"
 
+	"git.mills.io/prologic/tube/media"
+
 	"github.com/wybiral/feeds"
 )
 
+// rssFeedXML is feeds.RssFeedXml with the iTunes namespace, so that items
+// can carry the duration of their video.
+type rssFeedXML struct {
+	XMLName          xml.Name `xml:"rss"`
+	Version          string   `xml:"version,attr"`
+	ContentNamespace string   `xml:"xmlns:content,attr"`
+	ITunesNamespace  string   `xml:"xmlns:itunes,attr"`
+	Channel          *rssChannel
+}
+
+type rssChannel struct {
+	*feeds.RssFeed
+	Items []*rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	*feeds.RssItem
+	Duration string `xml:"itunes:duration,omitempty"`
+}
+
 // buildFeed creates RSS feed attribute for App based on Library contents.
 func buildFeed(a *App) {
+	feed, err := a.feed("", "", "", a.Library.Playlist())
+	if err != nil {
+		return
+	}
+	a.Feed = feed
+}
+
+// externalURL returns the URL tube is reachable at, for the links of feeds.
+func (a *App) externalURL() string {
+	if len(a.Config.Feed.ExternalURL) > 0 {
+		return a.Config.Feed.ExternalURL
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		host := a.Config.Server.Host
+		port := a.Config.Server.Port
+		return fmt.Sprintf("http://%s:%d", host, port)
+	}
+	return fmt.Sprintf("http://%s", hostname)
+}
+
+// feed renders the RSS feed of the public videos of the playlist pl. The
+// title is appended to the configured title of the feed, and the
+// description and link (a path, e.g: of a tag page) replace its configured
+// ones, if not empty.
+func (a *App) feed(title, description, link string, pl media.Playlist) ([]byte, error) {
 	cfg := a.Config.Feed
 	now := time.Now()
+	externalURL := a.externalURL()
 	f := &feeds.Feed{
 		Title:       cfg.Title,
 		Link:        &feeds.Link{Href: cfg.Link},
@@ -26,23 +76,27 @@ func buildFeed(a *App) {
 		Created:   now,
 		Copyright: cfg.Copyright,
 	}
-	var externalURL string
-	if len(cfg.ExternalURL) > 0 {
-		externalURL = cfg.ExternalURL
-	} else {
-		hostname, err := os.Hostname()
+	if title != "" && cfg.Title != "" {
+		f.Title = fmt.Sprintf("%s - %s", cfg.Title, title)
+	} else if title != "" {
+		f.Title = title
+	}
+	if description != "" {
+		f.Description = description
+	}
+	if link != "" {
+		u, err := url.Parse(externalURL)
 		if err != nil {
-			host := a.Config.Server.Host
-			port := a.Config.Server.Port
-			externalURL = fmt.Sprintf("http://%s:%d", host, port)
-		} else {
-			externalURL = fmt.Sprintf("http://%s", hostname)
+			return nil, err
 		}
+		u.Path = path.Join(u.Path, link)
+		f.Link = &feeds.Link{Href: u.String()}
 	}
-	for _, v := range a.Library.Playlist() {
+	var durations []string
+	for _, v := range public(pl) {
 		u, err := url.Parse(externalURL)
 		if err != nil {
-			return
+			return nil, err
 		}
 		u.Path = path.Join(u.Path, "v", v.ID)
 		id := u.String()
@@ -54,7 +108,7 @@ func buildFeed(a *App) {
 			Enclosure: &feeds.Enclosure{
 				Url:    id + ".mp4",
 				Length: strconv.FormatInt(v.Size, 10),
-				Type:   "video/mp4",
+				Type:   a.videoContentType(v),
 			},
 			Author: &feeds.Author{
 				Name:  cfg.Author.Name,
@@ -62,10 +116,25 @@ func buildFeed(a *App) {
 			},
 			Created: v.Timestamp,
 		})
+		var duration string
+		if v.Duration > 0 {
+			duration = formatDuration(v.Duration)
+		}
+		durations = append(durations, duration)
 	}
-	feed, err := f.ToRss()
+	rss := (&feeds.Rss{Feed: f}).RssFeed()
+	channel := &rssChannel{RssFeed: rss}
+	for i, item := range rss.Items {
+		channel.Items = append(channel.Items, &rssItem{RssItem: item, Duration: durations[i]})
+	}
+	feed, err := xml.MarshalIndent(&rssFeedXML{
+		Version:          "2.0",
+		ContentNamespace: "http://purl.org/rss/1.0/modules/content/",
+		ITunesNamespace:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Channel:          channel,
+	}, "", "  ")
 	if err != nil {
-		return
+		return nil, err
 	}
-	a.Feed = []byte(feed)
+	return append([]byte(xml.Header[:len(xml.Header)-1]), feed...), nil
 }
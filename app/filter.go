@@ -0,0 +1,55 @@
+package app
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"git.mills.io/prologic/tube/media"
+)
+
+// playlistFilter restricts the playlist of the video pages to the videos
+// with a tag and/or of a collection (library prefix), given as the tag and
+// collection query parameters.
+type playlistFilter struct {
+	Tag        string
+	Collection string
+}
+
+// parseFilter returns the playlist filter of the request r.
+func parseFilter(r *http.Request) playlistFilter {
+	return playlistFilter{
+		Tag:        media.NormalizeTag(r.URL.Query().Get("tag")),
+		Collection: strings.Trim(r.URL.Query().Get("collection"), "/"),
+	}
+}
+
+// Apply returns the videos of the playlist pl matching the filter.
+func (f playlistFilter) Apply(pl media.Playlist) media.Playlist {
+	if f.Tag == "" && f.Collection == "" {
+		return pl
+	}
+	return pl.Filter(func(v *media.Video) bool {
+		if f.Tag != "" && !v.HasTag(f.Tag) {
+			return false
+		}
+		if f.Collection != "" && (v.Location == nil || v.Location.Prefix != f.Collection) {
+			return false
+		}
+		return true
+	})
+}
+
+// Query returns the filter as query parameters, to be appended to the links
+// of the playlist so that it stays filtered.
+func (f playlistFilter) Query() template.URL {
+	q := url.Values{}
+	if f.Tag != "" {
+		q.Set("tag", f.Tag)
+	}
+	if f.Collection != "" {
+		q.Set("collection", f.Collection)
+	}
+	return template.URL(q.Encode())
+}
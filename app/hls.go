@@ -0,0 +1,286 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/utils"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// phaseHLS is the name of the job phase segmenting videos for HLS.
+	phaseHLS = "hls"
+
+	// hlsMasterPlaylist is the name of the playlist referencing every
+	// rendition of a video.
+	hlsMasterPlaylist = "master.m3u8"
+
+	// hlsSource is the name of the HLS rendition of the master video.
+	hlsSource = "source"
+)
+
+// validStreamFile matches the names of playlists and segments that may be
+// served from a video's stream directory.
+var validStreamFile = regexp.MustCompile(`^[a-zA-Z0-9_-]+\.(m3u8|m4s|mp4|ts|mpd)$`)
+
+// streamMimeTypes maps the extensions of HLS and DASH files to their MIME types.
+var streamMimeTypes = map[string]string{
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".ts":   "video/mp2t",
+	".mpd":  "application/dash+xml",
+}
+
+// hlsDir returns the directory the HLS playlists and segments of the video
+// file vf are stored in.
+func hlsDir(vf string) string {
+	return fmt.Sprintf("%s#hls", strings.TrimSuffix(vf, filepath.Ext(vf)))
+}
+
+// renditionFile returns the file of the rendition of vf with the given
+// suffix, or vf itself for an empty suffix.
+func renditionFile(vf, suffix string) string {
+	if suffix == "" {
+		return vf
+	}
+	return fmt.Sprintf("%s#%s.mp4", strings.TrimSuffix(vf, filepath.Ext(vf)), suffix)
+}
+
+// keyframeArgs returns the ffmpeg options forcing keyframes at every HLS
+// (or DASH) segment boundary, so that renditions segment at the same
+// positions and players can switch between them seamlessly.
+func (a *App) keyframeArgs(p *media.Path) []string {
+	if !a.hlsEnabled() && !p.DASH {
+		return nil
+	}
+	return []string{
+		"-force_key_frames",
+		fmt.Sprintf("expr:gte(t,n_forced*%d)", a.Config.Transcoder.HLS.SegmentDuration),
+	}
+}
+
+// segment splits vf and each of its renditions into HLS segments (without
+// re-encoding) and writes a master playlist referencing all of them.
+func (a *App) segment(job *Job, vf string) error {
+	cfg := a.Config.Transcoder.HLS
+	a.Jobs.Phase(job, phaseHLS)
+
+	tmp := hlsDir(vf) + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return fmt.Errorf("error removing stale HLS directory: %w", err)
+	}
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return fmt.Errorf("error creating HLS directory: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	type variant struct {
+		name string
+		info *media.ProbeInfo
+	}
+
+	suffixes := append([]string{""}, a.Config.Transcoder.Qualities()...)
+	var variants []variant
+	for i, suffix := range suffixes {
+		src := renditionFile(vf, suffix)
+		if !utils.FileExists(src) {
+			continue
+		}
+		name := suffix
+		if name == "" {
+			name = hlsSource
+		}
+
+		info, err := media.Probe(src)
+		if err != nil {
+			return err
+		}
+
+		ext := "m4s"
+		args := []string{
+			"-y",
+			"-i", src,
+			"-c", "copy",
+			"-loglevel", "quiet",
+			"-f", "hls",
+			"-hls_time", fmt.Sprint(cfg.SegmentDuration),
+			"-hls_playlist_type", "vod",
+		}
+		if cfg.SegmentType == "mpegts" {
+			ext = "ts"
+			args = append(args, "-hls_segment_type", "mpegts")
+		} else {
+			args = append(args,
+				"-hls_segment_type", "fmp4",
+				"-hls_fmp4_init_filename", fmt.Sprintf("%s_init.mp4", name),
+			)
+		}
+		args = append(args,
+			"-hls_segment_filename", filepath.Join(tmp, fmt.Sprintf("%s_%%05d.%s", name, ext)),
+			filepath.Join(tmp, fmt.Sprintf("%s.m3u8", name)),
+		)
+
+		if err := utils.RunCmd(a.Config.Transcoder.Timeout, "ffmpeg", args...); err != nil {
+			return fmt.Errorf("error segmenting video for HLS: %w", err)
+		}
+
+		variants = append(variants, variant{name: name, info: info})
+		a.Jobs.Progress(job, 100*float64(i+1)/float64(len(suffixes)))
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	if cfg.SegmentType == "mpegts" {
+		b.WriteString("#EXT-X-VERSION:3\n")
+	} else {
+		b.WriteString("#EXT-X-VERSION:7\n")
+	}
+	for _, v := range variants {
+		bandwidth := v.info.Bitrate
+		if bandwidth <= 0 {
+			// BANDWIDTH is required, so make a conservative guess.
+			bandwidth = 5_000_000
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", bandwidth)
+		if v.info.Width > 0 && v.info.Height > 0 {
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", v.info.Width, v.info.Height)
+		}
+		fmt.Fprintf(&b, "\n%s.m3u8\n", v.name)
+	}
+	if err := os.WriteFile(filepath.Join(tmp, hlsMasterPlaylist), []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("error writing HLS master playlist: %w", err)
+	}
+
+	if err := os.RemoveAll(hlsDir(vf)); err != nil {
+		return fmt.Errorf("error removing previous HLS directory: %w", err)
+	}
+	if err := os.Rename(tmp, hlsDir(vf)); err != nil {
+		return fmt.Errorf("error renaming HLS directory: %w", err)
+	}
+
+	return nil
+}
+
+// hasHLS returns true if HLS playlists have been generated for the video.
+func hasHLS(m *media.Video) bool {
+	_, err := m.Location.Files().Stat(path.Join(hlsDir(m.Name), hlsMasterPlaylist))
+	return err == nil
+}
+
+// playlistURI matches the URI attributes of the tags of HLS playlists.
+var playlistURI = regexp.MustCompile(`URI="([^"]*)"`)
+
+// sharePlaylist returns the HLS playlist data with the share link token
+// appended to the URIs of the playlists and segments it references.
+func sharePlaylist(data []byte, token string) []byte {
+	query := "?" + middleware.ShareParam + "=" + url.QueryEscape(token)
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			lines[i] = playlistURI.ReplaceAllStringFunc(line, func(attr string) string {
+				return strings.TrimSuffix(attr, `"`) + query + `"`
+			})
+		default:
+			lines[i] = line + query
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// streamCache returns the cacheability of the stream files of the video m
+// requested by r: those of unlisted and private videos (or opened with share
+// links) must not be kept by shared caches.
+func streamCache(r *http.Request, m *media.Video) string {
+	if !m.Listed() || middleware.GetShare(r) != nil {
+		return "private"
+	}
+	return "public"
+}
+
+// serveStreamFile serves a playlist, manifest or segment named file from
+// the stream directory dir of the video m.
+func serveStreamFile(w http.ResponseWriter, r *http.Request, m *media.Video, dir, file string) {
+	if !validStreamFile.MatchString(file) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	ext := filepath.Ext(file)
+	w.Header().Set("Content-Type", streamMimeTypes[ext])
+	if ext == ".m3u8" || ext == ".mpd" {
+		w.Header().Set("Cache-Control", streamCache(r, m)+", no-cache")
+	} else {
+		w.Header().Set("Cache-Control", streamCache(r, m)+", max-age=7776000")
+	}
+
+	// Players resolve the URIs of playlists without their query, so those
+	// requested with a share link get its token appended to them.
+	p := m.Location
+	if ext == ".m3u8" && middleware.GetShare(r) != nil {
+		data, err := media.ReadFile(p.Files(), path.Join(dir, file))
+		if err != nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		data = sharePlaylist(data, r.URL.Query().Get(middleware.ShareParam))
+		http.ServeContent(w, r, file, time.Time{}, bytes.NewReader(data))
+		return
+	}
+	if p.Local() {
+		fn, err := securejoin.SecureJoin(filepath.Join(p.Path, dir), file)
+		if err != nil || !utils.FileExists(fn) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		http.ServeFile(w, r, fn)
+		return
+	}
+
+	f, fi, err := media.Open(p.Files(), path.Join(dir, file))
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, file, fi.ModTime, f)
+}
+
+// HTTP handler for /v/id/hls/file
+func (a *App) hlsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	file := vars["file"]
+
+	// share links restricted to a quality don't grant the other renditions
+	m, ok := a.video(r, id)
+	if !ok || sharedQuality(r, "") != "" {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if file == hlsMasterPlaylist {
+		log.Printf("/v/%s/hls", id)
+		if err := a.Views.Inc(id); err != nil {
+			log.Warn(err)
+		}
+	}
+
+	serveStreamFile(w, r, m, hlsDir(m.Name), file)
+}
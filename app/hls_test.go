@@ -0,0 +1,79 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+	"git.mills.io/prologic/tube/media"
+)
+
+func TestServeStreamFileCache(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, hlsDir("v")), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{hlsMasterPlaylist, "720p_00001.m4s"} {
+		if err := os.WriteFile(filepath.Join(dir, hlsDir("v"), name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := &media.Path{Path: dir}
+	key := []byte("key")
+	token, err := middleware.SignShare(key, &middleware.Share{ID: "link", Video: "v", Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		visibility media.Visibility
+		shared     bool
+		file       string
+		cache      string
+	}{
+		{media.Public, false, hlsMasterPlaylist, "public, no-cache"},
+		{media.Public, false, "720p_00001.m4s", "public, max-age=7776000"},
+		{media.Unlisted, false, "720p_00001.m4s", "private, max-age=7776000"},
+		{media.Private, false, hlsMasterPlaylist, "private, no-cache"},
+		{media.Private, false, "720p_00001.m4s", "private, max-age=7776000"},
+		{media.Public, true, "720p_00001.m4s", "private, max-age=7776000"},
+	}
+	for _, test := range tests {
+		m := &media.Video{ID: "v", Name: "v", Location: p, Visibility: test.visibility}
+		target := "/v/v/hls/" + test.file
+		if test.shared {
+			target += "?" + middleware.ShareParam + "=" + token
+		}
+		w := httptest.NewRecorder()
+		middleware.AllowShared(func(w http.ResponseWriter, r *http.Request) {
+			serveStreamFile(w, r, m, hlsDir(m.Name), test.file)
+		}, func() []byte { return key }, func(r *http.Request, s *middleware.Share) error {
+			return nil
+		})(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK || w.Header().Get("Cache-Control") != test.cache {
+			t.Errorf("%s %s (shared: %v): status %d with Cache-Control %q, want %q", test.visibility, test.file, test.shared, w.Code, w.Header().Get("Cache-Control"), test.cache)
+		}
+	}
+}
+
+func TestSharePlaylist(t *testing.T) {
+	playlist := "#EXTM3U\n" +
+		"#EXT-X-VERSION:7\n" +
+		"#EXT-X-MAP:URI=\"720p_init.mp4\"\n" +
+		"#EXTINF:6.000000,\n" +
+		"720p_00001.m4s\r\n" +
+		"#EXT-X-ENDLIST\n"
+	want := "#EXTM3U\n" +
+		"#EXT-X-VERSION:7\n" +
+		"#EXT-X-MAP:URI=\"720p_init.mp4?share=a.b\"\n" +
+		"#EXTINF:6.000000,\n" +
+		"720p_00001.m4s?share=a.b\n" +
+		"#EXT-X-ENDLIST\n"
+	if got := string(sharePlaylist([]byte(playlist), "a.b")); got != want {
+		t.Errorf("sharePlaylist = %q, want %q", got, want)
+	}
+}
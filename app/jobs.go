@@ -0,0 +1,512 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"git.mills.io/prologic/tube/media"
+
+	shortuuid "github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxRetryBackoff caps the exponential backoff between job attempts.
+const maxRetryBackoff = time.Hour
+
+// JobState is the lifecycle state of a Job.
+type JobState string
+
+const (
+	// JobQueued is a job waiting for a worker (or for its next attempt).
+	JobQueued JobState = "queued"
+	// JobRunning is a job currently being processed by a worker.
+	JobRunning JobState = "running"
+	// JobFailed is a job that exhausted its attempts or failed permanently.
+	JobFailed JobState = "failed"
+	// JobDone is a job that completed successfully.
+	JobDone JobState = "done"
+)
+
+// JobKind selects the function a Job is dispatched to.
+type JobKind string
+
+const (
+	// JobUpload transcodes a video uploaded through /upload.
+	JobUpload JobKind = "upload"
+	// JobImport downloads and transcodes a video imported through /import.
+	JobImport JobKind = "import"
+)
+
+// JobPhase is a single step of a Job, e.g: transcoding the video or
+// resizing it to one of the configured sizes.
+type JobPhase struct {
+	Name     string   `json:"name"`
+	State    JobState `json:"state"`
+	Progress float64  `json:"progress"`
+}
+
+// Job is a unit of background work. Jobs are persisted in the Store so
+// that they survive a restart of tube and are resumed or retried.
+type Job struct {
+	ID       string   `json:"id"`
+	Kind     JobKind  `json:"kind"`
+	State    JobState `json:"state"`
+	Attempts int      `json:"attempts"`
+	Error    string   `json:"error,omitempty"`
+
+	// Library is the library path the resulting video is stored in.
+	Library string `json:"library"`
+	// Source is a temporary file owned by the job. It is removed once the
+	// job is finished (done or failed).
+	Source      string `json:"source,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Tags, Category, Owner (the user who queued the job) and Visibility
+	// are written to the .yml sidecar of the video.
+	Tags       media.Tags       `json:"tags,omitempty"`
+	Category   string           `json:"category,omitempty"`
+	Owner      string           `json:"owner,omitempty"`
+	Visibility media.Visibility `json:"visibility,omitempty"`
+	// Video is the final path of the video once it has been published.
+	Video string `json:"video,omitempty"`
+	// Stage is a temporary directory owned by the job, where videos for
+	// library paths not stored locally are published before being stored.
+	// It is removed once the job is finished (done or failed).
+	Stage string `json:"stage,omitempty"`
+
+	Phases []*JobPhase `json:"phases,omitempty"`
+
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+}
+
+// Finished returns true if the job will not be run again.
+func (j *Job) Finished() bool {
+	return j.State == JobDone || j.State == JobFailed
+}
+
+// phase returns the phase with the given name, if it is planned.
+func (j *Job) phase(name string) *JobPhase {
+	for _, ph := range j.Phases {
+		if ph.Name == name {
+			return ph
+		}
+	}
+	return nil
+}
+
+// current returns the running phase, if any.
+func (j *Job) current() *JobPhase {
+	for _, ph := range j.Phases {
+		if ph.State == JobRunning {
+			return ph
+		}
+	}
+	return nil
+}
+
+// JobStatus is the public view of a Job reported by the /jobs API.
+type JobStatus struct {
+	ID          string      `json:"id"`
+	Kind        JobKind     `json:"kind"`
+	State       JobState    `json:"state"`
+	Attempts    int         `json:"attempts"`
+	Error       string      `json:"error,omitempty"`
+	Title       string      `json:"title,omitempty"`
+	Owner       string      `json:"owner,omitempty"`
+	Phase       string      `json:"phase,omitempty"`
+	Progress    float64     `json:"progress"`
+	Phases      []*JobPhase `json:"phases"`
+	Created     time.Time   `json:"created"`
+	Updated     time.Time   `json:"updated"`
+	NextAttempt *time.Time  `json:"next_attempt,omitempty"`
+}
+
+// Status returns the public view of the job. Progress is the overall
+// percentage of completion across all phases.
+func (j *Job) Status() *JobStatus {
+	st := &JobStatus{
+		ID:       j.ID,
+		Kind:     j.Kind,
+		State:    j.State,
+		Attempts: j.Attempts,
+		Error:    j.Error,
+		Title:    j.Title,
+		Owner:    j.Owner,
+		Phases:   make([]*JobPhase, len(j.Phases)),
+		Created:  j.Created,
+		Updated:  j.Updated,
+	}
+	if j.State == JobQueued && !j.NextAttempt.IsZero() {
+		next := j.NextAttempt
+		st.NextAttempt = &next
+	}
+	for i, ph := range j.Phases {
+		phase := *ph
+		st.Phases[i] = &phase
+		st.Progress += ph.Progress / float64(len(j.Phases))
+	}
+	if ph := j.current(); ph != nil {
+		st.Phase = ph.Name
+	}
+	if j.State == JobDone {
+		st.Progress = 100
+	}
+	return st
+}
+
+// JobFunc processes a single Job.
+type JobFunc func(job *Job) error
+
+// permanentError marks a job error that retrying cannot fix.
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error { return e.error }
+
+// permanent wraps err so that the job is failed without further attempts.
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// JobQueue runs persisted jobs on a pool of workers. Running jobs are kept
+// in memory so their progress can be reported to subscribers without
+// writing every progress update to the Store.
+type JobQueue struct {
+	mu          sync.Mutex
+	cfg         *JobsConfig
+	store       Store
+	handlers    map[JobKind]JobFunc
+	pending     chan string
+	running     map[string]*Job
+	subscribers map[string][]chan []byte
+}
+
+func newJobQueue(cfg *JobsConfig, store Store) *JobQueue {
+	return &JobQueue{
+		cfg:         cfg,
+		store:       store,
+		handlers:    make(map[JobKind]JobFunc),
+		pending:     make(chan string),
+		running:     make(map[string]*Job),
+		subscribers: make(map[string][]chan []byte),
+	}
+}
+
+// Handle registers the function used to process jobs of the given kind.
+func (q *JobQueue) Handle(kind JobKind, fn JobFunc) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[kind] = fn
+}
+
+// Enqueue persists a new job and schedules it for processing.
+func (q *JobQueue) Enqueue(job *Job) error {
+	now := time.Now()
+	job.ID = shortuuid.New()
+	job.State = JobQueued
+	job.Created = now
+	job.Updated = now
+	if err := q.store.PutJob(job); err != nil {
+		return fmt.Errorf("error storing job %s: %w", job.ID, err)
+	}
+	log.WithField("job", job.ID).WithField("kind", job.Kind).Info("job queued")
+	q.schedule(job.ID, 0)
+	return nil
+}
+
+// Status returns the status of the job with the given id.
+func (q *JobQueue) Status(id string) (*JobStatus, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job, ok := q.running[id]; ok {
+		return job.Status(), nil
+	}
+	job, err := q.store.GetJob(id)
+	if err != nil {
+		return nil, err
+	}
+	return job.Status(), nil
+}
+
+// Subscribe returns a channel that receives the JSON encoded JobStatus of
+// the job with the given id whenever it changes. Only the latest status is
+// buffered, so slow subscribers skip intermediate updates. The channel is
+// closed when the job is finished; cancel must be called once the subscriber
+// is no longer interested.
+func (q *JobQueue) Subscribe(id string) (<-chan []byte, func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ch := make(chan []byte, 1)
+	q.subscribers[id] = append(q.subscribers[id], ch)
+	cancel := func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		subs := q.subscribers[id]
+		for i, sub := range subs {
+			if sub == ch {
+				q.subscribers[id] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+		if len(q.subscribers[id]) == 0 {
+			delete(q.subscribers, id)
+		}
+	}
+	return ch, cancel
+}
+
+// publish sends the job's status to its subscribers. Subscribers of a
+// finished job are removed. The caller must hold q.mu.
+func (q *JobQueue) publish(job *Job) {
+	data, err := json.Marshal(job.Status())
+	if err != nil {
+		log.WithError(err).WithField("job", job.ID).Error("error encoding job status")
+		return
+	}
+	for _, ch := range q.subscribers[job.ID] {
+		// Replace any pending status not yet received by the subscriber.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- data
+		if job.Finished() {
+			close(ch)
+		}
+	}
+	if job.Finished() {
+		delete(q.subscribers, job.ID)
+	}
+}
+
+// Plan sets the phases a running job goes through. Phases already completed
+// by a previous attempt keep their state.
+func (q *JobQueue) Plan(job *Job, phases ...string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	planned := make([]*JobPhase, len(phases))
+	for i, name := range phases {
+		if ph := job.phase(name); ph != nil && ph.State == JobDone {
+			planned[i] = ph
+			continue
+		}
+		planned[i] = &JobPhase{Name: name, State: JobQueued}
+	}
+	job.Phases = planned
+	q.save(job)
+}
+
+// Phase marks the named phase of a running job as started, completing the
+// previously running phase.
+func (q *JobQueue) Phase(job *Job, name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ph := job.current(); ph != nil {
+		ph.State = JobDone
+		ph.Progress = 100
+	}
+	ph := job.phase(name)
+	if ph == nil {
+		ph = &JobPhase{Name: name}
+		job.Phases = append(job.Phases, ph)
+	}
+	ph.State = JobRunning
+	ph.Progress = 0
+	q.save(job)
+}
+
+// Progress records the percentage of completion of the running phase.
+// Progress is only reported to subscribers and not persisted.
+func (q *JobQueue) Progress(job *Job, percent float64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ph := job.current()
+	if ph == nil {
+		return
+	}
+	if percent > 100 {
+		percent = 100
+	}
+	ph.Progress = percent
+	q.publish(job)
+}
+
+// Update applies fn to a running job and persists the result.
+func (q *JobQueue) Update(job *Job, fn func(job *Job)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	fn(job)
+	q.save(job)
+}
+
+// save persists the job and publishes its status. The caller must hold q.mu.
+func (q *JobQueue) save(job *Job) {
+	job.Updated = time.Now()
+	if err := q.store.PutJob(job); err != nil {
+		log.WithError(err).WithField("job", job.ID).Error("error storing job")
+	}
+	q.publish(job)
+}
+
+// Start recovers unfinished jobs from the Store and starts the workers.
+// Jobs that were running when tube stopped are queued again.
+func (q *JobQueue) Start() error {
+	jobs, err := q.store.ListJobs()
+	if err != nil {
+		return fmt.Errorf("error listing jobs: %w", err)
+	}
+	retention := time.Duration(q.cfg.Retention) * time.Hour
+	for _, job := range jobs {
+		if job.Finished() {
+			if retention > 0 && time.Since(job.Updated) > retention {
+				if err := q.store.DeleteJob(job.ID); err != nil {
+					log.WithError(err).WithField("job", job.ID).Warn("error purging expired job")
+				}
+			}
+			continue
+		}
+		if job.State == JobRunning {
+			log.WithField("job", job.ID).Info("resuming job interrupted by restart")
+			job.State = JobQueued
+			job.Updated = time.Now()
+			if err := q.store.PutJob(job); err != nil {
+				return fmt.Errorf("error storing job %s: %w", job.ID, err)
+			}
+		}
+		q.schedule(job.ID, time.Until(job.NextAttempt))
+	}
+	workers := q.cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return nil
+}
+
+func (q *JobQueue) schedule(id string, delay time.Duration) {
+	if delay <= 0 {
+		go func() { q.pending <- id }()
+		return
+	}
+	time.AfterFunc(delay, func() { q.pending <- id })
+}
+
+func (q *JobQueue) worker() {
+	for id := range q.pending {
+		q.run(id)
+	}
+}
+
+func (q *JobQueue) run(id string) {
+	job, err := q.store.GetJob(id)
+	if err != nil {
+		log.WithError(err).WithField("job", id).Error("error loading job")
+		return
+	}
+	if job.State != JobQueued {
+		return
+	}
+
+	q.mu.Lock()
+	fn, ok := q.handlers[job.Kind]
+	q.mu.Unlock()
+	if !ok {
+		q.finish(job, permanent(fmt.Errorf("no handler for job kind %q", job.Kind)))
+		return
+	}
+
+	q.mu.Lock()
+	job.State = JobRunning
+	job.Attempts++
+	job.Error = ""
+	job.Updated = time.Now()
+	if err := q.store.PutJob(job); err != nil {
+		q.mu.Unlock()
+		log.WithError(err).WithField("job", id).Error("error storing job")
+		return
+	}
+	q.running[job.ID] = job
+	q.publish(job)
+	q.mu.Unlock()
+
+	log.
+		WithField("job", job.ID).
+		WithField("kind", job.Kind).
+		WithField("attempt", job.Attempts).
+		Info("job started")
+
+	q.finish(job, fn(job))
+}
+
+// finish records the outcome of a job attempt and schedules a retry with
+// exponential backoff if the job can still succeed.
+func (q *JobQueue) finish(job *Job, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, job.ID)
+
+	job.Updated = time.Now()
+	if ph := job.current(); ph != nil {
+		if err == nil {
+			ph.State = JobDone
+			ph.Progress = 100
+		} else {
+			ph.State = JobFailed
+		}
+	}
+	switch {
+	case err == nil:
+		job.State = JobDone
+		log.WithField("job", job.ID).Info("job done")
+	case errors.As(err, &permanentError{}) || job.Attempts >= q.cfg.MaxAttempts:
+		job.State = JobFailed
+		job.Error = err.Error()
+		log.WithError(err).WithField("job", job.ID).Error("job failed")
+	default:
+		backoff := time.Duration(q.cfg.RetryBackoff) * time.Second << (job.Attempts - 1)
+		if backoff < 0 || backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+		job.State = JobQueued
+		job.Error = err.Error()
+		job.NextAttempt = job.Updated.Add(backoff)
+		log.
+			WithError(err).
+			WithField("job", job.ID).
+			WithField("backoff", backoff).
+			Warn("job attempt failed, retrying")
+	}
+
+	if job.Finished() && job.Source != "" {
+		if err := os.Remove(job.Source); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("job", job.ID).Warn("error removing job source")
+		}
+	}
+	if job.Finished() && job.Stage != "" {
+		if err := os.RemoveAll(job.Stage); err != nil {
+			log.WithError(err).WithField("job", job.ID).Warn("error removing job stage")
+		}
+	}
+
+	if err := q.store.PutJob(job); err != nil {
+		log.WithError(err).WithField("job", job.ID).Error("error storing job")
+		return
+	}
+	q.publish(job)
+
+	if job.State == JobQueued {
+		q.schedule(job.ID, time.Until(job.NextAttempt))
+	}
+}
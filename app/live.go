@@ -0,0 +1,232 @@
+package app
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/utils"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// playableExtensions, playableVideoCodecs and playableAudioCodecs describe
+// the files browsers can play without transcoding.
+var (
+	playableExtensions = map[string]bool{
+		".mp4": true, ".m4v": true, ".webm": true,
+	}
+	playableVideoCodecs = map[string]bool{
+		"h264": true, "vp8": true, "vp9": true, "av1": true,
+	}
+	playableAudioCodecs = map[string]bool{
+		"": true, "aac": true, "mp3": true, "opus": true, "vorbis": true,
+	}
+)
+
+// LiveTranscoder streams videos that aren't browser-playable through ffmpeg
+// as fragmented MP4, keeping a bounded cache of complete transcodes on disk
+// and limiting the number of concurrent transcodes.
+type LiveTranscoder struct {
+	mu       sync.Mutex
+	cfg      *LiveConfig
+	profile  *TranscodeProfile
+	slots    chan struct{}
+	inflight map[string]bool
+}
+
+// newLiveTranscoder returns a new LiveTranscoder for the given Transcoder
+// settings.
+func newLiveTranscoder(cfg *TranscoderConfig) *LiveTranscoder {
+	return &LiveTranscoder{
+		cfg:      cfg.Live,
+		profile:  cfg.Profiles[cfg.Live.Profile],
+		slots:    make(chan struct{}, cfg.Live.MaxConcurrent),
+		inflight: make(map[string]bool),
+	}
+}
+
+// Start creates the cache directory and trims it to the configured size.
+func (lt *LiveTranscoder) Start() error {
+	if err := os.MkdirAll(lt.cfg.CachePath, 0o755); err != nil {
+		return fmt.Errorf("error creating live transcoding cache %s: %w", lt.cfg.CachePath, err)
+	}
+	lt.evict()
+	return nil
+}
+
+// cacheKey identifies a transcode of the video; it changes whenever the
+// source file or the profile does.
+func (lt *LiveTranscoder) cacheKey(m *media.Video) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%s\x00", m.Path, m.Size, m.Timestamp.UTC().Format(time.RFC3339Nano))
+	fmt.Fprint(h, strings.Join(lt.profile.args(), " "))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Playable returns true if browsers can play the video as is. Videos that
+// could not be probed are assumed to be playable.
+func (lt *LiveTranscoder) Playable(m *media.Video) bool {
+	if !playableExtensions[strings.ToLower(filepath.Ext(m.Path))] {
+		return false
+	}
+	if m.VideoCodec == "" {
+		return true
+	}
+	return playableVideoCodecs[m.VideoCodec] && playableAudioCodecs[m.AudioCodec]
+}
+
+// Serve streams the video m transcoded to w, from the cache if a complete
+// transcode is available. It responds with 503 Service Unavailable when
+// the maximum number of concurrent transcodes is reached.
+func (lt *LiveTranscoder) Serve(w http.ResponseWriter, r *http.Request, m *media.Video) {
+	key := lt.cacheKey(m)
+	fn := filepath.Join(lt.cfg.CachePath, key+".mp4")
+	if utils.FileExists(fn) {
+		// Touch the file so that eviction is least recently used first.
+		now := time.Now()
+		if err := os.Chtimes(fn, now, now); err != nil {
+			log.WithError(err).Warn("error updating live transcoding cache entry")
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeFile(w, r, fn)
+		return
+	}
+
+	select {
+	case lt.slots <- struct{}{}:
+		defer func() { <-lt.slots }()
+	default:
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "Too many videos are being transcoded, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Only one of the viewers of a video fills the cache.
+	lt.mu.Lock()
+	caching := !lt.inflight[key]
+	lt.inflight[key] = true
+	lt.mu.Unlock()
+
+	var (
+		out io.Writer = w
+		tf  *os.File
+		err error
+	)
+	if caching {
+		defer func() {
+			lt.mu.Lock()
+			delete(lt.inflight, key)
+			lt.mu.Unlock()
+		}()
+		tf, err = os.CreateTemp(lt.cfg.CachePath, "tube-live-*.tmp")
+		if err != nil {
+			log.WithError(err).Error("error creating live transcoding cache entry")
+			caching = false
+		} else {
+			defer os.Remove(tf.Name())
+			defer tf.Close()
+			out = io.MultiWriter(w, tf)
+		}
+	}
+
+	src, err := m.Location.Source(m.Name)
+	if err != nil {
+		log.WithError(err).WithField("path", m.Path).Error("error locating video for on the fly transcoding")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	args := []string{"-i", src}
+	args = append(args, lt.profile.args()...)
+	args = append(args,
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-f", "mp4",
+		"-loglevel", "quiet",
+		"pipe:1",
+	)
+
+	// The transcode is stopped as soon as the viewer goes away.
+	cmd := exec.CommandContext(r.Context(), "ffmpeg", args...)
+	cmd.Stdout = out
+
+	log.WithField("path", m.Path).WithField("caching", caching).Info("transcoding video on the fly")
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := cmd.Run(); err != nil {
+		log.WithError(err).WithField("path", m.Path).Warn("on the fly transcoding stopped")
+		return
+	}
+
+	if caching {
+		if err := tf.Close(); err != nil {
+			log.WithError(err).Error("error writing live transcoding cache entry")
+			return
+		}
+		if err := os.Rename(tf.Name(), fn); err != nil {
+			log.WithError(err).Error("error renaming live transcoding cache entry")
+			return
+		}
+		lt.evict()
+	}
+}
+
+// evict removes the least recently used transcodes until the cache fits in
+// the configured size.
+func (lt *LiveTranscoder) evict() {
+	files, err := filepath.Glob(filepath.Join(lt.cfg.CachePath, "*.mp4"))
+	if err != nil {
+		return
+	}
+
+	type entry struct {
+		path    string
+		size    int64
+		modtime time.Time
+	}
+	var entries []entry
+	for _, fn := range files {
+		stat, err := os.Stat(fn)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{fn, stat.Size(), stat.ModTime()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modtime.After(entries[j].modtime)
+	})
+
+	var total int64
+	for _, e := range entries {
+		total += e.size
+		if total <= lt.cfg.CacheSize {
+			continue
+		}
+		if err := os.Remove(e.path); err != nil {
+			log.WithError(err).WithField("path", e.path).Warn("error evicting live transcoding cache entry")
+			continue
+		}
+		log.WithField("path", e.path).Debug("evicted live transcoding cache entry")
+	}
+}
+
+// videoContentType returns the MIME type /v/id.mp4 is served with for the
+// video m, without probing it.
+func (a *App) videoContentType(m *media.Video) string {
+	if a.Live != nil && !playableExtensions[strings.ToLower(filepath.Ext(m.Path))] {
+		return "video/mp4"
+	}
+	return media.ContentType(m.Path)
+}
@@ -8,6 +8,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// basicAuthUsername is the username of the HTTP basic auth of
+// OptionallyRequireAdminAuth.
+const basicAuthUsername = "uploader"
+
 // OptionallyRequireAdminAuth wraps a handler requiring HTTP basic auth
 // using "uploader" as the username.
 // If a password isn't set then auth is skipped.
@@ -19,7 +23,7 @@ func OptionallyRequireAdminAuth(handler http.HandlerFunc, password string) http.
 			return
 		}
 
-		username := "uploader"
+		username := basicAuthUsername
 		realm := "Tube uploader"
 
 		// The following line is kind of a work around.
@@ -46,14 +50,21 @@ func OptionallyRequireAdminAuth(handler http.HandlerFunc, password string) http.
 			return
 		}
 
-		handler(w, r)
+		handler(w, WithIdentity(r, &Identity{Username: username, Role: RoleAdmin}))
 	}
 }
 
+// RequireSandstormPermission protects the handler with the Sandstorm
+// permission permissionNeeded, or only a signed in user if empty.
 func RequireSandstormPermission(handler http.HandlerFunc, permissionNeeded string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		
 		// Failed
+		if permissionNeeded == "" && r.Header.Get("X-Sandstorm-User-Id") == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			log.Debugln("No signed in user")
+			return
+		}
 		if !strings.Contains(r.Header.Get("X-Sandstorm-Permissions"), permissionNeeded) {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			log.Debugln("No upload capability granted")
@@ -63,3 +74,36 @@ func RequireSandstormPermission(handler http.HandlerFunc, permissionNeeded strin
 		handler(w, r)
 	}
 }
+
+// BasicAuthenticator returns an Authenticator identifying the requests
+// with the credentials of OptionallyRequireAdminAuth as an admin, so that
+// pages other than those it protects know them too.
+func BasicAuthenticator(password string) Authenticator {
+	return func(r *http.Request) *Identity {
+		user, pass, ok := r.BasicAuth()
+		if password == "" || !ok || subtle.ConstantTimeCompare([]byte(user), []byte(basicAuthUsername)) != 1 || subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			return nil
+		}
+		return &Identity{Username: basicAuthUsername, Role: RoleAdmin}
+	}
+}
+
+// SandstormAuthenticator identifies the requests with the user and the
+// permissions passed by sandstorm-http-bridge: "admin" grants the admin
+// role, "upload" the editor one.
+func SandstormAuthenticator(r *http.Request) *Identity {
+	userID := r.Header.Get("X-Sandstorm-User-Id")
+	if userID == "" {
+		return nil
+	}
+	id := &Identity{Username: userID, Role: RoleViewer}
+	for _, permission := range strings.Split(r.Header.Get("X-Sandstorm-Permissions"), ",") {
+		switch {
+		case permission == "admin":
+			id.Role = RoleAdmin
+		case permission == "upload" && id.Role != RoleAdmin:
+			id.Role = RoleEditor
+		}
+	}
+	return id
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireSandstormPermission(t *testing.T) {
+	tests := []struct {
+		name        string
+		permission  string
+		user        string
+		permissions string
+		status      int
+	}{
+		{"upload", "upload", "user", "upload", http.StatusOK},
+		{"admin and upload", "upload", "user", "admin,upload", http.StatusOK},
+		{"missing permission", "admin", "user", "upload", http.StatusUnauthorized},
+		{"viewer", "", "user", "", http.StatusOK},
+		{"anonymous viewer", "", "", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		handler := RequireSandstormPermission(func(w http.ResponseWriter, r *http.Request) {}, test.permission)
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.user != "" {
+			r.Header.Set("X-Sandstorm-User-Id", test.user)
+		}
+		r.Header.Set("X-Sandstorm-Permissions", test.permissions)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
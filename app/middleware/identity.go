@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Role is the role of a user, granting the permissions of every lower role.
+type Role string
+
+const (
+	// RoleViewer can watch videos.
+	RoleViewer Role = "viewer"
+	// RoleUploader can also upload and import videos.
+	RoleUploader Role = "uploader"
+	// RoleEditor can also edit and delete videos and manage the trash.
+	RoleEditor Role = "editor"
+	// RoleAdmin can also manage users.
+	RoleAdmin Role = "admin"
+)
+
+// Roles are the valid roles, lowest first.
+var Roles = []Role{RoleViewer, RoleUploader, RoleEditor, RoleAdmin}
+
+func (r Role) rank() int {
+	for i, role := range Roles {
+		if r == role {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Valid returns true if r is one of the known Roles.
+func (r Role) Valid() bool {
+	return r.rank() > 0
+}
+
+// Allows returns true if the role r has the permissions of the role other.
+func (r Role) Allows(other Role) bool {
+	return r.Valid() && r.rank() >= other.rank()
+}
+
+// Scopes of the API tokens, named like the Sandstorm permissions granting
+// the same routes.
+const (
+	// ScopeRead allows watching the private videos of the user.
+	ScopeRead = "read"
+	// ScopeUpload allows uploading, editing and deleting videos.
+	ScopeUpload = "upload"
+	// ScopeImport allows importing videos.
+	ScopeImport = "import"
+	// ScopeAdmin allows everything.
+	ScopeAdmin = "admin"
+)
+
+// Scopes are the valid scopes of API tokens.
+var Scopes = []string{ScopeRead, ScopeUpload, ScopeImport, ScopeAdmin}
+
+// Identity is the user a request is made by.
+type Identity struct {
+	Username string
+	Role     Role
+	// Scopes are those of the API token the request was made with, or nil
+	// if it wasn't (e.g: with a login session).
+	Scopes []string
+}
+
+// HasScope returns true if the user may use the scope: always, unless the
+// request was made with an API token lacking it (and the admin scope).
+func (id *Identity) HasScope(scope string) bool {
+	if id.Scopes == nil {
+		return true
+	}
+	for _, s := range id.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+type identityKey struct{}
+
+// WithIdentity returns the request r made by the user id.
+func WithIdentity(r *http.Request, id *Identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id))
+}
+
+// GetIdentity returns the user the request r is made by, or nil if it is
+// anonymous.
+func GetIdentity(r *http.Request) *Identity {
+	id, _ := r.Context().Value(identityKey{}).(*Identity)
+	return id
+}
+
+// Authenticator returns the user a request is made by, or nil if it is
+// anonymous.
+type Authenticator func(r *http.Request) *Identity
+
+// Authenticate returns a middleware setting the identity of requests with
+// the Authenticator auth.
+func Authenticate(auth Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if id := auth(r); id != nil {
+				r = WithIdentity(r, id)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRole wraps a handler requiring a user with (at least) the role
+// role. Anonymous page views (by browsers) are redirected to loginURL,
+// other anonymous requests are unauthorized, and users lacking the role
+// are forbidden.
+func RequireRole(handler http.HandlerFunc, role Role, loginURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// For request needing CORS, send a 204.
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		id := GetIdentity(r)
+		if id == nil {
+			if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, loginURL+"?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			log.Debugln("Anonymous request requiring a login")
+			return
+		}
+
+		if !id.Role.Allows(role) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			log.Debugf("User %s lacks the %s role", id.Username, role)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// RequireScope wraps a handler forbidding the requests made with an API
+// token lacking the scope.
+func RequireScope(handler http.HandlerFunc, scope string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id := GetIdentity(r); id != nil && !id.HasScope(scope) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			log.Debugf("API token of %s lacks the %s scope", id.Username, scope)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// AllowTokens wraps a handler protected by other means (e.g: by
+// OptionallyRequireAdminAuth) letting the requests made with an API token
+// through to scoped instead.
+func AllowTokens(handler, scoped http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id := GetIdentity(r); id != nil && id.Scopes != nil {
+			scoped(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
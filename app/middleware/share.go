@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ShareParam is the query parameter carrying the token of share links.
+const ShareParam = "share"
+
+// ErrInvalidShare is returned for share tokens that are malformed, not
+// signed with the current key or expired.
+var ErrInvalidShare = errors.New("invalid or expired share link")
+
+// Share is the (signed) content of a share link, granting access to a
+// video until it expires.
+type Share struct {
+	ID      string    `json:"id"`
+	Video   string    `json:"video"`
+	Expires time.Time `json:"expires"`
+	// MaxUses is the no. of times the link can be used (0 for unlimited),
+	// and Quality the only quality of the video it grants (if not empty).
+	MaxUses int    `json:"max_uses,omitempty"`
+	Quality string `json:"quality,omitempty"`
+	// Playback is set on the short-lived tokens the page of a link hands
+	// out to its player, which only grant the video and its thumbnail.
+	Playback bool `json:"playback,omitempty"`
+}
+
+// sign returns the HMAC-SHA256 of the payload with the key.
+func sign(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// SignShare returns the token of the share link s, signed with the key.
+func SignShare(key []byte, s *Share) (string, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sign(key, payload)), nil
+}
+
+// ParseShare returns the share link of the token, if it is signed with the
+// key and hasn't expired.
+func ParseShare(key []byte, token string) (*Share, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidShare
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, sign(key, payload)) {
+		return nil, ErrInvalidShare
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidShare
+	}
+	var s Share
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, ErrInvalidShare
+	}
+	if time.Now().After(s.Expires) {
+		return nil, ErrInvalidShare
+	}
+	return &s, nil
+}
+
+type shareKey struct{}
+
+// GetShare returns the share link the request r was made with, or nil.
+func GetShare(r *http.Request) *Share {
+	s, _ := r.Context().Value(shareKey{}).(*Share)
+	return s
+}
+
+// ShareVerifier checks that a (correctly signed) share link is still
+// valid for the request r, e.g: not revoked nor used up.
+type ShareVerifier func(r *http.Request, s *Share) error
+
+// AllowShared wraps a handler granting the requests with a share token
+// (signed with the key returned by key, and accepted by verify) access to
+// the shared video: the handler finds the link with GetShare. Requests
+// with an invalid token are forbidden, and those without one are passed
+// on as is.
+func AllowShared(handler http.HandlerFunc, key func() []byte, verify ShareVerifier) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get(ShareParam)
+		if token == "" {
+			handler(w, r)
+			return
+		}
+
+		s, err := ParseShare(key(), token)
+		if err == nil {
+			err = verify(r, s)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			log.WithError(err).Debugln("Rejected share link")
+			return
+		}
+
+		handler(w, r.WithContext(context.WithValue(r.Context(), shareKey{}, s)))
+	}
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareSigning(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	share := &Share{
+		ID:      "link",
+		Video:   "cats/kitten",
+		Expires: time.Now().Add(time.Hour).Truncate(time.Second).UTC(),
+		MaxUses: 3,
+		Quality: "720p",
+	}
+	token, err := SignShare(key, share)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, _ := strings.Cut(token, ".")
+
+	// forge returns the token of s signed with the key.
+	forge := func(s Share, key []byte) string {
+		token, err := SignShare(key, &s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	expired := *share
+	expired.Expires = time.Now().Add(-time.Second)
+	unlimited := *share
+	unlimited.MaxUses = 0
+	unlimitedPayload, _, _ := strings.Cut(forge(unlimited, []byte("other key")), ".")
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", token, true},
+		{"other key", forge(*share, []byte("other key")), false},
+		{"empty key", forge(*share, nil), false},
+		{"expired", forge(expired, key), false},
+		{"tampered payload", unlimitedPayload + "." + sig, false},
+		{"tampered signature", payload + "." + base64.RawURLEncoding.EncodeToString([]byte("forged")), false},
+		{"truncated signature", payload + "." + sig[:len(sig)-2], false},
+		{"no signature", payload, false},
+		{"empty signature", payload + ".", false},
+		{"invalid base64", payload + ".!!!", false},
+		{"not JSON", "bm90IGpzb24." + base64.RawURLEncoding.EncodeToString(sign(key, "bm90IGpzb24")), false},
+		{"empty", "", false},
+	}
+	for _, test := range tests {
+		s, err := ParseShare(key, test.token)
+		if !test.valid {
+			if !errors.Is(err, ErrInvalidShare) || s != nil {
+				t.Errorf("%s: ParseShare = %+v, %v, want %v", test.name, s, err, ErrInvalidShare)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ParseShare: %s", test.name, err)
+			continue
+		}
+		if *s != *share {
+			t.Errorf("%s: ParseShare = %+v, want %+v", test.name, s, share)
+		}
+	}
+}
+
+func TestAllowShared(t *testing.T) {
+	key := []byte("key")
+	token, err := SignShare(key, &Share{ID: "link", Video: "v", Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := errors.New("share link revoked")
+
+	tests := []struct {
+		name   string
+		query  string
+		verify error
+		status int
+		shared bool
+	}{
+		{"without token", "", nil, http.StatusOK, false},
+		{"valid token", "?share=" + token, nil, http.StatusOK, true},
+		{"rejected by verify", "?share=" + token, revoked, http.StatusForbidden, false},
+		{"invalid token", "?share=" + token + "x", nil, http.StatusForbidden, false},
+	}
+	for _, test := range tests {
+		var shared *Share
+		handler := AllowShared(func(w http.ResponseWriter, r *http.Request) {
+			shared = GetShare(r)
+		}, func() []byte { return key }, func(r *http.Request, s *Share) error {
+			return test.verify
+		})
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, "/v/v"+test.query, nil))
+		if w.Code != test.status || (shared != nil) != test.shared {
+			t.Errorf("%s: status %d with share %+v, want %d and a share: %v", test.name, w.Code, shared, test.status, test.shared)
+		}
+	}
+}
@@ -0,0 +1,600 @@
+package app
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512" // SHA-384 and SHA-512, for RS384/512 and ES384/512
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// oidcCookie is the name of the cookie holding the state of a login
+	// with the identity provider, for oidcLoginTTL.
+	oidcCookie   = "tube_oidc"
+	oidcLoginTTL = 10 * time.Minute
+	// oidcLeeway is the clock skew tolerated validating ID tokens.
+	oidcLeeway = time.Minute
+	// oidcTimeout is the timeout of the requests to the identity provider.
+	oidcTimeout = 10 * time.Second
+)
+
+var (
+	errOIDCState   = errors.New("invalid or expired login state, please log in again")
+	errOIDCToken   = errors.New("invalid ID token")
+	errOIDCNoRole  = errors.New("your account isn't allowed to log in")
+	errOIDCNoKey   = errors.New("unknown ID token signing key")
+	errOIDCIssuer  = errors.New("issuer mismatch")
+	errOIDCExpired = errors.New("ID token expired")
+)
+
+// oidcDiscovery is the (relevant part of the) configuration of an OpenID
+// Connect provider, fetched from its discovery document.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcState is the state of a login with the identity provider, kept in
+// the oidcCookie until the provider redirects back to the callback.
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Next     string `json:"next"`
+}
+
+// OIDC logs users in with an OpenID Connect provider, using the
+// authorization code flow with PKCE.
+type OIDC struct {
+	cfg    *OIDCConfig
+	client *http.Client
+
+	// mu guards the discovery document and keys of the provider, fetched on
+	// first use (and the keys again when it uses an unknown one).
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+// newOIDC returns a new OIDC with the given settings.
+func newOIDC(cfg *OIDCConfig) *OIDC {
+	return &OIDC{cfg: cfg, client: &http.Client{Timeout: oidcTimeout}}
+}
+
+// getJSON decodes the JSON document at u into v.
+func (o *OIDC) getJSON(u string, v interface{}) error {
+	res, err := o.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("error fetching %s: %s", u, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// provider returns the discovery document of the provider.
+func (o *OIDC) provider() (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := o.getJSON(o.cfg.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("error discovering OIDC provider: %w", err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != o.cfg.Issuer {
+		return nil, fmt.Errorf("error discovering OIDC provider: %w %q", errOIDCIssuer, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("error discovering OIDC provider: incomplete discovery document")
+	}
+	o.discovery = &d
+	return o.discovery, nil
+}
+
+// jwk is a JSON Web Key of the provider.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	// N and E are the modulus and exponent of RSA keys, Crv, X and Y the
+	// curve and coordinates of EC ones.
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// decodeInt returns the base64url encoded big-endian integer s.
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey returns the public key k, or nil if its type isn't supported.
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// key returns the signing key kid of the provider, fetching its keys again
+// if it is unknown (e.g: they were rotated).
+func (o *OIDC) key(kid string) (crypto.PublicKey, error) {
+	d, err := o.provider()
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := o.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("error fetching OIDC keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.WithError(err).WithField("kid", k.Kid).Warn("invalid OIDC key")
+			continue
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	o.keys = keys
+	if key, ok := o.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errOIDCNoKey
+}
+
+// verifySignature checks the signature sig of the payload signed with the
+// key using the JWS algorithm alg.
+func verifySignature(alg string, key crypto.PublicKey, payload, sig []byte) error {
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return errOIDCToken
+	}
+	h := hash.New()
+	h.Write(payload)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			return errOIDCToken
+		}
+		return rsa.VerifyPKCS1v15(key, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size {
+			return errOIDCToken
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errOIDCToken
+		}
+		return nil
+	default:
+		return errOIDCToken
+	}
+}
+
+// oidcAudience is the aud claim, either a string or an array of strings.
+type oidcAudience []string
+
+// UnmarshalJSON ...
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = oidcAudience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// oidcClaims are the standard claims of ID tokens checked by tube.
+type oidcClaims struct {
+	Issuer          string       `json:"iss"`
+	Subject         string       `json:"sub"`
+	Audience        oidcAudience `json:"aud"`
+	AuthorizedParty string       `json:"azp"`
+	Expiry          float64      `json:"exp"`
+	IssuedAt        float64      `json:"iat"`
+	Nonce           string       `json:"nonce"`
+}
+
+// verify checks the signature and claims of the ID token, issued for the
+// login with the given nonce, and returns its claims.
+func (o *OIDC) verify(token, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errOIDCToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil || len(header.Alg) != 5 {
+		return nil, errOIDCToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errOIDCToken
+	}
+	key, err := o.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, errOIDCToken
+	}
+
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errOIDCToken
+	}
+	var claims oidcClaims
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, errOIDCToken
+	}
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != o.cfg.Issuer:
+		return nil, errOIDCIssuer
+	case claims.Subject == "":
+		return nil, errOIDCToken
+	case !claims.Audience.contains(o.cfg.ClientID):
+		return nil, fmt.Errorf("%w: audience mismatch", errOIDCToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != o.cfg.ClientID:
+		return nil, fmt.Errorf("%w: authorized party mismatch", errOIDCToken)
+	case now.After(time.Unix(int64(claims.Expiry), 0).Add(oidcLeeway)):
+		return nil, errOIDCExpired
+	case time.Unix(int64(claims.IssuedAt), 0).After(now.Add(oidcLeeway)):
+		return nil, fmt.Errorf("%w: issued in the future", errOIDCToken)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: nonce mismatch", errOIDCToken)
+	}
+
+	var all map[string]interface{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, errOIDCToken
+	}
+	return all, nil
+}
+
+// contains returns true if the audience includes the client id.
+func (a oidcAudience) contains(id string) bool {
+	for _, aud := range a {
+		if aud == id {
+			return true
+		}
+	}
+	return false
+}
+
+// role returns the role granted by the groups of the claims, or "" if the
+// user isn't allowed to log in.
+func (o *OIDC) role(claims map[string]interface{}) middleware.Role {
+	var groups []string
+	switch v := claims[o.cfg.GroupsClaim].(type) {
+	case string:
+		groups = []string{v}
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+
+	role := middleware.Role("")
+	for _, group := range groups {
+		if r, ok := o.cfg.Roles[group]; ok && (role == "" || r.Allows(role)) {
+			role = r
+		}
+	}
+	if role == "" {
+		role = o.cfg.DefaultRole
+	}
+	return role
+}
+
+// redirectURL returns the URL the provider redirects back to after the
+// user logged in, for the request r.
+func (o *OIDC) redirectURL(r *http.Request) string {
+	if o.cfg.RedirectURL != "" {
+		return o.cfg.RedirectURL
+	}
+	scheme := "http"
+	if isSecure(r) {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/login/oidc/callback", scheme, r.Host)
+}
+
+// pkceChallenge returns the S256 code challenge of the PKCE verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL starts a login, returning the URL of the provider to log in at
+// and the state to keep until the callback.
+func (o *OIDC) AuthURL(r *http.Request, next string) (string, *oidcState, error) {
+	d, err := o.provider()
+	if err != nil {
+		return "", nil, err
+	}
+	state := &oidcState{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken() + randomToken(),
+		Next:     next,
+	}
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", o.cfg.ClientID)
+	q.Set("redirect_uri", o.redirectURL(r))
+	q.Set("scope", strings.Join(o.cfg.Scopes, " "))
+	q.Set("state", state.State)
+	q.Set("nonce", state.Nonce)
+	q.Set("code_challenge", pkceChallenge(state.Verifier))
+	q.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), state, nil
+}
+
+// Exchange redeems the authorization code of the callback request r for
+// an ID token, and returns its verified claims.
+func (o *OIDC) Exchange(r *http.Request, code string, state *oidcState) (map[string]interface{}, error) {
+	d, err := o.provider()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.redirectURL(r))
+	form.Set("code_verifier", state.Verifier)
+	form.Set("client_id", o.cfg.ClientID)
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.cfg.ClientID), url.QueryEscape(o.cfg.ClientSecret))
+	}
+
+	res, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error redeeming authorization code: %w", err)
+	}
+	defer res.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("error redeeming authorization code: %s", res.Status)
+	}
+	if tokens.Error != "" {
+		return nil, fmt.Errorf("error redeeming authorization code: %s %s", tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("error redeeming authorization code: no ID token")
+	}
+	return o.verify(tokens.IDToken, state.Nonce)
+}
+
+// setOIDCCookie sets (or with a nil state, clears) the cookie holding the
+// state of a login.
+func setOIDCCookie(w http.ResponseWriter, r *http.Request, state *oidcState) {
+	cookie := &http.Cookie{
+		Name:     oidcCookie,
+		Path:     "/login/oidc",
+		HttpOnly: true,
+		Secure:   isSecure(r),
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   -1,
+	}
+	if state != nil {
+		data, _ := json.Marshal(state)
+		cookie.Value = base64.RawURLEncoding.EncodeToString(data)
+		cookie.MaxAge = int(oidcLoginTTL.Seconds())
+	}
+	http.SetCookie(w, cookie)
+}
+
+// getOIDCCookie returns the state of the login of the callback request r,
+// if it matches the one returned by the provider.
+func getOIDCCookie(r *http.Request) (*oidcState, error) {
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		return nil, errOIDCState
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil {
+		return nil, errOIDCState
+	}
+	var state oidcState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errOIDCState
+	}
+	if state.State == "" || subtle.ConstantTimeCompare([]byte(state.State), []byte(r.URL.Query().Get("state"))) != 1 {
+		return nil, errOIDCState
+	}
+	return &state, nil
+}
+
+// HTTP handler for /login/oidc
+// Redirects to the identity provider to log in.
+func (a *App) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	u, state, err := a.OIDC.AuthURL(r, safeRedirect(r.FormValue("next")))
+	if err != nil {
+		log.WithError(err).Error("error starting OIDC login")
+		a.renderLogin(w, r, http.StatusBadGateway, "the identity provider is unavailable")
+		return
+	}
+	setOIDCCookie(w, r, state)
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// oidcUsername returns the username of the account of a user whose
+// username_claim is claim: in lower case, the local part only of email
+// addresses, and with the characters usernames can't have replaced by '-'.
+func oidcUsername(claim string) string {
+	name := strings.ToLower(claim)
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '-'
+	}, name)
+	name = strings.TrimLeft(name, "._-")
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+// HTTP handler for /login/oidc/callback
+// Logs in the user the identity provider redirected back, creating their
+// account on their first login.
+func (a *App) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	state, err := getOIDCCookie(r)
+	setOIDCCookie(w, r, nil)
+	if err != nil {
+		a.renderLogin(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		log.WithField("error", e).WithField("description", r.URL.Query().Get("error_description")).Warn("OIDC login failed")
+		a.renderLogin(w, r, http.StatusUnauthorized, "login failed: "+e)
+		return
+	}
+
+	claims, err := a.OIDC.Exchange(r, r.URL.Query().Get("code"), state)
+	if err != nil {
+		log.WithError(err).Warn("OIDC login failed")
+		a.renderLogin(w, r, http.StatusUnauthorized, "login failed")
+		return
+	}
+
+	subject, _ := claims["sub"].(string)
+	claim, _ := claims[a.OIDC.cfg.UsernameClaim].(string)
+	username := oidcUsername(claim)
+	role := a.OIDC.role(claims)
+	if role == "" {
+		log.WithField("user", username).Warn("OIDC user without role")
+		a.renderLogin(w, r, http.StatusForbidden, errOIDCNoRole.Error())
+		return
+	}
+
+	token, session, err := a.Users.LoginExternal(username, subject, role)
+	if err != nil {
+		status := userErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.WithError(err).Error("error logging in")
+		} else {
+			log.WithError(err).WithField("user", username).WithField(a.OIDC.cfg.UsernameClaim, claim).Warn("OIDC login refused")
+		}
+		if errors.Is(err, errInvalidName) {
+			err = fmt.Errorf("%w (from the %s claim %q)", err, a.OIDC.cfg.UsernameClaim, claim)
+		}
+		a.renderLogin(w, r, status, err.Error())
+		return
+	}
+	setSessionCookie(w, r, token, session.Expires)
+	http.Redirect(w, r, state.Next, http.StatusSeeOther)
+}
@@ -0,0 +1,481 @@
+package app
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+)
+
+// newTestStore returns a Store in a temporary directory.
+func newTestStore(t *testing.T) Store {
+	t.Helper()
+	store, err := NewBitcaskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// fakeIdP is an OpenID Connect provider serving its discovery document,
+// its keys and a token endpoint, which redeems the code it was given for
+// an ID token made by its idToken func.
+type fakeIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	// code, challenge and nonce are those of the pending login.
+	code      string
+	challenge string
+	nonce     string
+	idToken   func(claims map[string]interface{}) string
+	jwksCalls int
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		idp.jwksCalls++
+		idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "k1",
+				"kty": "RSA",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// authorize plays the part of the user logging in at the authorization
+// endpoint of the URL u, returning the code to redeem.
+func (idp *fakeIdP) authorize(t *testing.T, u string) (code, state string) {
+	t.Helper()
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := parsed.Query()
+	if parsed.Path != "/authorize" || q.Get("response_type") != "code" || q.Get("client_id") != "tube" ||
+		q.Get("code_challenge_method") != "S256" || !strings.Contains(q.Get("scope"), "openid") {
+		t.Fatalf("unexpected authorization URL %s", u)
+	}
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.code = randomToken()
+	idp.challenge = q.Get("code_challenge")
+	idp.nonce = q.Get("nonce")
+	return idp.code, q.Get("state")
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	user, pass, _ := r.BasicAuth()
+	switch {
+	case r.FormValue("grant_type") != "authorization_code", r.FormValue("code") != idp.code:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	case pkceChallenge(r.FormValue("code_verifier")) != idp.challenge:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE"})
+		return
+	case user != "tube" || pass != "secret":
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+	idp.code = ""
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"iss":                idp.URL,
+		"sub":                "subject-1",
+		"aud":                "tube",
+		"exp":                now + 300,
+		"iat":                now,
+		"nonce":              idp.nonce,
+		"preferred_username": "Alice",
+		"groups":             []string{"staff", "video-editors"},
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idp.idToken(claims)})
+}
+
+// jwt returns the JWT of the header and claims, signed with sign.
+func jwt(header, claims map[string]interface{}, sign func(payload []byte) []byte) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	payload := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(payload)))
+}
+
+// signRS256 returns a func signing payloads with the key, using RS256.
+func signRS256(key *rsa.PrivateKey) func([]byte) []byte {
+	return func(payload []byte) []byte {
+		digest := sha256.Sum256(payload)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			panic(err)
+		}
+		return sig
+	}
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := newFakeIdP(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "k1"}
+
+	tests := []struct {
+		name    string
+		idToken func(claims map[string]interface{}) string
+		err     error
+	}{
+		{
+			name: "valid",
+			idToken: func(claims map[string]interface{}) string {
+				return jwt(rs256, claims, signRS256(idp.key))
+			},
+		},
+		{
+			name: "several audiences",
+			idToken: func(claims map[string]interface{}) string {
+				claims["aud"] = []string{"other", "tube"}
+				claims["azp"] = "tube"
+				return jwt(rs256, claims, signRS256(idp.key))
+			},
+		},
+		{
+			name: "wrong audience",
+			idToken: func(claims map[string]interface{}) string {
+				claims["aud"] = "other"
+				return jwt(rs256, claims, signRS256(idp.key))
+			},
+			err: errOIDCToken,
+		},
+		{
+			name: "wrong authorized party",
+			idToken: func(claims map[string]interface{}) string {
+				claims["aud"] = []string{"other", "tube"}
+				claims["azp"] = "other"
+				return jwt(rs256, claims, signRS256(idp.key))
+			},
+			err: errOIDCToken,
+		},
+		{
+			name: "wrong issuer",
+			idToken: func(claims map[string]interface{}) string {
+				claims["iss"] = "https://evil.example.com"
+				return jwt(rs256, claims, signRS256(idp.key))
+			},
+			err: errOIDCIssuer,
+		},
+		{
+			name: "wrong nonce",
+			idToken: func(claims map[string]interface{}) string {
+				claims["nonce"] = "replayed"
+				return jwt(rs256, claims, signRS256(idp.key))
+			},
+			err: errOIDCToken,
+		},
+		{
+			name: "expired",
+			idToken: func(claims map[string]interface{}) string {
+				claims["iat"] = time.Now().Add(-time.Hour).Unix()
+				claims["exp"] = time.Now().Add(-2 * oidcLeeway).Unix()
+				return jwt(rs256, claims, signRS256(idp.key))
+			},
+			err: errOIDCExpired,
+		},
+		{
+			name: "expired within leeway",
+			idToken: func(claims map[string]interface{}) string {
+				claims["exp"] = time.Now().Add(-oidcLeeway / 2).Unix()
+				return jwt(rs256, claims, signRS256(idp.key))
+			},
+		},
+		{
+			name: "issued in the future",
+			idToken: func(claims map[string]interface{}) string {
+				claims["iat"] = time.Now().Add(time.Hour).Unix()
+				return jwt(rs256, claims, signRS256(idp.key))
+			},
+			err: errOIDCToken,
+		},
+		{
+			name: "alg none",
+			idToken: func(claims map[string]interface{}) string {
+				return jwt(map[string]interface{}{"alg": "none", "kid": "k1"}, claims, func([]byte) []byte { return nil })
+			},
+			err: errOIDCToken,
+		},
+		{
+			name: "alg HS256 with the public key",
+			idToken: func(claims map[string]interface{}) string {
+				secret := []byte(base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()))
+				return jwt(map[string]interface{}{"alg": "HS256", "kid": "k1"}, claims, func(payload []byte) []byte {
+					mac := hmac.New(sha256.New, secret)
+					mac.Write(payload)
+					return mac.Sum(nil)
+				})
+			},
+			err: errOIDCToken,
+		},
+		{
+			name: "unknown kid",
+			idToken: func(claims map[string]interface{}) string {
+				return jwt(map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims, signRS256(otherKey))
+			},
+			err: errOIDCNoKey,
+		},
+		{
+			name: "bad signature",
+			idToken: func(claims map[string]interface{}) string {
+				return jwt(rs256, claims, signRS256(otherKey))
+			},
+			err: errOIDCToken,
+		},
+		{
+			name: "tampered claims",
+			idToken: func(claims map[string]interface{}) string {
+				token := jwt(rs256, claims, signRS256(idp.key))
+				parts := strings.Split(token, ".")
+				claims["preferred_username"] = "admin"
+				c, _ := json.Marshal(claims)
+				return parts[0] + "." + base64.RawURLEncoding.EncodeToString(c) + "." + parts[2]
+			},
+			err: errOIDCToken,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := newOIDC(&OIDCConfig{
+				Issuer:        idp.URL,
+				ClientID:      "tube",
+				ClientSecret:  "secret",
+				Scopes:        []string{"openid"},
+				UsernameClaim: "preferred_username",
+				GroupsClaim:   "groups",
+			})
+			idp.idToken = test.idToken
+			r := httptest.NewRequest(http.MethodGet, "http://tube.example.com/login/oidc", nil)
+			u, state, err := o.AuthURL(r, "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, _ := idp.authorize(t, u)
+
+			claims, err := o.Exchange(r, code, state)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("Exchange error = %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Exchange: %s", err)
+			}
+			if claims["sub"] != "subject-1" || claims["preferred_username"] != "Alice" {
+				t.Errorf("claims = %v", claims)
+			}
+		})
+	}
+
+	if idp.jwksCalls < 2 {
+		t.Errorf("keys were fetched %d times, want them fetched again for an unknown kid", idp.jwksCalls)
+	}
+}
+
+func TestOIDCExchangeWrongVerifier(t *testing.T) {
+	idp := newFakeIdP(t)
+	idp.idToken = func(claims map[string]interface{}) string {
+		return jwt(map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims, signRS256(idp.key))
+	}
+	o := newOIDC(&OIDCConfig{Issuer: idp.URL, ClientID: "tube", ClientSecret: "secret", Scopes: []string{"openid"}})
+	r := httptest.NewRequest(http.MethodGet, "http://tube.example.com/login/oidc", nil)
+	u, state, err := o.AuthURL(r, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := idp.authorize(t, u)
+	state.Verifier = "intercepted"
+	if _, err := o.Exchange(r, code, state); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("Exchange error = %v, want invalid_grant", err)
+	}
+}
+
+func TestOIDCUsername(t *testing.T) {
+	tests := []struct {
+		claim, want string
+	}{
+		{"alice", "alice"},
+		{"Alice", "alice"},
+		{"alice.smith@example.com", "alice.smith"},
+		{"alice+tube@example.com", "alice-tube"},
+		{"Jean Dupont", "jean-dupont"},
+		{"_alice", "alice"},
+		{"@example.com", ""},
+		{strings.Repeat("a", 40), strings.Repeat("a", 32)},
+	}
+	for _, test := range tests {
+		if got := oidcUsername(test.claim); got != test.want {
+			t.Errorf("oidcUsername(%q) = %q, want %q", test.claim, got, test.want)
+		}
+	}
+}
+
+func TestOIDCRole(t *testing.T) {
+	o := newOIDC(&OIDCConfig{
+		GroupsClaim: "groups",
+		Roles: map[string]middleware.Role{
+			"staff":         middleware.RoleViewer,
+			"video-editors": middleware.RoleEditor,
+			"uploaders":     middleware.RoleUploader,
+		},
+	})
+	tests := []struct {
+		groups      interface{}
+		defaultRole middleware.Role
+		want        middleware.Role
+	}{
+		{[]interface{}{"staff", "video-editors", "uploaders"}, "", middleware.RoleEditor},
+		{"uploaders", "", middleware.RoleUploader},
+		{[]interface{}{"unknown"}, "", ""},
+		{[]interface{}{"unknown"}, middleware.RoleViewer, middleware.RoleViewer},
+		{nil, "", ""},
+	}
+	for _, test := range tests {
+		o.cfg.DefaultRole = test.defaultRole
+		if got := o.role(map[string]interface{}{"groups": test.groups}); got != test.want {
+			t.Errorf("role(%v) with default %q = %q, want %q", test.groups, test.defaultRole, got, test.want)
+		}
+	}
+}
+
+// TestOIDCLogin logs in through the login and callback handlers.
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeIdP(t)
+	username := "Alice"
+	idp.idToken = func(claims map[string]interface{}) string {
+		claims["preferred_username"] = username
+		return jwt(map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims, signRS256(idp.key))
+	}
+	cfg := &AuthConfig{Mode: authModeUsers, SessionTTL: 1}
+	a := &App{
+		Config: &Config{Auth: cfg},
+		Users:  newUsers(cfg, newTestStore(t)),
+		OIDC: newOIDC(&OIDCConfig{
+			Issuer:        idp.URL,
+			ClientID:      "tube",
+			ClientSecret:  "secret",
+			Scopes:        []string{"openid"},
+			UsernameClaim: "preferred_username",
+			GroupsClaim:   "groups",
+			Roles:         map[string]middleware.Role{"video-editors": middleware.RoleEditor},
+		}),
+		Templates: newTemplateStore("base"),
+	}
+	a.Templates.Add("login", template.Must(template.New("base").Parse("{{ .Message }}")))
+
+	// login returns the response of the callback of a login.
+	login := func(t *testing.T) *http.Response {
+		w := httptest.NewRecorder()
+		a.oidcLoginHandler(w, httptest.NewRequest(http.MethodGet, "http://tube.example.com/login/oidc?next=/upload", nil))
+		res := w.Result()
+		if res.StatusCode != http.StatusFound {
+			t.Fatalf("login status = %s, want 302", res.Status)
+		}
+		code, state := idp.authorize(t, res.Header.Get("Location"))
+
+		r := httptest.NewRequest(http.MethodGet, "http://tube.example.com/login/oidc/callback?"+
+			url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+		for _, cookie := range res.Cookies() {
+			r.AddCookie(cookie)
+		}
+		w = httptest.NewRecorder()
+		a.oidcCallbackHandler(w, r)
+		return w.Result()
+	}
+
+	res := login(t)
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/upload" {
+		t.Fatalf("callback = %s to %q, want 303 to /upload", res.Status, res.Header.Get("Location"))
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == sessionCookie {
+			r.AddCookie(cookie)
+		}
+	}
+	id := a.Users.Identify(r)
+	if id == nil || id.Username != "alice" || id.Role != middleware.RoleEditor {
+		t.Fatalf("Identify = %+v, want alice the editor", id)
+	}
+
+	// a forged state is refused before the code is redeemed
+	data, _ := json.Marshal(&oidcState{State: "other"})
+	r = httptest.NewRequest(http.MethodGet, "http://tube.example.com/login/oidc/callback?code=x&state=forged", nil)
+	r.AddCookie(&http.Cookie{Name: oidcCookie, Value: base64.RawURLEncoding.EncodeToString(data)})
+	if _, err := getOIDCCookie(r); !errors.Is(err, errOIDCState) {
+		t.Errorf("getOIDCCookie error = %v, want %v", err, errOIDCState)
+	}
+
+	// email addresses log in with their local part
+	username = "Alice@Example.com"
+	if res := login(t); res.StatusCode != http.StatusSeeOther {
+		t.Errorf("callback with an email address = %s, want 303", res.Status)
+	}
+	if users, err := a.Users.List(); err != nil || len(users) != 1 || users[0].Username != "alice" {
+		t.Errorf("List = %v, %v, want alice only", users, err)
+	}
+
+	// claims without a valid username are refused with the claim
+	username = "@example.com"
+	res = login(t)
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "preferred_username") {
+		t.Errorf("callback without a username = %s, %q, want 400 naming the claim", res.Status, body)
+	}
+}
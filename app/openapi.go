@@ -0,0 +1,253 @@
+package app
+
+import (
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.mills.io/prologic/tube/media"
+)
+
+// muxVar matches the variables of the paths of mux routes with a pattern,
+// e.g: {id:.+}.
+var muxVar = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// typeEnums are the values of the string types of the JSON API.
+var typeEnums = map[reflect.Type][]string{
+	reflect.TypeOf(JobKind("")):  {string(JobUpload), string(JobImport)},
+	reflect.TypeOf(JobState("")): {string(JobQueued), string(JobRunning), string(JobFailed), string(JobDone)},
+	reflect.TypeOf(media.Visibility("")): {
+		string(media.Public), string(media.Unlisted), string(media.Private),
+	},
+}
+
+// schemaName returns the name of the schema of the struct type t, without
+// the api prefix of the types of the JSON API (e.g: Video for apiVideo).
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	if strings.HasPrefix(name, "api") {
+		return strings.ToUpper(name[3:4]) + name[4:]
+	}
+	return name
+}
+
+// schemaOf returns the JSON schema of the values of type t, adding those of
+// the named structs to schemas, and referencing them.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := schemaName(t)
+		if name == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[name]; !ok {
+			// added before its fields, for recursive types
+			schemas[name] = nil
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		s := map[string]interface{}{"type": "string"}
+		if enum, ok := typeEnums[t]; ok {
+			s["enum"] = enum
+		}
+		return s
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema returns the JSON schema of the struct type t, described by
+// the json tags of its fields, and their doc, format and enum tags.
+// Fields without omitempty are required.
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+
+		s := schemaOf(f.Type, schemas)
+		if _, ref := s["$ref"]; !ref {
+			if doc := f.Tag.Get("doc"); doc != "" {
+				s["description"] = doc
+			}
+			if format := f.Tag.Get("format"); format != "" {
+				s["format"] = format
+			}
+			if enum := f.Tag.Get("enum"); enum != "" {
+				s["enum"] = strings.Split(enum, ",")
+			}
+		}
+		properties[name] = s
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+
+	s := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// jsonContent returns the content of a request or response body of the
+// given type.
+func jsonContent(contentType string, v interface{}, schemas map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		contentType: map[string]interface{}{"schema": schemaOf(reflect.TypeOf(v), schemas)},
+	}
+}
+
+// openAPI returns the OpenAPI document describing the routes of the JSON
+// API, and how to authenticate with the auth mode in use.
+func (a *App) openAPI() map[string]interface{} {
+	schemas := make(map[string]interface{})
+	security := make(map[string]interface{})
+	if os.Getenv("SANDSTORM") != "1" && a.Config.Auth.Mode != authModeNone {
+		security["bearerAuth"] = map[string]interface{}{
+			"type":        "http",
+			"scheme":      "bearer",
+			"description": "API token created at /tokens",
+		}
+	}
+	switch {
+	case os.Getenv("SANDSTORM") == "1":
+		// authenticated by sandstorm-http-bridge
+	case a.Config.Auth.Mode == authModeNone:
+		// every route is open
+	case a.Users != nil:
+		security["cookieAuth"] = map[string]interface{}{
+			"type": "apiKey",
+			"in":   "cookie",
+			"name": sessionCookie,
+		}
+	default:
+		security["basicAuth"] = map[string]interface{}{
+			"type":        "http",
+			"scheme":      "basic",
+			"description": "the admin credentials of the auth_password",
+		}
+	}
+	names := make([]string, 0, len(security))
+	for name := range security {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var requirements []map[string][]string
+	for _, name := range names {
+		requirements = append(requirements, map[string][]string{name: {}})
+	}
+
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content":     jsonContent("application/json", apiError{}, schemas),
+	}
+	paths := make(map[string]map[string]interface{})
+	for _, route := range a.apiRoutes() {
+		op := map[string]interface{}{
+			"operationId": route.ID,
+			"summary":     route.Summary,
+			"tags":        []string{route.Tag},
+		}
+
+		var params []map[string]interface{}
+		for _, p := range route.Params {
+			param := map[string]interface{}{
+				"name":     p.Name,
+				"in":       p.In,
+				"required": p.Required,
+				"schema":   map[string]interface{}{"type": p.Type},
+			}
+			if p.Description != "" {
+				param["description"] = p.Description
+			}
+			params = append(params, param)
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if route.Body != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  jsonContent(route.ContentType, route.Body, schemas),
+			}
+		}
+
+		response := map[string]interface{}{"description": http.StatusText(route.Status)}
+		if route.Response != nil {
+			response["content"] = jsonContent("application/json", route.Response, schemas)
+		}
+		op["responses"] = map[string]interface{}{
+			strconv.Itoa(route.Status): response,
+			"default":                  errorResponse,
+		}
+
+		if route.Role != "" {
+			op["description"] = "Requires the " + string(route.Role) + " role, and the " +
+				route.Scope + " scope for API tokens."
+			if requirements != nil {
+				op["security"] = requirements
+			}
+		}
+
+		path := muxVar.ReplaceAllString(route.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(route.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Tube API",
+			"version": "1",
+		},
+		"servers": []map[string]interface{}{{"url": apiPrefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas":         schemas,
+			"securitySchemes": security,
+		},
+	}
+}
+
+// HTTP handler for GET /api/v1/openapi.json
+func (a *App) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, a.openAPI())
+}
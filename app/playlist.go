@@ -0,0 +1,164 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+	"git.mills.io/prologic/tube/media"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// playlistPageSize is the no. of videos of the playlist rendered with a
+	// page, and the default page size of the playlist API.
+	playlistPageSize = 50
+	// maxPlaylistPageSize is the maximum page size of the playlist API.
+	maxPlaylistPageSize = 500
+)
+
+// apiVideo is a video as returned by the JSON APIs (e.g: search), with
+// every field of media.Video but those locating its files on the server.
+type apiVideo struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Album       string    `json:"album,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Tags        []string  `json:"tags,omitempty"`
+	Category    string    `json:"category,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Visibility  string    `json:"visibility" enum:"public,unlisted,private"`
+	Library     string    `json:"library" doc:"prefix of the collection of the video"`
+	File        string    `json:"file" doc:"name of the file of the video in its collection"`
+	Size        int64     `json:"size" doc:"size of the video file in bytes"`
+	Duration    float64   `json:"duration,omitempty" doc:"duration in seconds"`
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	VideoCodec  string    `json:"video_codec,omitempty"`
+	AudioCodec  string    `json:"audio_codec,omitempty"`
+	Bitrate     int64     `json:"bitrate,omitempty" doc:"bitrate in bits per second"`
+	FrameRate   float64   `json:"frame_rate,omitempty"`
+	Timestamp   time.Time `json:"timestamp"`
+	Modified    string    `json:"modified"`
+	Views       int64     `json:"views"`
+	URL         string    `json:"url"`
+	Thumbnail   string    `json:"thumbnail"`
+}
+
+func newAPIVideo(v *media.Video) *apiVideo {
+	return &apiVideo{
+		ID:          v.ID,
+		Title:       v.Title,
+		Album:       v.Album,
+		Description: v.Description,
+		Tags:        v.Tags,
+		Category:    v.Category,
+		Owner:       v.Owner,
+		Visibility:  string(v.Visibility),
+		Library:     v.Location.Prefix,
+		File:        v.Name,
+		Size:        v.Size,
+		Duration:    v.Duration.Seconds(),
+		Width:       v.Width,
+		Height:      v.Height,
+		VideoCodec:  v.VideoCodec,
+		AudioCodec:  v.AudioCodec,
+		Bitrate:     v.Bitrate,
+		FrameRate:   v.FrameRate,
+		Timestamp:   v.Timestamp,
+		Modified:    v.Modified,
+		Views:       v.Views,
+		URL:         fmt.Sprintf("/v/%s", v.ID),
+		Thumbnail:   fmt.Sprintf("/t/%s", v.ID),
+	}
+}
+
+// loadViews sets the views of the videos of the playlist pl.
+func (a *App) loadViews(pl media.Playlist) {
+	a.Views.Load(pl)
+}
+
+// sortKey returns the key the playlist is sorted by for the sort criteria
+// sort, defaulting to the Timestamp.
+func sortKey(sort string) media.Key {
+	switch sort {
+	case "views":
+		return media.ViewsKey
+	case "duration":
+		return media.DurationKey
+	case "", "timestamp":
+	default:
+		log.Warnf("invalid sort critiera: %s", sort)
+	}
+	return media.TimestampKey
+}
+
+// playlistPage returns the page of up to n videos of the (filtered and
+// sorted) playlist listed to the viewer following the cursor after (if not empty), with their
+// views, and the cursor of the next page (empty if it is the last one).
+// Sorting by views requires the views of every video; otherwise only those
+// of the page are read.
+func (a *App) playlistPage(viewer *middleware.Identity, filter playlistFilter, sort, after string, n int) (media.Playlist, string, error) {
+	var cursor *media.Cursor
+	if after != "" {
+		var err error
+		if cursor, err = media.ParseCursor(after); err != nil {
+			return nil, "", err
+		}
+	}
+
+	pl := listed(viewer, filter.Apply(a.Library.Playlist()))
+	if sort == "views" {
+		a.loadViews(pl)
+	}
+	key := sortKey(sort)
+	pl.SortBy(key)
+	page, next := pl.Page(key, cursor, n)
+	if sort != "views" {
+		a.loadViews(page)
+	}
+	if next == nil {
+		return page, "", nil
+	}
+	return page, next.String(), nil
+}
+
+// HTTP handler for /playlist
+// Responds with a page of the playlist (filtered by tag and collection, and
+// sorted like the video pages) and the cursor of the next one as JSON, for
+// infinite scrolling.
+func (a *App) playlistHandler(w http.ResponseWriter, r *http.Request) {
+	n := playlistPageSize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 || n > maxPlaylistPageSize {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxPlaylistPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sort := strings.ToLower(r.URL.Query().Get("sort"))
+	page, next, err := a.playlistPage(middleware.GetIdentity(r), parseFilter(r), sort, r.URL.Query().Get("after"), n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	videos := make([]*apiVideo, len(page))
+	for i, v := range page {
+		videos[i] = newAPIVideo(v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(&struct {
+		Videos []*apiVideo `json:"videos"`
+		Next   string      `json:"next,omitempty"`
+	}{videos, next}); err != nil {
+		log.WithError(err).Error("error encoding playlist")
+	}
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"git.mills.io/prologic/tube/app/middleware"
+	"git.mills.io/prologic/tube/media"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// wantsJSON returns true if the client asked for a JSON response, with the
+// Accept header or format=json.
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" ||
+		strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// HTTP handler for /search
+// Renders the videos matching the query q (restricted to the library path
+// with the given prefix, if any) as a page or as JSON.
+func (a *App) searchHandler(w http.ResponseWriter, r *http.Request) {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	prefix := strings.Trim(r.URL.Query().Get("prefix"), "/")
+	log.Printf("/search?q=%s", q)
+
+	var prefixes []string
+	known := prefix == ""
+	for _, pc := range a.Config.Library {
+		if pc.Prefix != "" {
+			prefixes = append(prefixes, pc.Prefix)
+			known = known || pc.Prefix == prefix
+		}
+	}
+	if !known {
+		http.Error(w, fmt.Sprintf("unknown library prefix %q", prefix), http.StatusBadRequest)
+		return
+	}
+
+	results := listed(middleware.GetIdentity(r), a.Library.Search(q, prefix))
+	a.loadViews(results)
+
+	if wantsJSON(r) {
+		res := make([]*apiVideo, len(results))
+		for i, v := range results {
+			res[i] = newAPIVideo(v)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-cache")
+		if err := json.NewEncoder(w).Encode(&struct {
+			Query   string      `json:"query"`
+			Prefix  string      `json:"prefix,omitempty"`
+			Results []*apiVideo `json:"results"`
+		}{q, prefix, res}); err != nil {
+			log.WithError(err).Error("error encoding search results")
+		}
+		return
+	}
+
+	ctx := &struct {
+		Config   *Config
+		Playing  *media.Video
+		Query    string
+		Prefix   string
+		Prefixes []string
+		Results  media.Playlist
+	}{
+		Config:   a.Config,
+		Playing:  &media.Video{ID: ""},
+		Query:    q,
+		Prefix:   prefix,
+		Prefixes: prefixes,
+		Results:  results,
+	}
+	a.render("search", w, ctx)
+}
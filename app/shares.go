@@ -0,0 +1,561 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+	"git.mills.io/prologic/tube/media"
+
+	"github.com/gorilla/mux"
+	shortuuid "github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// shareKeySize is the size of the key share links are signed with.
+	shareKeySize = 32
+	// defaultShareTTL and maxShareTTL are the default and maximum validity of
+	// share links, in hours.
+	defaultShareTTL = 24
+	maxShareTTL     = 365 * 24
+	// sharePurgeInterval is how often expired share links are purged.
+	sharePurgeInterval = time.Hour
+	// sharePlaybackTTL is the validity of the playback tokens handed out
+	// by the pages of share links.
+	sharePlaybackTTL = 4 * time.Hour
+)
+
+var (
+	errShareRevoked  = errors.New("share link revoked")
+	errShareUsedUp   = errors.New("share link used up")
+	errShareUnopened = errors.New("share link not opened yet")
+	errSharePlayback = errors.New("share link playback token only grants the video")
+	errShareStream   = errors.New("share link streams need a playback token")
+	errShareNotFound = errors.New("share link not found")
+	errShareTTL      = fmt.Errorf("expiry must be 1-%d hours", maxShareTTL)
+	errShareMaxUses  = errors.New("max uses must be 0 (unlimited) or more")
+	errShareQuality  = errors.New("invalid quality")
+)
+
+// ShareLink is the record of a share link, counting its uses. Deleting it
+// revokes the link.
+type ShareLink struct {
+	middleware.Share
+	Uses    int       `json:"uses"`
+	Creator string    `json:"creator,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Shares manages the share links granting access to videos without an
+// account, and the key they are signed with.
+type Shares struct {
+	store Store
+
+	// mu guards the key and serializes the counting of uses.
+	mu  sync.Mutex
+	key []byte
+}
+
+// newShares returns a new Shares keeping its links in the store.
+func newShares(store Store) *Shares {
+	return &Shares{store: store}
+}
+
+// Start loads (or creates) the signing key, and periodically purges expired
+// links.
+func (s *Shares) Start() error {
+	key, err := s.store.GetShareKey()
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		if key, err = newShareKey(); err != nil {
+			return err
+		}
+		if err := s.store.PutShareKey(key); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.key = key
+	s.mu.Unlock()
+
+	s.purge()
+	go func() {
+		for range time.Tick(sharePurgeInterval) {
+			s.purge()
+		}
+	}()
+	return nil
+}
+
+// newShareKey returns a new random signing key.
+func newShareKey() ([]byte, error) {
+	key := make([]byte, shareKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("error generating share key: %w", err)
+	}
+	return key, nil
+}
+
+// purge removes the expired links.
+func (s *Shares) purge() {
+	links, err := s.store.ListShareLinks()
+	if err != nil {
+		log.WithError(err).Error("error listing share links")
+		return
+	}
+	for _, link := range links {
+		if time.Now().After(link.Expires) {
+			if err := s.store.DeleteShareLink(link.ID); err != nil {
+				log.WithError(err).Warn("error purging expired share link")
+			}
+		}
+	}
+}
+
+// Key returns the key share links are currently signed with.
+func (s *Shares) Key() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.key
+}
+
+// Token returns the token of the link, signed with the current key.
+func (s *Shares) Token(link *ShareLink) (string, error) {
+	return middleware.SignShare(s.Key(), &link.Share)
+}
+
+// PlaybackToken returns a playback token of the (opened) link share, for
+// streaming its video without counting uses. It expires after
+// sharePlaybackTTL, or with the link.
+func (s *Shares) PlaybackToken(share *middleware.Share) (string, error) {
+	playback := *share
+	playback.Playback = true
+	if expires := time.Now().Add(sharePlaybackTTL).Truncate(time.Second); expires.Before(share.Expires) {
+		playback.Expires = expires
+	}
+	return middleware.SignShare(s.Key(), &playback)
+}
+
+// List returns the unexpired links (only those created by creator, unless
+// empty), optionally of the video only, newest first.
+func (s *Shares) List(video, creator string) ([]*ShareLink, error) {
+	links, err := s.store.ListShareLinks()
+	if err != nil {
+		return nil, err
+	}
+	res := []*ShareLink{}
+	for _, link := range links {
+		if (video != "" && link.Video != video) || (creator != "" && link.Creator != creator) {
+			continue
+		}
+		if time.Now().After(link.Expires) {
+			continue
+		}
+		res = append(res, link)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.After(res[j].Created) })
+	return res, nil
+}
+
+// Get returns the link id.
+func (s *Shares) Get(id string) (*ShareLink, error) {
+	link, err := s.store.GetShareLink(id)
+	if err != nil {
+		return nil, err
+	}
+	if link == nil {
+		return nil, errShareNotFound
+	}
+	return link, nil
+}
+
+// Create adds a link to the video valid for ttl hours and maxUses uses (0
+// for unlimited), restricted to the given quality unless empty.
+func (s *Shares) Create(video, creator string, ttl, maxUses int, quality string) (*ShareLink, error) {
+	now := time.Now()
+	link := &ShareLink{
+		Share: middleware.Share{
+			ID:      shortuuid.New(),
+			Video:   video,
+			Expires: now.Add(time.Duration(ttl) * time.Hour).Truncate(time.Second),
+			MaxUses: maxUses,
+			Quality: quality,
+		},
+		Creator: creator,
+		Created: now,
+	}
+	if err := s.store.PutShareLink(link); err != nil {
+		return nil, err
+	}
+	log.WithField("video", video).WithField("link", link.ID).Info("created share link")
+	return link, nil
+}
+
+// Revoke deletes the link id, so that it can't be used anymore.
+func (s *Shares) Revoke(id string) error {
+	if err := s.store.DeleteShareLink(id); err != nil {
+		return err
+	}
+	log.WithField("link", id).Info("revoked share link")
+	return nil
+}
+
+// Rotate replaces the signing key, revoking every link.
+func (s *Shares) Rotate() error {
+	key, err := newShareKey()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.store.PutShareKey(key); err != nil {
+		return err
+	}
+	s.key = key
+	links, err := s.store.ListShareLinks()
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		if err := s.store.DeleteShareLink(link.ID); err != nil {
+			return err
+		}
+	}
+	log.Info("rotated share key")
+	return nil
+}
+
+// sharedMedia returns true if the request r is for the video or the
+// thumbnail of a share link, rather than its page.
+func sharedMedia(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/t/") || strings.HasSuffix(r.URL.Path, ".mp4")
+}
+
+// sharedStream returns true if the request r is for a manifest, playlist or
+// segment of the HLS and DASH streams of a video.
+func sharedStream(r *http.Request) bool {
+	_, file := mux.Vars(r)["file"]
+	return file || strings.HasSuffix(r.URL.Path, ".mpd")
+}
+
+// countsUse returns true if the request r uses the share link: opening its
+// page, or downloading the video (every request, with a Range header or
+// not). The requests for its thumbnail, and those of the player streaming
+// the video with a playback token handed out by the page, don't.
+func countsUse(r *http.Request, share *middleware.Share) bool {
+	return !share.Playback && !strings.HasPrefix(r.URL.Path, "/t/")
+}
+
+// Verify is the middleware.ShareVerifier of share links: their record must
+// still exist, and the requests using them are counted (against their max
+// uses, if any). Uncounted requests of links with max uses are only allowed
+// once the link was opened, and playback tokens only grant its video and
+// its streams, which only they grant (a player requests every segment).
+func (s *Shares) Verify(r *http.Request, share *middleware.Share) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	link, err := s.store.GetShareLink(share.ID)
+	if err != nil {
+		log.WithError(err).Error("error getting share link")
+		return errShareRevoked
+	}
+	if link == nil || link.Video != share.Video {
+		return errShareRevoked
+	}
+	if share.Playback && !sharedMedia(r) && !sharedStream(r) {
+		return errSharePlayback
+	}
+	if !share.Playback && sharedStream(r) {
+		return errShareStream
+	}
+	if !countsUse(r, share) {
+		if link.MaxUses > 0 && link.Uses == 0 {
+			return errShareUnopened
+		}
+		return nil
+	}
+	if link.MaxUses > 0 && link.Uses >= link.MaxUses {
+		return errShareUsedUp
+	}
+	link.Uses++
+	if err := s.store.PutShareLink(link); err != nil {
+		log.WithError(err).Error("error counting share link use")
+	}
+	return nil
+}
+
+// shared wraps a handler of a video granting access to the requests with a
+// valid share link.
+func (a *App) shared(handler http.HandlerFunc) http.HandlerFunc {
+	return middleware.AllowShared(handler, a.Shares.Key, a.Shares.Verify)
+}
+
+// sharedQuality returns the quality the share link of the request r is
+// restricted to, or quality if there is none.
+func sharedQuality(r *http.Request, quality string) string {
+	if share := middleware.GetShare(r); share != nil && share.Quality != "" {
+		return share.Quality
+	}
+	return quality
+}
+
+// renderShared renders the page of the video v opened with a share link,
+// showing only the video, which its player streams with a playback token.
+func (a *App) renderShared(w http.ResponseWriter, r *http.Request, v *media.Video) {
+	token, err := a.Shares.PlaybackToken(middleware.GetShare(r))
+	if err != nil {
+		log.WithError(err).Error("error signing share playback token")
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	ctx := &struct {
+		Config  *Config
+		Playing *media.Video
+		HLS     bool
+		Token   string
+	}{
+		Config:  a.Config,
+		Playing: v,
+		HLS:     hasHLS(v) && sharedQuality(r, "") == "",
+		Token:   token,
+	}
+	a.render("shared", w, ctx)
+}
+
+// apiShareLink is a share link as returned by the shares API, with its URL.
+type apiShareLink struct {
+	*ShareLink
+	URL string `json:"url"`
+}
+
+// shareLinks returns the links with their URLs.
+func (a *App) shareLinks(links ...*ShareLink) ([]*apiShareLink, error) {
+	res := make([]*apiShareLink, len(links))
+	for i, link := range links {
+		token, err := a.Shares.Token(link)
+		if err != nil {
+			return nil, err
+		}
+		u := fmt.Sprintf("%s/v/%s?%s=%s", a.externalURL(), link.Video, middleware.ShareParam, url.QueryEscape(token))
+		res[i] = &apiShareLink{link, u}
+	}
+	return res, nil
+}
+
+// canManageShare returns true if the user id may revoke the link: its
+// creator and admins.
+func canManageShare(id *middleware.Identity, link *ShareLink) bool {
+	if id == nil {
+		return false
+	}
+	return id.Username == link.Creator || id.Role.Allows(middleware.RoleAdmin)
+}
+
+// parseShareForm returns the expiry (in hours), max uses and quality of
+// the share link created by the request r.
+func (a *App) parseShareForm(r *http.Request) (int, int, string, error) {
+	ttl := defaultShareTTL
+	if s := r.FormValue("expires"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxShareTTL {
+			return 0, 0, "", errShareTTL
+		}
+		ttl = n
+	}
+	maxUses := 0
+	if s := r.FormValue("max_uses"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, 0, "", errShareMaxUses
+		}
+		maxUses = n
+	}
+	quality := strings.ToLower(r.FormValue("quality"))
+	if quality != "" && !a.Config.Transcoder.HasQuality(quality) {
+		return 0, 0, "", errShareQuality
+	}
+	return ttl, maxUses, quality, nil
+}
+
+// HTTP handler for /shares
+// Lists the share links (as JSON or a page managing them, with ?video=id
+// those of a video), and creates share links of the videos the user owns.
+// Admins see every link, other users those they created.
+func (a *App) sharesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// without a user (in the basic auth mode without an auth_password or
+	// the none auth mode) the links of every user would be listed
+	id := middleware.GetIdentity(r)
+	if id == nil {
+		http.Error(w, "Forbidden: share links need a signed in user or an auth_password", http.StatusForbidden)
+		return
+	}
+	videoID := r.FormValue("video")
+
+	var video *media.Video
+	if videoID != "" {
+		v, ok := a.video(r, videoID)
+		if !ok {
+			http.Error(w, "Video Not Found", http.StatusNotFound)
+			return
+		}
+		video = v
+	}
+
+	var created *apiShareLink
+	if r.Method == http.MethodPost {
+		if video == nil {
+			http.Error(w, "video is required", http.StatusBadRequest)
+			return
+		}
+		if !owns(id, video) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		ttl, maxUses, quality, err := a.parseShareForm(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		link, err := a.Shares.Create(video.ID, id.Username, ttl, maxUses, quality)
+		if err != nil {
+			log.WithError(err).Error("error creating share link")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res, err := a.shareLinks(link)
+		if err != nil {
+			log.WithError(err).Error("error signing share link")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		created = res[0]
+
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			if err := json.NewEncoder(w).Encode(created); err != nil {
+				log.WithError(err).Error("error encoding share link")
+			}
+			return
+		}
+	}
+
+	creator := ""
+	if !id.Role.Allows(middleware.RoleAdmin) {
+		creator = id.Username
+	}
+	links, err := a.Shares.List(videoID, creator)
+	if err != nil {
+		log.WithError(err).Error("error listing share links")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := a.shareLinks(links...)
+	if err != nil {
+		log.WithError(err).Error("error signing share links")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			log.WithError(err).Error("error encoding share links")
+		}
+		return
+	}
+
+	ctx := &struct {
+		Config   *Config
+		Playing  *media.Video
+		Video    *media.Video
+		CanShare bool
+		Admin    bool
+		Created  *apiShareLink
+		Links    []*apiShareLink
+		TTL      int
+	}{
+		Config:   a.Config,
+		Playing:  &media.Video{ID: ""},
+		Video:    video,
+		CanShare: video != nil && owns(id, video),
+		Admin:    id.Role.Allows(middleware.RoleAdmin),
+		Created:  created,
+		Links:    res,
+		TTL:      defaultShareTTL,
+	}
+	a.render("shares", w, ctx)
+}
+
+// HTTP handler for POST /shares/id/revoke and DELETE /shares/id
+func (a *App) shareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	link, err := a.Shares.Get(mux.Vars(r)["id"])
+	if errors.Is(err, errShareNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.WithError(err).Error("error getting share link")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !canManageShare(middleware.GetIdentity(r), link) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := a.Shares.Revoke(link.ID); err != nil {
+		log.WithError(err).Error("error revoking share link")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPost && !wantsJSON(r) {
+		http.Redirect(w, r, "/shares?video="+url.QueryEscape(link.Video), http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HTTP handler for POST /shares/rotate
+// Rotates the key share links are signed with, revoking them all.
+func (a *App) shareRotateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := a.Shares.Rotate(); err != nil {
+		log.WithError(err).Error("error rotating share key")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !wantsJSON(r) {
+		http.Redirect(w, r, "/shares", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,172 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+
+	"github.com/gorilla/mux"
+)
+
+func newTestShares(t *testing.T) *Shares {
+	t.Helper()
+	s := newShares(newTestStore(t))
+	key, err := newShareKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.key = key
+	return s
+}
+
+func TestSharesVerify(t *testing.T) {
+	s := newTestShares(t)
+	link, err := s.Create("v", "alice", 1, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.Token(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := middleware.ParseShare(s.Key(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playbackToken, err := s.PlaybackToken(share)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playback, err := middleware.ParseShare(s.Key(), playbackToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the requests are made in order, against the 2 uses of the link
+	tests := []struct {
+		name  string
+		path  string
+		rng   string
+		share *middleware.Share
+		err   error
+	}{
+		{"thumbnail before opening", "/t/v", "", share, errShareUnopened},
+		{"page", "/v/v", "", share, nil},
+		{"thumbnail", "/t/v", "", share, nil},
+		{"first range of a download", "/v/v.mp4", "bytes=0-", share, nil},
+		{"next range of a download", "/v/v.mp4", "bytes=1000-", share, errShareUsedUp},
+		{"download", "/v/v.mp4", "", share, errShareUsedUp},
+		{"page once used up", "/v/v", "", share, errShareUsedUp},
+		{"playback", "/v/v.mp4", "bytes=0-", playback, nil},
+		{"playback seeking", "/v/v.mp4", "bytes=1000-", playback, nil},
+		{"playback thumbnail", "/t/v", "", playback, nil},
+		{"playback stream", "/v/v/hls/master.m3u8", "", playback, nil},
+		{"playback stream init segment", "/v/v/hls/720p_init.mp4", "", playback, nil},
+		{"playback manifest", "/v/v.mpd", "", playback, nil},
+		{"stream", "/v/v/hls/master.m3u8", "", share, errShareStream},
+		{"stream init segment", "/v/v/hls/720p_init.mp4", "", share, errShareStream},
+		{"page with a playback token", "/v/v", "", playback, errSharePlayback},
+		{"other video", "/v/w.mp4", "", &middleware.Share{ID: link.ID, Video: "w"}, errShareRevoked},
+		{"unknown link", "/v/v.mp4", "", &middleware.Share{ID: "unknown", Video: "v"}, errShareRevoked},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if dir, file := path.Split(test.path); path.Base(dir) == "hls" {
+			r = mux.SetURLVars(r, map[string]string{"id": "v", "file": file})
+		}
+		if test.rng != "" {
+			r.Header.Set("Range", test.rng)
+		}
+		if err := s.Verify(r, test.share); !errors.Is(err, test.err) {
+			t.Errorf("%s: Verify error = %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	if link, err = s.Get(link.ID); err != nil || link.Uses != 2 {
+		t.Errorf("Get = %+v, %v, want 2 uses", link, err)
+	}
+	if err := s.Revoke(link.ID); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/v/v.mp4", nil)
+	if err := s.Verify(r, playback); !errors.Is(err, errShareRevoked) {
+		t.Errorf("Verify of a revoked link's playback token error = %v, want %v", err, errShareRevoked)
+	}
+}
+
+func TestSharesPlaybackToken(t *testing.T) {
+	s := newTestShares(t)
+	now := time.Now()
+	tests := []struct {
+		ttl  int
+		want time.Time
+	}{
+		{24, now.Add(sharePlaybackTTL)},
+		{1, now.Add(time.Hour)},
+	}
+	for _, test := range tests {
+		link, err := s.Create("v", "alice", test.ttl, 0, "720p")
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := s.PlaybackToken(&link.Share)
+		if err != nil {
+			t.Fatal(err)
+		}
+		playback, err := middleware.ParseShare(s.Key(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !playback.Playback || playback.ID != link.ID || playback.Quality != "720p" {
+			t.Errorf("PlaybackToken(%d hours) = %+v, want a playback token of %+v", test.ttl, playback, link.Share)
+		}
+		if d := playback.Expires.Sub(test.want); d > time.Second || d < -time.Second {
+			t.Errorf("PlaybackToken(%d hours) expires %s, want %s", test.ttl, playback.Expires, test.want)
+		}
+		if playback.Expires.After(link.Expires) {
+			t.Errorf("PlaybackToken(%d hours) expires after its link", test.ttl)
+		}
+	}
+}
+
+func TestSharesRotate(t *testing.T) {
+	s := newTestShares(t)
+	link, err := s.Create("v", "alice", 1, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.Token(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := middleware.ParseShare(s.Key(), token); !errors.Is(err, middleware.ErrInvalidShare) {
+		t.Errorf("ParseShare after Rotate error = %v, want %v", err, middleware.ErrInvalidShare)
+	}
+	if links, err := s.List("", ""); err != nil || len(links) != 0 {
+		t.Errorf("List after Rotate = %v, %v, want no links", links, err)
+	}
+}
+
+func TestSharesHandlerAnonymous(t *testing.T) {
+	a := &App{Config: DefaultConfig(), Shares: newTestShares(t)}
+	if _, err := a.Shares.Create("v", "alice", 1, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(method, "/shares", nil)
+		r.Header.Set("Accept", "application/json")
+		a.sharesHandler(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s /shares without a user: status %d, want %d", method, w.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -1,11 +1,58 @@
 package app
 
+import "git.mills.io/prologic/tube/media"
+
 // Store ...
 type Store interface {
+	media.Index
+
 	Close() error
 	Migrate(collection, id string) error
 	GetViews_(collection, id string) (int64, error)
 	IncView_(collection, id string) error
 	GetViews(id string) (int64, error)
 	IncViews(id string) error
+	// GetViewsBatch returns the views of the videos with the given ids
+	// (omitting those never viewed), and PutViewsBatch stores the views of
+	// several videos at once.
+	GetViewsBatch(ids []string) (map[string]int64, error)
+	PutViewsBatch(views map[string]int64) error
+	DeleteVideo(id string) error
+
+	GetJob(id string) (*Job, error)
+	PutJob(job *Job) error
+	DeleteJob(id string) error
+	ListJobs() ([]*Job, error)
+
+	GetTrash(id string) (*TrashEntry, error)
+	PutTrash(entry *TrashEntry) error
+	DeleteTrash(id string) error
+	ListTrash() ([]*TrashEntry, error)
+
+	// GetUser and GetSession return nil if there is no such user or
+	// session.
+	GetUser(username string) (*User, error)
+	PutUser(user *User) error
+	DeleteUser(username string) error
+	ListUsers() ([]*User, error)
+
+	GetSession(id string) (*Session, error)
+	PutSession(session *Session) error
+	DeleteSession(id string) error
+	ListSessions() ([]*Session, error)
+
+	// GetShareKey returns nil if no key was stored yet, and GetShareLink
+	// nil if there is no such (unrevoked) share link.
+	GetShareKey() ([]byte, error)
+	PutShareKey(key []byte) error
+	GetShareLink(id string) (*ShareLink, error)
+	PutShareLink(link *ShareLink) error
+	DeleteShareLink(id string) error
+	ListShareLinks() ([]*ShareLink, error)
+
+	// GetAPIToken returns nil if there is no such (unrevoked) API token.
+	GetAPIToken(id string) (*APIToken, error)
+	PutAPIToken(token *APIToken) error
+	DeleteAPIToken(id string) error
+	ListAPITokens() ([]*APIToken, error)
 }
@@ -0,0 +1,86 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"git.mills.io/prologic/tube/app/middleware"
+	"git.mills.io/prologic/tube/media"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// tagged returns the videos of the library tagged with tag, newest first.
+func (a *App) tagged(tag string) media.Playlist {
+	return a.Library.Playlist().Filter(func(v *media.Video) bool {
+		return v.HasTag(tag)
+	})
+}
+
+// videosPage is a page listing videos (e.g: of a tag or collection), with
+// an optional description, cover image and link to its feed. Its Filter
+// keeps the playlist of the video pages linked to restricted to the list.
+type videosPage struct {
+	Heading     string
+	Description string
+	Cover       string
+	Feed        string
+	Filter      playlistFilter
+}
+
+// renderVideos renders the page listing the videos of the playlist pl
+// listed to the user of the request r.
+func (a *App) renderVideos(w http.ResponseWriter, r *http.Request, page *videosPage, pl media.Playlist) {
+	pl = listed(middleware.GetIdentity(r), pl)
+	a.loadViews(pl)
+
+	ctx := &struct {
+		*videosPage
+		Config   *Config
+		Playing  *media.Video
+		Playlist media.Playlist
+	}{
+		videosPage: page,
+		Config:     a.Config,
+		Playing:    &media.Video{ID: ""},
+		Playlist:   pl,
+	}
+	a.render("videos", w, ctx)
+}
+
+// HTTP handler for /tag/name
+func (a *App) tagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := media.NormalizeTag(mux.Vars(r)["name"])
+	log.Printf("/tag/%s", tag)
+	a.renderVideos(w, r, &videosPage{
+		Heading: fmt.Sprintf("Tag: %s", tag),
+		Feed:    fmt.Sprintf("/tag/%s/feed.xml", url.PathEscape(tag)),
+		Filter:  playlistFilter{Tag: tag},
+	}, a.tagged(tag))
+}
+
+// HTTP handler for /category/name
+func (a *App) categoryHandler(w http.ResponseWriter, r *http.Request) {
+	category := mux.Vars(r)["name"]
+	log.Printf("/category/%s", category)
+	pl := a.Library.Playlist().Filter(func(v *media.Video) bool {
+		return v.InCategory(category)
+	})
+	a.renderVideos(w, r, &videosPage{Heading: fmt.Sprintf("Category: %s", category)}, pl)
+}
+
+// HTTP handler for /tag/name/feed.xml
+func (a *App) tagFeedHandler(w http.ResponseWriter, r *http.Request) {
+	tag := media.NormalizeTag(mux.Vars(r)["name"])
+	feed, err := a.feed(tag, "", fmt.Sprintf("/tag/%s", tag), a.tagged(tag))
+	if err != nil {
+		log.WithError(err).WithField("tag", tag).Error("error building feed")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(feed)
+}
@@ -0,0 +1,363 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+	"git.mills.io/prologic/tube/media"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// apiTokenPrefix prefixes API tokens, so that they are easy to recognize
+// (e.g: by secret scanners).
+const apiTokenPrefix = "tube_"
+
+var (
+	errTokenNotFound = errors.New("API token not found")
+	errTokenName     = errors.New("name must be 1-64 characters")
+	errTokenScopes   = errors.New("at least one valid scope is required")
+	errTokenScope    = errors.New("your role doesn't allow this scope")
+	errTokenExpiry   = errors.New("expiry must be a positive no. of days")
+	errTokenAuth     = errors.New("API tokens can only be managed when logged in")
+)
+
+// scopeRoles are the roles required to create API tokens with each scope.
+var scopeRoles = map[string]middleware.Role{
+	middleware.ScopeRead:   middleware.RoleViewer,
+	middleware.ScopeUpload: middleware.RoleUploader,
+	middleware.ScopeImport: middleware.RoleUploader,
+	middleware.ScopeAdmin:  middleware.RoleAdmin,
+}
+
+// APIToken is a personal API token of a user, sent in the Authorization
+// header of requests as a Bearer token. Its ID is the SHA-256 hash of the
+// token, so that the store doesn't hold usable tokens.
+type APIToken struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Username string     `json:"username"`
+	Scopes   []string   `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+// Expired returns true if the token has expired.
+func (t *APIToken) Expired() bool {
+	return t.Expires != nil && time.Now().After(*t.Expires)
+}
+
+// Tokens manages the API tokens.
+type Tokens struct {
+	store Store
+	// role returns the current role of the user username, or "" if there
+	// is no such user.
+	role func(username string) middleware.Role
+}
+
+// newTokens returns a new Tokens granting the users the role returned by
+// role.
+func newTokens(store Store, role func(username string) middleware.Role) *Tokens {
+	return &Tokens{store: store, role: role}
+}
+
+// List returns the tokens of the user username (or every token, if empty),
+// newest first.
+func (t *Tokens) List(username string) ([]*APIToken, error) {
+	tokens, err := t.store.ListAPITokens()
+	if err != nil {
+		return nil, err
+	}
+	res := []*APIToken{}
+	for _, token := range tokens {
+		if username == "" || token.Username == username {
+			res = append(res, token)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Created.After(res[j].Created) })
+	return res, nil
+}
+
+// Create adds a token of the user username with the given scopes, expiring
+// after days (or never, if 0), and returns it.
+func (t *Tokens) Create(username, name string, scopes []string, days int) (string, *APIToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 64 {
+		return "", nil, errTokenName
+	}
+	if days < 0 {
+		return "", nil, errTokenExpiry
+	}
+	role := t.role(username)
+	if role == "" {
+		return "", nil, errUserNotFound
+	}
+	var valid []string
+	for _, scope := range scopes {
+		required, ok := scopeRoles[scope]
+		if !ok {
+			return "", nil, errTokenScopes
+		}
+		if !role.Allows(required) {
+			return "", nil, errTokenScope
+		}
+		valid = append(valid, scope)
+	}
+	if len(valid) == 0 {
+		return "", nil, errTokenScopes
+	}
+
+	secret := apiTokenPrefix + randomToken()
+	now := time.Now()
+	token := &APIToken{
+		ID:       hashToken(secret),
+		Name:     name,
+		Username: username,
+		Scopes:   valid,
+		Created:  now,
+	}
+	if days > 0 {
+		expires := now.AddDate(0, 0, days)
+		token.Expires = &expires
+	}
+	if err := t.store.PutAPIToken(token); err != nil {
+		return "", nil, err
+	}
+	log.WithField("user", username).WithField("scopes", valid).Info("created API token")
+	return secret, token, nil
+}
+
+// Get returns the token id.
+func (t *Tokens) Get(id string) (*APIToken, error) {
+	token, err := t.store.GetAPIToken(id)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, errTokenNotFound
+	}
+	return token, nil
+}
+
+// Revoke deletes the token id.
+func (t *Tokens) Revoke(id string) error {
+	if err := t.store.DeleteAPIToken(id); err != nil {
+		return err
+	}
+	log.WithField("token", id).Info("revoked API token")
+	return nil
+}
+
+// bearerToken returns the Bearer token of the Authorization header of the
+// request r, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// Identify returns the user of the API token of the request r with its
+// scopes, or nil if it is invalid (or expired).
+func (t *Tokens) Identify(r *http.Request) *middleware.Identity {
+	secret, ok := bearerToken(r)
+	if !ok || !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil
+	}
+	token, err := t.store.GetAPIToken(hashToken(secret))
+	if err != nil {
+		log.WithError(err).Warn("error getting API token")
+		return nil
+	}
+	if token == nil || token.Expired() {
+		return nil
+	}
+	role := t.role(token.Username)
+	if role == "" {
+		return nil
+	}
+	return &middleware.Identity{
+		Username: token.Username,
+		Role:     role,
+		Scopes:   append([]string{}, token.Scopes...),
+	}
+}
+
+// deleteTokens removes the tokens of the user username.
+func deleteTokens(store Store, username string) error {
+	tokens, err := store.ListAPITokens()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if token.Username == username {
+			if err := store.DeleteAPIToken(token.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tokenErrorStatus returns the HTTP status of an error managing tokens.
+func tokenErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errTokenNotFound), errors.Is(err, errUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errTokenScope), errors.Is(err, errTokenAuth):
+		return http.StatusForbidden
+	case errors.Is(err, errTokenName), errors.Is(err, errTokenScopes), errors.Is(err, errTokenExpiry):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// tokenUser returns the user managing API tokens with the request r, who
+// must not be using one.
+func tokenUser(r *http.Request) (*middleware.Identity, error) {
+	id := middleware.GetIdentity(r)
+	if id == nil || id.Scopes != nil {
+		return nil, errTokenAuth
+	}
+	return id, nil
+}
+
+// HTTP handler for /tokens
+// Lists the API tokens of the user (every token for admins) as JSON or a
+// page managing them, and creates tokens, showing them once.
+func (a *App) tokensHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	id, err := tokenUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+	admin := id.Role.Allows(middleware.RoleAdmin)
+
+	var secret string
+	if r.Method == http.MethodPost {
+		days := 0
+		if s := r.FormValue("expires"); s != "" {
+			if days, err = strconv.Atoi(s); err != nil {
+				http.Error(w, errTokenExpiry.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		var scopes []string
+		for _, s := range r.Form["scope"] {
+			scopes = append(scopes, strings.Split(s, ",")...)
+		}
+		var token *APIToken
+		secret, token, err = a.Tokens.Create(id.Username, r.FormValue("name"), scopes, days)
+		if err != nil {
+			status := tokenErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				log.WithError(err).Error("error creating API token")
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusCreated)
+			res := &struct {
+				*APIToken
+				Token string `json:"token"`
+			}{token, secret}
+			if err := json.NewEncoder(w).Encode(res); err != nil {
+				log.WithError(err).Error("error encoding API token")
+			}
+			return
+		}
+	}
+
+	username := id.Username
+	if admin {
+		username = ""
+	}
+	tokens, err := a.Tokens.List(username)
+	if err != nil {
+		log.WithError(err).Error("error listing API tokens")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tokens); err != nil {
+			log.WithError(err).Error("error encoding API tokens")
+		}
+		return
+	}
+
+	var scopes []string
+	for _, scope := range middleware.Scopes {
+		if id.Role.Allows(scopeRoles[scope]) {
+			scopes = append(scopes, scope)
+		}
+	}
+	ctx := &struct {
+		Config  *Config
+		Playing *media.Video
+		Tokens  []*APIToken
+		Scopes  []string
+		Admin   bool
+		Created string
+	}{
+		Config:  a.Config,
+		Playing: &media.Video{ID: ""},
+		Tokens:  tokens,
+		Scopes:  scopes,
+		Admin:   admin,
+		Created: secret,
+	}
+	a.render("tokens", w, ctx)
+}
+
+// HTTP handler for POST /tokens/id/revoke and DELETE /tokens/id
+// Revokes a token of the user (or any token, for admins).
+func (a *App) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	id, err := tokenUser(r)
+	if err != nil {
+		http.Error(w, err.Error(), tokenErrorStatus(err))
+		return
+	}
+	token, err := a.Tokens.Get(mux.Vars(r)["id"])
+	if err == nil && token.Username != id.Username && !id.Role.Allows(middleware.RoleAdmin) {
+		err = errTokenNotFound
+	}
+	if err == nil {
+		err = a.Tokens.Revoke(token.ID)
+	}
+	if err != nil {
+		status := tokenErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.WithError(err).Error("error revoking API token")
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if r.Method == http.MethodPost && !wantsJSON(r) {
+		http.Redirect(w, r, "/tokens", http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,185 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+)
+
+// newTestTokens returns a Tokens whose users have the roles of roles.
+func newTestTokens(t *testing.T, roles map[string]middleware.Role) *Tokens {
+	t.Helper()
+	return newTokens(newTestStore(t), func(username string) middleware.Role { return roles[username] })
+}
+
+// bearerRequest returns a request made with the Authorization header auth.
+func bearerRequest(auth string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if auth != "" {
+		r.Header.Set("Authorization", auth)
+	}
+	return r
+}
+
+func TestTokensCreate(t *testing.T) {
+	tokens := newTestTokens(t, map[string]middleware.Role{
+		"viewer":   middleware.RoleViewer,
+		"uploader": middleware.RoleUploader,
+		"admin":    middleware.RoleAdmin,
+	})
+
+	tests := []struct {
+		username, name string
+		scopes         []string
+		days           int
+		err            error
+	}{
+		{"viewer", "feed reader", []string{middleware.ScopeRead}, 0, nil},
+		{"viewer", "uploads", []string{middleware.ScopeUpload}, 0, errTokenScope},
+		{"uploader", "ci", []string{middleware.ScopeUpload, middleware.ScopeImport}, 30, nil},
+		{"uploader", "everything", []string{middleware.ScopeAdmin}, 0, errTokenScope},
+		{"admin", "everything", []string{middleware.ScopeAdmin}, 0, nil},
+		{"admin", "nothing", nil, 0, errTokenScopes},
+		{"admin", "unknown", []string{"write"}, 0, errTokenScopes},
+		{"admin", "  ", []string{middleware.ScopeRead}, 0, errTokenName},
+		{"admin", strings.Repeat("x", 65), []string{middleware.ScopeRead}, 0, errTokenName},
+		{"admin", "past", []string{middleware.ScopeRead}, -1, errTokenExpiry},
+		{"nobody", "ghost", []string{middleware.ScopeRead}, 0, errUserNotFound},
+	}
+	for _, test := range tests {
+		secret, token, err := tokens.Create(test.username, test.name, test.scopes, test.days)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Create(%q, %q, %v, %d) error = %v, want %v", test.username, test.name, test.scopes, test.days, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		// only the hash of the secret is stored
+		if !strings.HasPrefix(secret, apiTokenPrefix) || token.ID != hashToken(secret) || strings.Contains(token.ID, secret) {
+			t.Errorf("Create(%q, %q) = %q with ID %q, want a %s secret identified by its hash", test.username, test.name, secret, token.ID, apiTokenPrefix)
+		}
+		if stored, err := tokens.store.GetAPIToken(token.ID); err != nil || stored == nil || stored.Username != test.username {
+			t.Errorf("GetAPIToken(%q) = %+v, %v, want the token of %s", token.ID, stored, err, test.username)
+		}
+		if stored, err := tokens.store.GetAPIToken(secret); err != nil || stored != nil {
+			t.Errorf("GetAPIToken(secret) = %+v, %v, want nothing", stored, err)
+		}
+
+		switch {
+		case test.days == 0 && token.Expires != nil:
+			t.Errorf("Create(%q, %q) expires %s, want never", test.username, test.name, token.Expires)
+		case test.days > 0 && (token.Expires == nil || !token.Expires.Equal(token.Created.AddDate(0, 0, test.days))):
+			t.Errorf("Create(%q, %q) expires %v, want in %d days", test.username, test.name, token.Expires, test.days)
+		}
+	}
+
+	if list, err := tokens.List("uploader"); err != nil || len(list) != 1 || list[0].Name != "ci" {
+		t.Errorf("List(uploader) = %v, %v, want the ci token", list, err)
+	}
+	if list, err := tokens.List(""); err != nil || len(list) != 3 {
+		t.Errorf("List() = %v, %v, want 3 tokens", list, err)
+	}
+}
+
+func TestTokensIdentify(t *testing.T) {
+	roles := map[string]middleware.Role{
+		"alice": middleware.RoleUploader,
+		"bob":   middleware.RoleEditor,
+	}
+	tokens := newTestTokens(t, roles)
+	upload, _, err := tokens.Create("alice", "ci", []string{middleware.ScopeUpload}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, _, err := tokens.Create("alice", "feed", []string{middleware.ScopeRead}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, token, err := tokens.Create("alice", "old", []string{middleware.ScopeRead}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Second)
+	token.Expires = &past
+	if err := tokens.store.PutAPIToken(token); err != nil {
+		t.Fatal(err)
+	}
+	deleted, _, err := tokens.Create("bob", "gone", []string{middleware.ScopeRead}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(roles, "bob")
+
+	tests := []struct {
+		name   string
+		auth   string
+		role   middleware.Role
+		scopes map[string]bool
+	}{
+		{"upload token", "Bearer " + upload, middleware.RoleUploader, map[string]bool{
+			middleware.ScopeUpload: true, middleware.ScopeRead: false, middleware.ScopeImport: false,
+		}},
+		{"case insensitive scheme", "bearer " + read, middleware.RoleUploader, map[string]bool{
+			middleware.ScopeRead: true, middleware.ScopeUpload: false,
+		}},
+		{"expired", "Bearer " + expired, "", nil},
+		{"user deleted", "Bearer " + deleted, "", nil},
+		{"unknown", "Bearer " + apiTokenPrefix + randomToken(), "", nil},
+		{"hash instead of secret", "Bearer " + hashToken(upload), "", nil},
+		{"without prefix", "Bearer " + strings.TrimPrefix(upload, apiTokenPrefix), "", nil},
+		{"basic scheme", "Basic " + upload, "", nil},
+		{"no header", "", "", nil},
+	}
+	for _, test := range tests {
+		id := tokens.Identify(bearerRequest(test.auth))
+		if test.role == "" {
+			if id != nil {
+				t.Errorf("%s: Identify = %+v, want nil", test.name, id)
+			}
+			continue
+		}
+		if id == nil || id.Username != "alice" || id.Role != test.role {
+			t.Errorf("%s: Identify = %+v, want alice with the role %s", test.name, id, test.role)
+			continue
+		}
+		for scope, want := range test.scopes {
+			if got := id.HasScope(scope); got != want {
+				t.Errorf("%s: HasScope(%s) = %v, want %v", test.name, scope, got, want)
+			}
+		}
+	}
+
+	// tokens get the current role of their user
+	roles["alice"] = middleware.RoleViewer
+	if id := tokens.Identify(bearerRequest("Bearer " + upload)); id == nil || id.Role != middleware.RoleViewer {
+		t.Errorf("Identify after a role change = %+v, want the viewer role", id)
+	}
+}
+
+func TestTokenErrorStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{errTokenNotFound, http.StatusNotFound},
+		{errUserNotFound, http.StatusNotFound},
+		{errTokenScope, http.StatusForbidden},
+		{errTokenAuth, http.StatusForbidden},
+		{errTokenName, http.StatusBadRequest},
+		{errTokenScopes, http.StatusBadRequest},
+		{errTokenExpiry, http.StatusBadRequest},
+		{errors.New("disk full"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if status := tokenErrorStatus(test.err); status != test.status {
+			t.Errorf("tokenErrorStatus(%v) = %d, want %d", test.err, status, test.status)
+		}
+	}
+}
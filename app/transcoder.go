@@ -0,0 +1,671 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.mills.io/prologic/tube/importers"
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/utils"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/dustin/go-humanize"
+	shortuuid "github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// phaseTranscode, phaseThumbnail, phaseDownload and phaseStore are the names
+// of job phases. Every configured rendition adds a "resize:<suffix>" phase.
+const (
+	phaseDownload  = "download"
+	phaseTranscode = "transcode"
+	phaseThumbnail = "thumbnail"
+	phaseStore     = "store"
+)
+
+func resizePhase(suffix string) string {
+	return "resize:" + suffix
+}
+
+// ffmpegEncoders returns the names of the encoders (and of the codecs that
+// can be encoded) supported by the installed ffmpeg.
+func ffmpegEncoders() (map[string]bool, error) {
+	if !utils.CmdExists("ffmpeg") {
+		return nil, fmt.Errorf("ffmpeg not found")
+	}
+	encoders := make(map[string]bool)
+
+	out, err := utils.RunCmdOutput(10, "ffmpeg", "-hide_banner", "-encoders")
+	if err != nil {
+		return nil, err
+	}
+	// e.g: " V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC"
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && len(fields[0]) == 6 && fields[0] != "------" {
+			encoders[fields[1]] = true
+		}
+	}
+
+	out, err = utils.RunCmdOutput(10, "ffmpeg", "-hide_banner", "-codecs")
+	if err != nil {
+		return nil, err
+	}
+	// e.g: " DEV.LS h264                 H.264 / AVC / MPEG-4 AVC"
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && len(fields[0]) == 6 && fields[0][1] == 'E' {
+			encoders[fields[1]] = true
+		}
+	}
+
+	return encoders, nil
+}
+
+// args returns the ffmpeg output options for encoding with the profile.
+func (p *TranscodeProfile) args() []string {
+	args := []string{"-c:v", p.VideoCodec}
+	if p.CRF > 0 {
+		args = append(args, "-crf", fmt.Sprint(p.CRF))
+	}
+	if p.VideoBitrate != "" {
+		args = append(args, "-b:v", p.VideoBitrate)
+	}
+	if p.Preset != "" {
+		args = append(args, "-preset", p.Preset)
+	}
+	if p.Size != "" {
+		args = append(args, "-s", p.Size)
+	}
+	if p.MaxHeight > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=-2:'min(ih,%d)'", p.MaxHeight))
+	}
+	args = append(args, "-c:a", p.AudioCodec)
+	if p.AudioBitrate != "" {
+		args = append(args, "-b:a", p.AudioBitrate)
+	}
+	args = append(args, "-strict", "-2")
+	return append(args, p.ExtraArgs...)
+}
+
+// Qualities returns the suffixes of the configured renditions, highest
+// quality (by the leading number of the suffix, e.g: 720p) first.
+func (c *TranscoderConfig) Qualities() []string {
+	suffixes := make([]string, 0, len(c.Renditions))
+	for suffix := range c.Renditions {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Slice(suffixes, func(i, j int) bool {
+		ni, nj := leadingNumber(suffixes[i]), leadingNumber(suffixes[j])
+		if ni != nj {
+			return ni > nj
+		}
+		return suffixes[i] < suffixes[j]
+	})
+	return suffixes
+}
+
+// HasQuality returns true if quality is the suffix of a configured rendition.
+func (c *TranscoderConfig) HasQuality(quality string) bool {
+	_, ok := c.Renditions[quality]
+	return ok
+}
+
+func leadingNumber(s string) int {
+	n := 0
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			break
+		}
+		n = n*10 + int(r-'0')
+	}
+	return n
+}
+
+// encode encodes src into dst with the named profile for the library path p.
+func (a *App) encode(job *Job, p *media.Path, profile, src, dst, title, description string) error {
+	tp := a.Config.Transcoder.Profiles[profile]
+	args := tp.args()
+	if tp.VideoCodec != "copy" {
+		args = append(args, a.keyframeArgs(p)...)
+	}
+	return a.convert(job, src, dst, title, description, args...)
+}
+
+// convert runs ffmpeg converting src into dst with the given output options,
+// setting its title and description.
+func (a *App) convert(job *Job, src, dst, title, description string, options ...string) error {
+	args := []string{"-y", "-i", src}
+	args = append(args, options...)
+	args = append(args,
+		"-loglevel", "quiet",
+		"-metadata", fmt.Sprintf("title=%s", title),
+		"-metadata", fmt.Sprintf("comment=%s", description),
+		dst,
+	)
+	if err := a.ffmpeg(job, a.Config.Transcoder.Timeout, src, args...); err != nil {
+		return fmt.Errorf("error transcoding video: %w", err)
+	}
+	return nil
+}
+
+// ffmpeg runs ffmpeg reporting its progress against the duration of src as
+// the progress of the running phase of job.
+func (a *App) ffmpeg(job *Job, timeout int, src string, args ...string) error {
+	var duration time.Duration
+	if info, err := media.Probe(src); err != nil {
+		log.WithError(err).WithField("job", job.ID).Warn("unable to probe duration, progress will not be reported")
+	} else {
+		duration = info.Duration
+	}
+	return utils.RunCmdProgress(timeout, func(pos time.Duration) {
+		if duration > 0 {
+			a.Jobs.Progress(job, 100*float64(pos)/float64(duration))
+		}
+	}, "ffmpeg", args...)
+}
+
+// transcode converts src into the master video at dst. Unless src is
+// already browser-compatible (see PassthroughConfig) and the library path p
+// isn't segmented for HLS or DASH, it is transcoded with the default profile
+// of the Transcoder.
+func (a *App) transcode(job *Job, p *media.Path, src, dst, title, description string) error {
+	a.Jobs.Phase(job, phaseTranscode)
+
+	decision, reason := decisionTranscode, "unable to probe video"
+	if info, err := media.Probe(src); err != nil {
+		log.WithError(err).WithField("job", job.ID).Warn("unable to probe video")
+	} else {
+		decision, reason = a.Config.Transcoder.Passthrough.decide(info)
+	}
+	// Copied video streams keep their keyframes, which segments must start at.
+	if decision != decisionTranscode && a.keyframeArgs(p) != nil {
+		decision, reason = decisionTranscode, "segmenting needs keyframes at segment boundaries"
+	}
+	log.
+		WithField("job", job.ID).
+		WithField("decision", decision).
+		WithField("reason", reason).
+		Info("converting video")
+
+	tp := a.Config.Transcoder.Profiles[a.Config.Transcoder.Profile]
+	switch decision {
+	case decisionRemux:
+		return a.convert(job, src, dst, title, description,
+			"-map", "0:v:0", "-map", "0:a:0?",
+			"-c", "copy",
+			"-movflags", "+faststart",
+		)
+	case decisionAudio:
+		args := []string{
+			"-map", "0:v:0", "-map", "0:a:0",
+			"-c:v", "copy",
+			"-c:a", tp.AudioCodec,
+		}
+		if tp.AudioBitrate != "" {
+			args = append(args, "-b:a", tp.AudioBitrate)
+		}
+		args = append(args, "-movflags", "+faststart")
+		return a.convert(job, src, dst, title, description, args...)
+	default:
+		return a.encode(job, p, a.Config.Transcoder.Profile, src, dst, title, description)
+	}
+}
+
+// decisionRemux, decisionAudio and decisionTranscode are the ways an
+// uploaded or imported video is converted into the master video.
+const (
+	decisionRemux     = "remux"
+	decisionAudio     = "audio"
+	decisionTranscode = "transcode"
+)
+
+// decide returns how a video described by info is converted into the master
+// video, and why.
+func (c *PassthroughConfig) decide(info *media.ProbeInfo) (string, string) {
+	if !c.Enabled {
+		return decisionTranscode, "passthrough disabled"
+	}
+	if !contains(c.VideoCodecs, info.VideoCodec) {
+		return decisionTranscode, fmt.Sprintf("video codec %q not allowed", info.VideoCodec)
+	}
+	if c.MaxHeight > 0 && info.Height > c.MaxHeight {
+		return decisionTranscode, fmt.Sprintf("height %d exceeds %d", info.Height, c.MaxHeight)
+	}
+	if c.MaxBitrate > 0 && info.Bitrate > c.MaxBitrate {
+		return decisionTranscode, fmt.Sprintf("bitrate %d exceeds %d", info.Bitrate, c.MaxBitrate)
+	}
+	if info.AudioCodec != "" && !contains(c.AudioCodecs, info.AudioCodec) {
+		return decisionAudio, fmt.Sprintf("audio codec %q not allowed", info.AudioCodec)
+	}
+	return decisionRemux, fmt.Sprintf("%s/%s is browser-compatible", info.VideoCodec, info.AudioCodec)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// thumbnail generates a JPEG thumbnail for src at dst.
+func (a *App) thumbnail(job *Job, src, dst string) error {
+	a.Jobs.Phase(job, phaseThumbnail)
+	if err := utils.RunCmd(
+		a.Config.Thumbnailer.Timeout,
+		"ffmpeg",
+		"-i", src,
+		"-y",
+		"-vf", "thumbnail",
+		"-t", fmt.Sprint(a.Config.Thumbnailer.PositionFromStart),
+		"-vframes", "1",
+		"-strict", "-2",
+		"-loglevel", "quiet",
+		dst,
+	); err != nil {
+		return fmt.Errorf("error generating thumbnail: %w", err)
+	}
+	return nil
+}
+
+// resize transcodes vf into every rendition configured in the Transcoder,
+// stored next to vf as name#suffix.mp4
+func (a *App) resize(job *Job, p *media.Path, vf, title, description string) error {
+	for _, suffix := range a.Config.Transcoder.Qualities() {
+		if ph := job.phase(resizePhase(suffix)); ph != nil && ph.State == JobDone {
+			continue
+		}
+		a.Jobs.Phase(job, resizePhase(suffix))
+		profile := a.Config.Transcoder.Renditions[suffix]
+		log.
+			WithField("suffix", suffix).
+			WithField("profile", profile).
+			WithField("vf", filepath.Base(vf)).
+			Info("resizing video for lower quality playback")
+		sf := fmt.Sprintf(
+			"%s#%s.mp4",
+			strings.TrimSuffix(vf, filepath.Ext(vf)),
+			suffix,
+		)
+		if err := a.encode(job, p, profile, vf, sf, title, description); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renditionPhases returns the phases rendering the lower quality renditions
+// of a video published into the library path p, segmenting them for
+// streaming and storing them in p (if not stored locally).
+func (a *App) renditionPhases(p *media.Path) []string {
+	var phases []string
+	for _, suffix := range a.Config.Transcoder.Qualities() {
+		phases = append(phases, resizePhase(suffix))
+	}
+	if a.hlsEnabled() {
+		phases = append(phases, phaseHLS)
+	}
+	if p.DASH {
+		phases = append(phases, phaseDASH)
+	}
+	if !p.Local() {
+		phases = append(phases, phaseStore)
+	}
+	return phases
+}
+
+// renditions renders every lower quality rendition of the published video
+// vf and segments them for HLS and DASH (if enabled). Videos published into
+// the stage of the job are then stored in the library path p.
+func (a *App) renditions(job *Job, p *media.Path, vf string) error {
+	if err := a.resize(job, p, vf, job.Title, job.Description); err != nil {
+		return err
+	}
+	if a.hlsEnabled() {
+		if err := a.segment(job, vf); err != nil {
+			return err
+		}
+	}
+	if p.DASH {
+		if err := a.dash(job, vf); err != nil {
+			return err
+		}
+	}
+	if !p.Local() {
+		return a.store(job, p, vf)
+	}
+	return nil
+}
+
+// store uploads the video vf and every file derived from it (thumbnail,
+// renditions, HLS and DASH directories) from the stage of the job to the
+// Storage of the library path p, then adds the video to the library. The
+// video itself is stored last, so that it is only listed once complete.
+func (a *App) store(job *Job, p *media.Path, vf string) error {
+	a.Jobs.Phase(job, phaseStore)
+
+	var files []string
+	err := filepath.WalkDir(job.Stage, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && fp != vf {
+			files = append(files, fp)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error listing staged files: %w", err)
+	}
+	files = append(files, vf)
+
+	for _, fp := range files {
+		rel, err := filepath.Rel(job.Stage, fp)
+		if err != nil {
+			return err
+		}
+		if err := storeFile(p.Files(), filepath.ToSlash(rel), fp); err != nil {
+			return fmt.Errorf("error storing %s: %w", rel, err)
+		}
+	}
+
+	rel, err := filepath.Rel(job.Stage, vf)
+	if err != nil {
+		return err
+	}
+	if err := a.Library.Add(path.Join(p.Path, filepath.ToSlash(rel))); err != nil {
+		return fmt.Errorf("error adding stored video to library: %w", err)
+	}
+	buildFeed(a)
+	return nil
+}
+
+// storeFile writes the local file fp to the Storage s as name.
+func storeFile(s media.Storage, name, fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return s.Write(name, f, stat.Size())
+}
+
+func (a *App) hlsEnabled() bool {
+	return a.Config.Transcoder.HLS != nil && a.Config.Transcoder.HLS.Enabled
+}
+
+// videoName returns the final name (relative to the library path p) for a
+// video published into p. The (sanitized) original filename is used when the
+// library path or server is configured to preserve it, otherwise a random
+// name is generated (or when there is no original filename).
+func (a *App) videoName(p *media.Path, filename string) (string, error) {
+	name := fmt.Sprintf("%s.mp4", shortuuid.New())
+	if filename != "" && (a.Config.Server.PreserveUploadFilename || p.PreserveUploadFilename) {
+		name = fmt.Sprintf("%s.mp4", filenameWithoutExtension(filename))
+	}
+	// If the (sanitized) original filename collides with an existing file,
+	// we try to add a shortuuid() to it until we find one that doesn't exist.
+	for _, err := p.Files().Stat(name); !errors.Is(err, fs.ErrNotExist); _, err = p.Files().Stat(name) {
+		if err != nil {
+			return "", err
+		}
+		log.Warn("File '" + name + "' already exists.")
+		name = fmt.Sprintf("%s_%s.mp4", filenameWithoutExtension(name), shortuuid.New())
+		log.Warn("Using filename '" + name + "' instead.")
+	}
+	return name, nil
+}
+
+// publishPath returns the local file the video named name is published to:
+// the file in the library path p if it is stored locally, otherwise the file
+// in the stage of the job, to be stored in p once all renditions are done.
+func (a *App) publishPath(job *Job, p *media.Path, name string) (string, error) {
+	dir := p.Path
+	if !p.Local() {
+		dir = filepath.Join(a.Config.Server.UploadPath, "tube-stage-"+job.ID)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return "", fmt.Errorf("error creating job stage: %w", err)
+		}
+		a.Jobs.Update(job, func(job *Job) { job.Stage = dir })
+	}
+	vf, err := securejoin.SecureJoin(dir, name)
+	if err != nil {
+		return "", fmt.Errorf("error creating file name in target library: %w", err)
+	}
+	return vf, nil
+}
+
+// publish moves a transcoded video and its thumbnail into the library as vf.
+// The thumbnail is moved first so it is in place when the watcher picks up
+// the video.
+func publish(tf, thumb, vf string) error {
+	if err := os.Rename(thumb, fmt.Sprintf("%s.jpg", strings.TrimSuffix(vf, filepath.Ext(vf)))); err != nil {
+		return fmt.Errorf("error renaming generated thumbnail: %w", err)
+	}
+	if err := os.Rename(tf, vf); err != nil {
+		return fmt.Errorf("error renaming transcoded video: %w", err)
+	}
+	return nil
+}
+
+// writeMetadata writes the .yml sidecar of the video vf (before it is
+// published) with the tags, category, owner and visibility of the job, if
+// any.
+func writeMetadata(job *Job, vf string) error {
+	meta := make(map[string]interface{})
+	if len(job.Tags) > 0 {
+		meta["tags"] = job.Tags
+	}
+	if job.Category != "" {
+		meta["category"] = job.Category
+	}
+	if job.Owner != "" {
+		meta["owner"] = job.Owner
+	}
+	if job.Visibility != "" && job.Visibility != media.Public {
+		meta["visibility"] = job.Visibility
+	}
+	if len(meta) == 0 {
+		return nil
+	}
+	data, err := yaml.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(fmt.Sprintf("%s.yml", strings.TrimSuffix(vf, filepath.Ext(vf))), data, 0o644); err != nil {
+		return fmt.Errorf("error writing metadata: %w", err)
+	}
+	return nil
+}
+
+// processUpload is the JobFunc for JobUpload jobs.
+func (a *App) processUpload(job *Job) error {
+	p, ok := a.Library.Paths[job.Library]
+	if !ok {
+		return permanent(fmt.Errorf("uploading to invalid library path: %s", job.Library))
+	}
+	if p.ReadOnly {
+		return permanent(fmt.Errorf("uploading to read-only library path: %s", job.Library))
+	}
+
+	phases := []string{phaseTranscode, phaseThumbnail}
+	a.Jobs.Plan(job, append(phases, a.renditionPhases(p)...)...)
+
+	// A previous attempt already published the video; only the lower
+	// quality renditions are left to do.
+	if job.Video != "" {
+		return a.renditions(job, p, job.Video)
+	}
+
+	tf, err := ioutil.TempFile(
+		a.Config.Server.UploadPath,
+		"tube-transcode-*.mp4",
+	)
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for transcoding: %w", err)
+	}
+	tf.Close()
+	defer os.Remove(tf.Name())
+
+	thumb := fmt.Sprintf("%s.jpg", strings.TrimSuffix(tf.Name(), filepath.Ext(tf.Name())))
+	defer os.Remove(thumb)
+
+	if err := a.transcode(job, p, job.Source, tf.Name(), job.Title, job.Description); err != nil {
+		return err
+	}
+
+	if err := a.thumbnail(job, job.Source, thumb); err != nil {
+		return err
+	}
+
+	name, err := a.videoName(p, job.Filename)
+	if err != nil {
+		return err
+	}
+	vf, err := a.publishPath(job, p, name)
+	if err != nil {
+		return err
+	}
+
+	if err := writeMetadata(job, vf); err != nil {
+		return err
+	}
+	if err := publish(tf.Name(), thumb, vf); err != nil {
+		return err
+	}
+	a.Jobs.Update(job, func(job *Job) { job.Video = vf })
+
+	return a.renditions(job, p, vf)
+}
+
+// processImport is the JobFunc for JobImport jobs.
+func (a *App) processImport(job *Job) error {
+	p, ok := a.Library.Paths[job.Library]
+	if !ok {
+		return permanent(fmt.Errorf("importing to invalid library path: %s", job.Library))
+	}
+	if p.ReadOnly {
+		return permanent(fmt.Errorf("importing to read-only library path: %s", job.Library))
+	}
+
+	phases := []string{phaseDownload, phaseTranscode}
+	a.Jobs.Plan(job, append(phases, a.renditionPhases(p)...)...)
+
+	// A previous attempt already published the video; only the lower
+	// quality renditions are left to do.
+	if job.Video != "" {
+		return a.renditions(job, p, job.Video)
+	}
+
+	a.Jobs.Phase(job, phaseDownload)
+	videoImporter, err := importers.NewImporter(job.URL)
+	if err != nil {
+		return permanent(fmt.Errorf("error creating video importer for %s: %w", job.URL, err))
+	}
+
+	videoInfo, err := videoImporter.GetVideoInfo(job.URL)
+	if err != nil {
+		return fmt.Errorf("error retriving video info for %s: %w", job.URL, err)
+	}
+	a.Jobs.Update(job, func(job *Job) {
+		job.Title = videoInfo.Title
+		job.Description = videoInfo.Description
+	})
+
+	uf, err := ioutil.TempFile(
+		a.Config.Server.UploadPath,
+		"tube-import-*.mp4",
+	)
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for importing: %w", err)
+	}
+	uf.Close()
+	defer os.Remove(uf.Name())
+
+	log.WithField("video_url", videoInfo.VideoURL).Info("requesting video size")
+
+	res, err := http.Head(videoInfo.VideoURL)
+	if err != nil {
+		return fmt.Errorf("error getting size of video %w", err)
+	}
+	res.Body.Close()
+	contentLength := utils.SafeParseInt64(res.Header.Get("Content-Length"), -1)
+	if contentLength == -1 {
+		err := fmt.Errorf("error calculating size of video")
+		log.WithField("contentLength", contentLength).Error(err)
+		return err
+	}
+	if contentLength > a.Config.Server.MaxUploadSize {
+		err := fmt.Errorf(
+			"imported video would exceed maximum upload size of %s",
+			humanize.Bytes(uint64(a.Config.Server.MaxUploadSize)),
+		)
+		log.
+			WithField("contentLength", contentLength).
+			WithField("max_upload_size", a.Config.Server.MaxUploadSize).
+			Error(err)
+		return permanent(err)
+	}
+
+	log.WithField("contentLength", contentLength).Info("downloading video")
+
+	if err := utils.Download(videoInfo.VideoURL, uf.Name()); err != nil {
+		return fmt.Errorf("error downloading video %s: %w", job.URL, err)
+	}
+
+	tf, err := ioutil.TempFile(
+		a.Config.Server.UploadPath,
+		"tube-transcode-*.mp4",
+	)
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for transcoding: %w", err)
+	}
+	tf.Close()
+	defer os.Remove(tf.Name())
+
+	thumb := fmt.Sprintf("%s.jpg", strings.TrimSuffix(tf.Name(), filepath.Ext(tf.Name())))
+	defer os.Remove(thumb)
+
+	if err := utils.Download(videoInfo.ThumbnailURL, thumb); err != nil {
+		return fmt.Errorf("error downloading thumbnail: %w", err)
+	}
+
+	if err := a.transcode(job, p, uf.Name(), tf.Name(), job.Title, job.Description); err != nil {
+		return err
+	}
+
+	name, err := a.videoName(p, "")
+	if err != nil {
+		return err
+	}
+	vf, err := a.publishPath(job, p, name)
+	if err != nil {
+		return err
+	}
+
+	if err := writeMetadata(job, vf); err != nil {
+		return err
+	}
+	if err := publish(tf.Name(), thumb, vf); err != nil {
+		return err
+	}
+	a.Jobs.Update(job, func(job *Job) { job.Video = vf })
+
+	return a.renditions(job, p, vf)
+}
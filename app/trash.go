@@ -0,0 +1,464 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"git.mills.io/prologic/tube/media"
+
+	"github.com/gorilla/mux"
+	shortuuid "github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// trashPurgeInterval is how often expired entries are purged from the trash.
+const trashPurgeInterval = time.Hour
+
+// errVideoExists is returned when restoring a video whose file exists again.
+var errVideoExists = errors.New("video already exists")
+
+// sidecarExtensions are the extensions of the sidecar files of a video.
+var sidecarExtensions = []string{".jpg", ".yml", ".probe.json"}
+
+// TrashEntry is a deleted video whose files were moved to the trash, so
+// that it can be restored until the entry expires.
+type TrashEntry struct {
+	ID    string `json:"id"`
+	Video string `json:"video"`
+	Title string `json:"title"`
+	// Owner is the owner of the video, who may restore or purge it.
+	Owner string `json:"owner,omitempty"`
+	// Library is the library path the video was deleted from, and Name the
+	// name of its file relative to it.
+	Library string `json:"library"`
+	Name    string `json:"name"`
+	// Files are the names of the files moved from the Storage of the
+	// library path, and Sidecars those moved from its Sidecars storage.
+	Files    []string  `json:"files"`
+	Sidecars []string  `json:"sidecars,omitempty"`
+	Deleted  time.Time `json:"deleted"`
+}
+
+// Trash keeps the files of deleted videos in a directory for the configured
+// retention period.
+type Trash struct {
+	cfg   *TrashConfig
+	store Store
+}
+
+// newTrash returns a new Trash with the given settings.
+func newTrash(cfg *TrashConfig, store Store) *Trash {
+	return &Trash{cfg: cfg, store: store}
+}
+
+// dir returns the directory the files of the trash entry id are kept in.
+func (t *Trash) dir(id string) string {
+	return filepath.Join(t.cfg.Path, id)
+}
+
+// Start creates the trash directory and periodically purges expired entries.
+func (t *Trash) Start() error {
+	if err := os.MkdirAll(t.cfg.Path, 0o755); err != nil {
+		return fmt.Errorf("error creating trash %s: %w", t.cfg.Path, err)
+	}
+	t.purge()
+	go func() {
+		for range time.Tick(trashPurgeInterval) {
+			t.purge()
+		}
+	}()
+	return nil
+}
+
+// purge removes the entries older than the configured retention.
+func (t *Trash) purge() {
+	retention := time.Duration(t.cfg.Retention) * time.Hour
+	if retention <= 0 {
+		return
+	}
+	entries, err := t.store.ListTrash()
+	if err != nil {
+		log.WithError(err).Error("error listing trash")
+		return
+	}
+	for _, entry := range entries {
+		if time.Since(entry.Deleted) > retention {
+			if err := t.Remove(entry.ID); err != nil {
+				log.WithError(err).WithField("entry", entry.ID).Warn("error purging expired trash entry")
+			}
+		}
+	}
+}
+
+// Remove permanently deletes the trash entry id and its files.
+func (t *Trash) Remove(id string) error {
+	if err := os.RemoveAll(t.dir(id)); err != nil {
+		return fmt.Errorf("error removing trash entry files: %w", err)
+	}
+	return t.store.DeleteTrash(id)
+}
+
+// videoFiles returns the names of the files of the video named name in the
+// Storage s: the video itself, its renditions, HLS/DASH files and sidecars.
+// The video is always last.
+func videoFiles(s media.Storage, name string) ([]string, error) {
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	dir := path.Dir(name)
+	if dir == "." {
+		dir = ""
+	}
+
+	siblings, err := s.List(dir, false)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	var files []string
+	for _, f := range siblings {
+		if f.Name != name && (strings.HasPrefix(f.Name, stem+"#") || isSidecar(stem, f.Name)) {
+			files = append(files, f.Name)
+		}
+	}
+	for _, d := range []string{hlsDir(name), dashDir(name)} {
+		stream, err := s.List(d, true)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, f := range stream {
+			files = append(files, f.Name)
+		}
+	}
+	return append(files, name), nil
+}
+
+// sidecarFiles returns the names of the sidecar files of the video named
+// name in the Storage s.
+func sidecarFiles(s media.Storage, name string) []string {
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	var files []string
+	for _, ext := range sidecarExtensions {
+		if _, err := s.Stat(stem + ext); err == nil {
+			files = append(files, stem+ext)
+		}
+	}
+	return files
+}
+
+func isSidecar(stem, name string) bool {
+	for _, ext := range sidecarExtensions {
+		if name == stem+ext {
+			return true
+		}
+	}
+	return false
+}
+
+// moveOut moves the named file of s to the local file dst.
+func moveOut(s media.Storage, name, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	if fp, ok := media.LocalPath(s, name); ok {
+		if err := os.Rename(fp, dst); err == nil {
+			return nil
+		}
+	}
+	r, err := s.OpenRange(name, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return s.Delete(name)
+}
+
+// moveIn moves the local file src to the named file of s.
+func moveIn(s media.Storage, name, src string) error {
+	if fp, ok := media.LocalPath(s, name); ok {
+		if err := os.MkdirAll(filepath.Dir(fp), 0o755); err != nil {
+			return err
+		}
+		if err := os.Rename(src, fp); err == nil {
+			return nil
+		}
+	}
+	if err := storeFile(s, name, src); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// removeStreamDirs removes the (empty) local HLS/DASH directories of the
+// video named name.
+func removeStreamDirs(s media.Storage, name string) {
+	for _, d := range []string{hlsDir(name), dashDir(name)} {
+		if fp, ok := media.LocalPath(s, d); ok {
+			os.Remove(fp)
+		}
+	}
+}
+
+// deleteVideo deletes the video m and all of its files, moving them to the
+// trash if it is enabled, and removes it from the library and the Store.
+// The returned TrashEntry is nil if the video was deleted permanently.
+func (a *App) deleteVideo(m *media.Video) (*TrashEntry, error) {
+	p := m.Location
+	if p.ReadOnly {
+		return nil, media.ErrReadOnly
+	}
+
+	files, err := videoFiles(p.Files(), m.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error listing files of %s: %w", m.ID, err)
+	}
+	var sidecars []string
+	if p.Sidecars != nil {
+		sidecars = sidecarFiles(p.Sidecars, m.Name)
+	}
+
+	var entry *TrashEntry
+	if a.Config.Trash.Enabled {
+		entry = &TrashEntry{
+			ID:      shortuuid.New(),
+			Video:   m.ID,
+			Title:   m.Title,
+			Owner:   m.Owner,
+			Library: p.Path,
+			Name:    m.Name,
+			Deleted: time.Now(),
+		}
+		err = a.trashFiles(entry, p, files, sidecars)
+		if len(entry.Files) > 0 || len(entry.Sidecars) > 0 {
+			if err := a.Store.PutTrash(entry); err != nil {
+				log.WithError(err).WithField("entry", entry.ID).Error("error storing trash entry")
+			}
+		}
+	} else {
+		err = deleteFiles(p, files, sidecars)
+	}
+	removeStreamDirs(p.Files(), m.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting %s: %w", m.ID, err)
+	}
+
+	a.Library.Remove(m.Path)
+	if err := a.Views.Delete(m.ID); err != nil {
+		log.WithError(err).WithField("id", m.ID).Warn("error deleting video data")
+	}
+	buildFeed(a)
+
+	log.WithField("id", m.ID).WithField("trashed", entry != nil).Info("deleted video")
+	return entry, nil
+}
+
+// trashFiles moves files (and sidecars) of the library path p to the trash,
+// recording them in entry as they are moved.
+func (a *App) trashFiles(entry *TrashEntry, p *media.Path, files, sidecars []string) error {
+	dir := a.Trash.dir(entry.ID)
+	for _, name := range sidecars {
+		if err := moveOut(p.Sidecars, name, filepath.Join(dir, "sidecars", filepath.FromSlash(name))); err != nil {
+			return err
+		}
+		entry.Sidecars = append(entry.Sidecars, name)
+	}
+	for _, name := range files {
+		if err := moveOut(p.Files(), name, filepath.Join(dir, "files", filepath.FromSlash(name))); err != nil {
+			return err
+		}
+		entry.Files = append(entry.Files, name)
+	}
+	return nil
+}
+
+// deleteFiles permanently deletes files (and sidecars) of the library path p.
+func deleteFiles(p *media.Path, files, sidecars []string) error {
+	for _, name := range sidecars {
+		if err := p.Sidecars.Delete(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	for _, name := range files {
+		if err := p.Files().Delete(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreVideo moves the files of the trash entry id back into its library
+// path and adds the video to the library again.
+func (a *App) restoreVideo(id string) (*TrashEntry, error) {
+	entry, err := a.Store.GetTrash(id)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := a.Library.Paths[entry.Library]
+	if !ok {
+		return nil, fmt.Errorf("restoring to invalid library path: %s", entry.Library)
+	}
+	if p.ReadOnly {
+		return nil, media.ErrReadOnly
+	}
+	if _, err := p.Files().Stat(entry.Name); err == nil {
+		return nil, fmt.Errorf("error restoring %s: %w", entry.Name, errVideoExists)
+	}
+
+	dir := a.Trash.dir(entry.ID)
+	if p.Sidecars != nil {
+		for _, name := range entry.Sidecars {
+			if err := moveIn(p.Sidecars, name, filepath.Join(dir, "sidecars", filepath.FromSlash(name))); err != nil {
+				return nil, fmt.Errorf("error restoring %s: %w", name, err)
+			}
+		}
+	}
+	// The video is restored last, so that it is complete once picked up.
+	for _, name := range entry.Files {
+		if err := moveIn(p.Files(), name, filepath.Join(dir, "files", filepath.FromSlash(name))); err != nil {
+			return nil, fmt.Errorf("error restoring %s: %w", name, err)
+		}
+	}
+
+	if err := a.Trash.Remove(entry.ID); err != nil {
+		log.WithError(err).WithField("entry", entry.ID).Warn("error removing restored trash entry")
+	}
+	if err := a.Library.Add(path.Join(p.Path, entry.Name)); err != nil {
+		return nil, fmt.Errorf("error adding restored video to library: %w", err)
+	}
+	buildFeed(a)
+
+	log.WithField("id", entry.Video).Info("restored video")
+	return entry, nil
+}
+
+// HTTP handler for DELETE /v/id
+func (a *App) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	m, ok := a.video(r, id)
+	if !ok {
+		http.Error(w, "Video Not Found", http.StatusNotFound)
+		return
+	}
+	if !a.canEdit(r, m.Owner) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	entry, err := a.deleteVideo(m)
+	if errors.Is(err, media.ErrReadOnly) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.WithError(err).WithField("id", id).Error("error deleting video")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if entry == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entry); err != nil {
+		log.WithError(err).WithField("id", id).Error("error encoding trash entry")
+	}
+}
+
+// HTTP handler for /trash
+// Lists the trash entries of the videos the user owns (every entry for
+// admins).
+func (a *App) trashHandler(w http.ResponseWriter, r *http.Request) {
+	all, err := a.Store.ListTrash()
+	if err != nil {
+		log.WithError(err).Error("error listing trash")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var entries []*TrashEntry
+	for _, entry := range all {
+		if a.canEdit(r, entry.Owner) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.After(entries[j].Deleted)
+	})
+	if entries == nil {
+		entries = []*TrashEntry{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		log.WithError(err).Error("error encoding trash")
+	}
+}
+
+// HTTP handler for POST /trash/id/restore and DELETE /trash/id
+func (a *App) trashEntryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	id := mux.Vars(r)["id"]
+
+	if entry, err := a.Store.GetTrash(id); err != nil {
+		http.Error(w, "Trash Entry Not Found", http.StatusNotFound)
+		return
+	} else if !a.canEdit(r, entry.Owner) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := a.Trash.Remove(id); err != nil {
+			log.WithError(err).WithField("entry", id).Error("error removing trash entry")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	entry, err := a.restoreVideo(id)
+	if errors.Is(err, media.ErrReadOnly) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if errors.Is(err, errVideoExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.WithError(err).WithField("entry", id).Error("error restoring video")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/v/%s", entry.Video))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entry); err != nil {
+		log.WithError(err).WithField("entry", id).Error("error encoding trash entry")
+	}
+}
@@ -0,0 +1,446 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// authModeBasic protects the routes changing the library with a single
+	// password, and authModeUsers with the roles of user accounts.
+	// authModeNone explicitly opens every route to everyone.
+	authModeBasic = "basic"
+	authModeUsers = "users"
+	authModeNone  = "none"
+
+	// sessionCookie is the name of the cookie holding the session token.
+	sessionCookie = "tube_session"
+	// minPasswordLength is the minimum length of passwords.
+	minPasswordLength = 8
+	// sessionPurgeInterval is how often expired sessions are purged.
+	sessionPurgeInterval = time.Hour
+)
+
+var (
+	errInvalidLogin = errors.New("invalid username or password")
+	errUserExists   = errors.New("user already exists")
+	errUserNotFound = errors.New("user not found")
+	errLastAdmin    = errors.New("there must be at least one admin")
+	errInvalidRole  = errors.New("invalid role")
+	errShortPass    = fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	errInvalidName  = errors.New("username must be 1-32 lower case letters, digits, '.', '_' or '-'")
+	errUserTaken    = errors.New("username taken by another account")
+
+	validUsername = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,31}$`)
+)
+
+// User is an account of a user of the users auth mode.
+type User struct {
+	Username string `json:"username"`
+	// PasswordHash is the bcrypt hash of the password of the user.
+	PasswordHash string          `json:"password_hash"`
+	Role         middleware.Role `json:"role"`
+	Created      time.Time       `json:"created"`
+	// Subject identifies the users who log in with OIDC (without a
+	// password) at their identity provider.
+	Subject string `json:"subject,omitempty"`
+}
+
+// Session is the login session of a user. Its ID is the SHA-256 hash of
+// the token held by the session cookie, so that the store doesn't hold
+// usable tokens.
+type Session struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Users manages the user accounts and their login sessions.
+type Users struct {
+	cfg   *AuthConfig
+	store Store
+
+	// mu serializes changes to the accounts, so that the last admin can't
+	// be removed by concurrent requests.
+	mu sync.Mutex
+}
+
+// newUsers returns a new Users with the given settings.
+func newUsers(cfg *AuthConfig, store Store) *Users {
+	return &Users{cfg: cfg, store: store}
+}
+
+// Start creates the first admin if there are no users yet, and
+// periodically purges expired sessions.
+func (u *Users) Start() error {
+	users, err := u.store.ListUsers()
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		password := os.Getenv("auth_password")
+		generated := password == ""
+		if generated {
+			password = randomToken()
+		}
+		if _, err := u.Create("admin", password, middleware.RoleAdmin); err != nil {
+			return fmt.Errorf("error creating admin user: %w", err)
+		}
+		if generated {
+			log.Warnf("Created user admin with password %s, change it at /login", password)
+		} else {
+			log.Info("Created user admin with the password of auth_password")
+		}
+	}
+
+	u.purge()
+	go func() {
+		for range time.Tick(sessionPurgeInterval) {
+			u.purge()
+		}
+	}()
+	return nil
+}
+
+// purge removes the expired sessions.
+func (u *Users) purge() {
+	sessions, err := u.store.ListSessions()
+	if err != nil {
+		log.WithError(err).Error("error listing sessions")
+		return
+	}
+	for _, session := range sessions {
+		if time.Now().After(session.Expires) {
+			if err := u.store.DeleteSession(session.ID); err != nil {
+				log.WithError(err).Warn("error purging expired session")
+			}
+		}
+	}
+}
+
+// randomToken returns a random URL safe token.
+func randomToken() string {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// hashToken returns the SHA-256 hash of the token, used as the ID of its
+// session. It is base64 encoded to fit the maximum key size of the store.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// hashPassword returns the bcrypt hash of the password.
+func hashPassword(password string) (string, error) {
+	if len(password) < minPasswordLength {
+		return "", errShortPass
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("error hashing password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// dummyHash returns a password hash compared against when logging in as
+// an unknown user.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte(randomToken()), bcrypt.DefaultCost)
+	return hash
+})
+
+// List returns the users, sorted by username.
+func (u *Users) List() ([]*User, error) {
+	users, err := u.store.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+	return users, nil
+}
+
+// Create adds the user username with the given password and role.
+func (u *Users) Create(username, password string, role middleware.Role) (*User, error) {
+	if !validUsername.MatchString(username) {
+		return nil, errInvalidName
+	}
+	if !role.Valid() {
+		return nil, errInvalidRole
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	existing, err := u.store.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, errUserExists
+	}
+	user := &User{
+		Username:     username,
+		PasswordHash: hash,
+		Role:         role,
+		Created:      time.Now(),
+	}
+	if err := u.store.PutUser(user); err != nil {
+		return nil, err
+	}
+	log.WithField("user", username).WithField("role", role).Info("created user")
+	return user, nil
+}
+
+// Update changes the password and/or role of the user username (leaving
+// those given empty unchanged). Changing the password logs the user out.
+func (u *Users) Update(username, password string, role middleware.Role) (*User, error) {
+	var hash string
+	if password != "" {
+		var err error
+		if hash, err = hashPassword(password); err != nil {
+			return nil, err
+		}
+	}
+	if role != "" && !role.Valid() {
+		return nil, errInvalidRole
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	user, err := u.store.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errUserNotFound
+	}
+	if role != "" && role != user.Role {
+		if user.Role == middleware.RoleAdmin {
+			if err := u.checkOtherAdmin(username); err != nil {
+				return nil, err
+			}
+		}
+		user.Role = role
+	}
+	if hash != "" {
+		user.PasswordHash = hash
+		if err := u.deleteSessions(username); err != nil {
+			return nil, err
+		}
+	}
+	if err := u.store.PutUser(user); err != nil {
+		return nil, err
+	}
+	log.WithField("user", username).WithField("role", user.Role).Info("updated user")
+	return user, nil
+}
+
+// Delete removes the user username and their API tokens, and logs them out.
+func (u *Users) Delete(username string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	user, err := u.store.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return errUserNotFound
+	}
+	if user.Role == middleware.RoleAdmin {
+		if err := u.checkOtherAdmin(username); err != nil {
+			return err
+		}
+	}
+	if err := u.deleteSessions(username); err != nil {
+		return err
+	}
+	if err := deleteTokens(u.store, username); err != nil {
+		return err
+	}
+	if err := u.store.DeleteUser(username); err != nil {
+		return err
+	}
+	log.WithField("user", username).Info("deleted user")
+	return nil
+}
+
+// checkOtherAdmin returns errLastAdmin unless there is an admin other than
+// the user username.
+func (u *Users) checkOtherAdmin(username string) error {
+	users, err := u.store.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if user.Username != username && user.Role == middleware.RoleAdmin {
+			return nil
+		}
+	}
+	return errLastAdmin
+}
+
+// deleteSessions removes the sessions of the user username.
+func (u *Users) deleteSessions(username string) error {
+	sessions, err := u.store.ListSessions()
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		if session.Username == username {
+			if err := u.store.DeleteSession(session.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Login checks the password of the user username and starts a session,
+// returning its token.
+func (u *Users) Login(username, password string) (string, *Session, error) {
+	user, err := u.store.GetUser(username)
+	if err != nil {
+		return "", nil, err
+	}
+	if user == nil {
+		// Compare anyway, so that unknown users take as long as known ones.
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return "", nil, errInvalidLogin
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return "", nil, errInvalidLogin
+	}
+	return u.startSession(user)
+}
+
+// startSession logs the user in, returning the token of their new session.
+func (u *Users) startSession(user *User) (string, *Session, error) {
+	token := randomToken()
+	now := time.Now()
+	session := &Session{
+		ID:       hashToken(token),
+		Username: user.Username,
+		Created:  now,
+		Expires:  now.Add(time.Duration(u.cfg.SessionTTL) * time.Hour),
+	}
+	if err := u.store.PutSession(session); err != nil {
+		return "", nil, err
+	}
+	log.WithField("user", user.Username).Info("user logged in")
+	return token, session, nil
+}
+
+// LoginExternal logs in the user username authenticated by an identity
+// provider as subject, creating their account on their first login and
+// updating its role to role on the following ones.
+func (u *Users) LoginExternal(username, subject string, role middleware.Role) (string, *Session, error) {
+	if !validUsername.MatchString(username) {
+		return "", nil, errInvalidName
+	}
+	if !role.Valid() {
+		return "", nil, errInvalidRole
+	}
+
+	u.mu.Lock()
+	user, err := u.store.GetUser(username)
+	if err == nil {
+		switch {
+		case user == nil:
+			user = &User{
+				Username: username,
+				Role:     role,
+				Created:  time.Now(),
+				Subject:  subject,
+			}
+			if err = u.store.PutUser(user); err == nil {
+				log.WithField("user", username).WithField("role", role).Info("created user")
+			}
+		case user.Subject != subject:
+			// Never log into local accounts, or those of other subjects.
+			err = errUserTaken
+		case user.Role != role:
+			if user.Role == middleware.RoleAdmin {
+				err = u.checkOtherAdmin(username)
+			}
+			if err == nil {
+				user.Role = role
+				err = u.store.PutUser(user)
+			}
+		}
+	}
+	u.mu.Unlock()
+	if err != nil {
+		return "", nil, err
+	}
+	return u.startSession(user)
+}
+
+// Role returns the role of the user username, or "" if there is no such
+// user.
+func (u *Users) Role(username string) middleware.Role {
+	user, err := u.store.GetUser(username)
+	if err != nil {
+		log.WithError(err).Warn("error getting user")
+		return ""
+	}
+	if user == nil {
+		return ""
+	}
+	return user.Role
+}
+
+// Logout ends the session of the token.
+func (u *Users) Logout(token string) error {
+	return u.store.DeleteSession(hashToken(token))
+}
+
+// Identify returns the user logged in with the session cookie of the
+// request r, or nil if there is none (or it expired).
+func (u *Users) Identify(r *http.Request) *middleware.Identity {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+	session, err := u.store.GetSession(hashToken(cookie.Value))
+	if err != nil {
+		log.WithError(err).Warn("error getting session")
+		return nil
+	}
+	if session == nil || time.Now().After(session.Expires) {
+		return nil
+	}
+	user, err := u.store.GetUser(session.Username)
+	if err != nil {
+		log.WithError(err).Warn("error getting user")
+		return nil
+	}
+	if user == nil {
+		return nil
+	}
+	return &middleware.Identity{Username: user.Username, Role: user.Role}
+}
@@ -0,0 +1,245 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.mills.io/prologic/tube/app/middleware"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestUsers(t *testing.T) *Users {
+	t.Helper()
+	return newUsers(&AuthConfig{Mode: authModeUsers, SessionTTL: 1}, newTestStore(t))
+}
+
+// sessionRequest returns a request made with the session cookie of token.
+func sessionRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+	return r
+}
+
+func TestUsersCreate(t *testing.T) {
+	u := newTestUsers(t)
+	if _, err := u.Create("alice", "password1", middleware.RoleEditor); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username, password string
+		role               middleware.Role
+		err                error
+	}{
+		{"bob", "password1", middleware.RoleViewer, nil},
+		{"alice", "password2", middleware.RoleViewer, errUserExists},
+		{"Carol", "password1", middleware.RoleViewer, errInvalidName},
+		{"carol@example.com", "password1", middleware.RoleViewer, errInvalidName},
+		{"", "password1", middleware.RoleViewer, errInvalidName},
+		{"carol", "short", middleware.RoleViewer, errShortPass},
+		{"carol", "password1", "owner", errInvalidRole},
+	}
+	for _, test := range tests {
+		_, err := u.Create(test.username, test.password, test.role)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Create(%q, %q, %q) error = %v, want %v", test.username, test.password, test.role, err, test.err)
+		}
+	}
+}
+
+func TestUsersLogin(t *testing.T) {
+	u := newTestUsers(t)
+	user, err := u.Create("alice", "correct horse", middleware.RoleUploader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cost, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil || cost != bcrypt.DefaultCost {
+		t.Errorf("password hash %q has cost %d, %v, want a bcrypt hash of cost %d", user.PasswordHash, cost, err, bcrypt.DefaultCost)
+	}
+
+	tests := []struct {
+		username, password string
+		err                error
+	}{
+		{"alice", "correct horse", nil},
+		{"alice", "correct horse ", errInvalidLogin},
+		{"alice", "Correct horse", errInvalidLogin},
+		{"alice", "", errInvalidLogin},
+		{"alice", user.PasswordHash, errInvalidLogin},
+		{"bob", "correct horse", errInvalidLogin},
+	}
+	for _, test := range tests {
+		token, session, err := u.Login(test.username, test.password)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Login(%q, %q) error = %v, want %v", test.username, test.password, err, test.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if session.ID != hashToken(token) || session.ID == token {
+			t.Errorf("session ID = %q, want the hash of the token %q", session.ID, token)
+		}
+		id := u.Identify(sessionRequest(token))
+		if id == nil || id.Username != "alice" || id.Role != middleware.RoleUploader {
+			t.Errorf("Identify = %+v, want alice the uploader", id)
+		}
+	}
+}
+
+func TestUsersSessions(t *testing.T) {
+	u := newTestUsers(t)
+	if _, err := u.Create("alice", "password1", middleware.RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// end ends the session of token, or leaves it open.
+		end   func(t *testing.T, token string)
+		valid bool
+	}{
+		{"open", func(t *testing.T, token string) {}, true},
+		{"unknown token", func(t *testing.T, token string) {
+			if err := u.Logout(token); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"expired", func(t *testing.T, token string) {
+			session, err := u.store.GetSession(hashToken(token))
+			if err != nil || session == nil {
+				t.Fatalf("GetSession = %v, %v", session, err)
+			}
+			session.Expires = time.Now().Add(-time.Second)
+			if err := u.store.PutSession(session); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"password changed", func(t *testing.T, token string) {
+			if _, err := u.Update("alice", "password2", ""); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := u.Update("alice", "password1", ""); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"role changed", func(t *testing.T, token string) {
+			if _, err := u.Update("alice", "", middleware.RoleUploader); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, session, err := u.Login("alice", "password1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ttl := time.Until(session.Expires); ttl <= 59*time.Minute || ttl > time.Hour {
+				t.Errorf("session expires in %s, want the session_ttl of 1 hour", ttl)
+			}
+			test.end(t, token)
+			if id := u.Identify(sessionRequest(token)); (id != nil) != test.valid {
+				t.Errorf("Identify = %+v, want a valid session: %v", id, test.valid)
+			}
+		})
+	}
+
+	// expired sessions are purged, the others kept: only the last one, as
+	// changing the password ended the previous ones
+	u.purge()
+	sessions, err := u.store.ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range sessions {
+		if time.Now().After(session.Expires) {
+			t.Errorf("expired session %s wasn't purged", session.ID)
+		}
+	}
+	if len(sessions) != 1 {
+		t.Errorf("%d sessions left, want 1", len(sessions))
+	}
+
+	if id := u.Identify(httptest.NewRequest(http.MethodGet, "/", nil)); id != nil {
+		t.Errorf("Identify without a cookie = %+v, want nil", id)
+	}
+}
+
+func TestUsersLastAdmin(t *testing.T) {
+	tests := []struct {
+		name string
+		// external is true if root logs in with OIDC, admins are the admins
+		// other than root, and change the change made to root.
+		external bool
+		admins   []string
+		change   func(u *Users) error
+		err      error
+	}{
+		{"delete", false, nil, func(u *Users) error { return u.Delete("root") }, errLastAdmin},
+		{"demote", false, nil, func(u *Users) error {
+			_, err := u.Update("root", "", middleware.RoleEditor)
+			return err
+		}, errLastAdmin},
+		{"change password", false, nil, func(u *Users) error {
+			_, err := u.Update("root", "password2", middleware.RoleAdmin)
+			return err
+		}, nil},
+		{"delete with another admin", false, []string{"ops"}, func(u *Users) error { return u.Delete("root") }, nil},
+		{"demote with another admin", false, []string{"ops"}, func(u *Users) error {
+			_, err := u.Update("root", "", middleware.RoleViewer)
+			return err
+		}, nil},
+		{"demote external", true, nil, func(u *Users) error {
+			_, _, err := u.LoginExternal("root", "subject-1", middleware.RoleViewer)
+			return err
+		}, errLastAdmin},
+		{"demote external with another admin", true, []string{"ops"}, func(u *Users) error {
+			_, _, err := u.LoginExternal("root", "subject-1", middleware.RoleViewer)
+			return err
+		}, nil},
+		{"delete viewer", false, nil, func(u *Users) error { return u.Delete("guest") }, nil},
+		{"delete unknown", false, nil, func(u *Users) error { return u.Delete("nobody") }, errUserNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u := newTestUsers(t)
+			if test.external {
+				if _, _, err := u.LoginExternal("root", "subject-1", middleware.RoleAdmin); err != nil {
+					t.Fatal(err)
+				}
+			} else if _, err := u.Create("root", "password1", middleware.RoleAdmin); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := u.Create("guest", "password1", middleware.RoleViewer); err != nil {
+				t.Fatal(err)
+			}
+			for _, admin := range test.admins {
+				if _, err := u.Create(admin, "password1", middleware.RoleAdmin); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := test.change(u); !errors.Is(err, test.err) {
+				t.Fatalf("error = %v, want %v", err, test.err)
+			}
+			admins := 0
+			users, err := u.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, user := range users {
+				if user.Role == middleware.RoleAdmin {
+					admins++
+				}
+			}
+			if admins == 0 {
+				t.Error("no admin left")
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package app
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"git.mills.io/prologic/tube/media"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Views counts the views of videos in memory, loading them from the Store
+// in batches as they're first needed and writing the changed counts back
+// to it periodically (and on Flush), so that counting a view doesn't read
+// and write the Store on every request.
+type Views struct {
+	store Store
+
+	mu    sync.Mutex
+	views map[string]int64
+	dirty map[string]bool
+}
+
+// newViews returns a new view counter backed by the Store store.
+func newViews(store Store) *Views {
+	return &Views{
+		store: store,
+		views: make(map[string]int64),
+		dirty: make(map[string]bool),
+	}
+}
+
+// Start periodically writes the changed view counts back to the Store,
+// every interval seconds.
+func (vs *Views) Start(interval int) {
+	go func() {
+		for range time.Tick(time.Duration(interval) * time.Second) {
+			if err := vs.Flush(); err != nil {
+				log.WithError(err).Error("error flushing views")
+			}
+		}
+	}()
+}
+
+// load reads the views of the videos ids not yet counted from the Store.
+// The caller must hold the lock.
+func (vs *Views) load(ids ...string) error {
+	var missing []string
+	for _, id := range ids {
+		if _, ok := vs.views[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	for _, id := range missing {
+		prefix := path.Dir(id)
+		if prefix == "." {
+			prefix = ""
+		}
+		if err := vs.store.Migrate(prefix, id); err != nil {
+			err := fmt.Errorf("error migrating store data: %w", err)
+			log.Warn(err)
+		}
+	}
+
+	views, err := vs.store.GetViewsBatch(missing)
+	if err != nil {
+		return err
+	}
+	for _, id := range missing {
+		vs.views[id] = views[id]
+	}
+	return nil
+}
+
+// Load sets the views of the videos of the playlist pl.
+func (vs *Views) Load(pl media.Playlist) {
+	ids := make([]string, len(pl))
+	for i, v := range pl {
+		ids[i] = v.ID
+	}
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if err := vs.load(ids...); err != nil {
+		err := fmt.Errorf("error retrieving views: %w", err)
+		log.Warn(err)
+	}
+	for _, v := range pl {
+		v.Views = vs.views[v.ID]
+	}
+}
+
+// Get returns the views of the video id.
+func (vs *Views) Get(id string) (int64, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if err := vs.load(id); err != nil {
+		return 0, fmt.Errorf("error retrieving views for %s: %w", id, err)
+	}
+	return vs.views[id], nil
+}
+
+// Inc counts a view of the video id.
+func (vs *Views) Inc(id string) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if err := vs.load(id); err != nil {
+		return fmt.Errorf("error retrieving views for %s: %w", id, err)
+	}
+	vs.views[id]++
+	vs.dirty[id] = true
+	return nil
+}
+
+// Delete forgets the views of the deleted video id, and deletes its data
+// from the Store.
+func (vs *Views) Delete(id string) error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	delete(vs.views, id)
+	delete(vs.dirty, id)
+	return vs.store.DeleteVideo(id)
+}
+
+// Flush writes the changed view counts back to the Store.
+func (vs *Views) Flush() error {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if len(vs.dirty) == 0 {
+		return nil
+	}
+	views := make(map[string]int64, len(vs.dirty))
+	for id := range vs.dirty {
+		views[id] = vs.views[id]
+	}
+	if err := vs.store.PutViewsBatch(views); err != nil {
+		return err
+	}
+	vs.dirty = make(map[string]bool)
+	log.WithField("videos", len(views)).Debug("flushed views")
+	return nil
+}
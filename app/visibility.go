@@ -0,0 +1,97 @@
+package app
+
+import (
+	"net/http"
+
+	"git.mills.io/prologic/tube/app/middleware"
+	"git.mills.io/prologic/tube/media"
+)
+
+// owns returns true if the user id (nil if anonymous) owns the video v, or
+// is an admin.
+func owns(id *middleware.Identity, v *media.Video) bool {
+	if id == nil {
+		return false
+	}
+	return (v.Owner != "" && id.Username == v.Owner) || id.Role.Allows(middleware.RoleAdmin)
+}
+
+// owner returns the username of the user of the request r, who owns the
+// videos they upload or import, or "" if anonymous.
+func owner(r *http.Request) string {
+	if id := middleware.GetIdentity(r); id != nil {
+		return id.Username
+	}
+	return ""
+}
+
+// canFollowJob returns true if the user id (nil if anonymous) may follow the
+// job st: the user who queued it and admins. Without auth, jobs are queued
+// anonymously and anyone may follow them.
+func canFollowJob(id *middleware.Identity, st *JobStatus) bool {
+	if id == nil {
+		return st.Owner == ""
+	}
+	return id.Username == st.Owner || id.Role.Allows(middleware.RoleAdmin)
+}
+
+// canEdit returns true if the user of the request r may edit, delete and
+// restore the videos (and trash entries) owned by owner: editors those they
+// own, and admins any. Without a user, only if auth is disabled.
+func (a *App) canEdit(r *http.Request, owner string) bool {
+	id := middleware.GetIdentity(r)
+	if id == nil {
+		return a.authDisabled()
+	}
+	return (owner != "" && id.Username == owner) || id.Role.Allows(middleware.RoleAdmin)
+}
+
+// canView returns true if the user id (nil if anonymous) may watch the
+// video v: public and unlisted videos can be watched by anyone, private
+// ones only by their owner and admins.
+func canView(id *middleware.Identity, v *media.Video) bool {
+	return v.Visibility != media.Private || owns(reader(id), v)
+}
+
+// listed returns the videos of the playlist pl listed to the user id (nil
+// if anonymous): the public ones, and the unlisted and private ones they
+// own (or any, for admins).
+func listed(id *middleware.Identity, pl media.Playlist) media.Playlist {
+	id = reader(id)
+	return pl.Filter(func(v *media.Video) bool {
+		return v.Listed() || owns(id, v)
+	})
+}
+
+// reader returns the user id, or nil (anonymous) if they use an API token
+// without the read scope, which can't watch their unlisted and private
+// videos.
+func reader(id *middleware.Identity) *middleware.Identity {
+	if id != nil && !id.HasScope(middleware.ScopeRead) {
+		return nil
+	}
+	return id
+}
+
+// public returns the public videos of the playlist pl.
+func public(pl media.Playlist) media.Playlist {
+	return pl.Filter((*media.Video).Listed)
+}
+
+// video returns the video id of the library, if the user of the request r
+// may watch it (or it was made with a share link of the video). Videos they
+// may not watch are reported as not found, so as not to disclose their
+// existence.
+func (a *App) video(r *http.Request, id string) (*media.Video, bool) {
+	v, ok := a.Library.Videos[id]
+	if !ok {
+		return nil, false
+	}
+	if share := middleware.GetShare(r); share != nil && share.Video == id {
+		return v, true
+	}
+	if !canView(middleware.GetIdentity(r), v) {
+		return nil, false
+	}
+	return v, true
+}
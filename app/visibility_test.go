@@ -0,0 +1,64 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"git.mills.io/prologic/tube/app/middleware"
+)
+
+func TestCanFollowJob(t *testing.T) {
+	alice := &middleware.Identity{Username: "alice", Role: middleware.RoleUploader}
+	bob := &middleware.Identity{Username: "bob", Role: middleware.RoleEditor}
+	admin := &middleware.Identity{Username: "root", Role: middleware.RoleAdmin}
+
+	tests := []struct {
+		name  string
+		id    *middleware.Identity
+		owner string
+		want  bool
+	}{
+		{"owner", alice, "alice", true},
+		{"other user", bob, "alice", false},
+		{"admin", admin, "alice", true},
+		{"anonymous", nil, "alice", false},
+		{"anonymous job", nil, "", true},
+		{"anonymous job of a user", alice, "", false},
+	}
+	for _, test := range tests {
+		if got := canFollowJob(test.id, &JobStatus{Owner: test.owner}); got != test.want {
+			t.Errorf("%s: canFollowJob = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCanEdit(t *testing.T) {
+	alice := &middleware.Identity{Username: "alice", Role: middleware.RoleEditor}
+	admin := &middleware.Identity{Username: "root", Role: middleware.RoleAdmin}
+
+	tests := []struct {
+		name  string
+		mode  string
+		id    *middleware.Identity
+		owner string
+		want  bool
+	}{
+		{"owner", authModeUsers, alice, "alice", true},
+		{"other editor", authModeUsers, alice, "bob", false},
+		{"video without owner", authModeUsers, alice, "", false},
+		{"admin", authModeUsers, admin, "bob", true},
+		{"anonymous", authModeBasic, nil, "", false},
+		{"auth disabled", authModeNone, nil, "bob", true},
+	}
+	for _, test := range tests {
+		a := &App{Config: &Config{Auth: &AuthConfig{Mode: test.mode}}}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.id != nil {
+			r = middleware.WithIdentity(r, test.id)
+		}
+		if got := a.canEdit(r, test.owner); got != test.want {
+			t.Errorf("%s: canEdit = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
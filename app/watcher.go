@@ -1,8 +1,9 @@
 package app
 
 import (
+	iofs "io/fs"
+	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
 	fs "github.com/fsnotify/fsnotify"
@@ -22,6 +23,36 @@ const addFlags = fs.Create | fs.Write | fs.Chmod
 // remove, rename, write, and chmod all require a remove event
 const removeFlags = fs.Remove | fs.Rename | fs.Write | fs.Chmod
 
+// watch adds dir to the watched directories, along with its subdirectories
+// if it belongs to a recursive library path. It returns the videos found in
+// the subdirectories.
+func (a *App) watch(dir string) []string {
+	if err := a.Watcher.Add(dir); err != nil {
+		log.WithError(err).WithField("dir", dir).Warn("error watching library directory")
+	}
+	if !a.Library.Recursive(dir) {
+		return nil
+	}
+	var videos []string
+	filepath.WalkDir(dir, func(fp string, d iofs.DirEntry, err error) error {
+		if err != nil || fp == dir {
+			return nil
+		}
+		if d.IsDir() {
+			if !a.Library.Recursive(fp) {
+				return filepath.SkipDir
+			}
+			if err := a.Watcher.Add(fp); err != nil {
+				log.WithError(err).WithField("dir", fp).Warn("error watching library directory")
+			}
+		} else if a.Library.Accepts(fp) {
+			videos = append(videos, fp)
+		}
+		return nil
+	})
+	return videos
+}
+
 // watch library paths and update Library with changes.
 func startWatcher(a *App) {
 	timer := time.NewTimer(debounceTimeout)
@@ -30,7 +61,23 @@ func startWatcher(a *App) {
 	for {
 		select {
 		case e := <-a.Watcher.Events:
-			if strings.ContainsAny(e.Name, "#") || filepath.Ext(e.Name) != ".mp4" {
+			if e.Op&fs.Create != 0 && a.Library.Recursive(e.Name) {
+				if fi, err := os.Stat(e.Name); err == nil && fi.IsDir() {
+					// Videos may have been moved into the new directory
+					// before it was watched.
+					for _, fp := range a.watch(e.Name) {
+						addEvents[fp] = struct{}{}
+					}
+					timer.Reset(debounceTimeout)
+					continue
+				}
+			}
+			if !a.Library.Accepts(e.Name) {
+				// A removed (or renamed) directory removes all its videos
+				if e.Op&(fs.Remove|fs.Rename) != 0 {
+					removeEvents[e.Name] = struct{}{}
+					timer.Reset(debounceTimeout)
+				}
 				continue
 			}
 			log.Debugf("fsnotify event: %s", e)
@@ -4,6 +4,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 	flag "github.com/spf13/pflag"
@@ -57,6 +59,17 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Write back pending view counts and close the store when stopped.
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-sigs
+		log.Infof("Received %s, shutting down", sig)
+		if err := a.Close(); err != nil {
+			log.WithError(err).Error("error closing store")
+		}
+		os.Exit(0)
+	}()
 	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
 	log.Printf("Local server: http://%s", addr)
 	err = a.Run()
@@ -0,0 +1,55 @@
+package media
+
+import (
+	"fmt"
+	"time"
+)
+
+// Index persists the metadata of the videos of a Library, so that files
+// that haven't changed since they were indexed aren't parsed again (e.g: on
+// startup).
+type Index interface {
+	// GetIndexed returns the entry of the video file at path, or nil if
+	// the file isn't indexed.
+	GetIndexed(path string) (*IndexEntry, error)
+	PutIndexed(entry *IndexEntry) error
+	DeleteIndexed(path string) error
+	// IndexedPaths returns the paths of every indexed video file.
+	IndexedPaths() ([]string, error)
+}
+
+// indexVersion is the version of the IndexEntry format, to be incremented
+// whenever the parsing of videos changes so that they are parsed again.
+const indexVersion = 3
+
+// IndexEntry is the indexed metadata of a video file, valid as long as the
+// size and modification time of the file and of its .yml sidecar are
+// unchanged.
+type IndexEntry struct {
+	Version  int       `json:"version,omitempty"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Sidecar  string    `json:"sidecar,omitempty"`
+	Video    *Video    `json:"video"`
+}
+
+// sidecarStamp identifies the version of the .yml sidecar of the video
+// named name of the library path p, or is empty if it has none.
+func sidecarStamp(p *Path, name string) string {
+	fi, err := p.StatSidecar(ymlFile(name))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", fi.Size, fi.ModTime.UnixNano())
+}
+
+// valid returns true if the entry is still valid for the file fi with the
+// given sidecar stamp.
+func (e *IndexEntry) valid(fi *FileInfo, sidecar string) bool {
+	return e.Video != nil &&
+		e.Version == indexVersion &&
+		e.Size == fi.Size &&
+		e.Modified.Equal(fi.ModTime) &&
+		e.Sidecar == sidecar
+}
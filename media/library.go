@@ -3,6 +3,7 @@ package media
 import (
 	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
 	log "github.com/sirupsen/logrus"
 	"os"
@@ -17,6 +18,9 @@ type Library struct {
 	mu     sync.RWMutex
 	Paths  map[string]*Path
 	Videos map[string]*Video
+	// Index persists the metadata of parsed videos, if set.
+	Index Index
+	search *searchIndex
 }
 
 // NewLibrary returns new instance of Library.
@@ -24,6 +28,7 @@ func NewLibrary() *Library {
 	lib := &Library{
 		Paths:  make(map[string]*Path),
 		Videos: make(map[string]*Video),
+		search: newSearchIndex(),
 	}
 	return lib
 }
@@ -41,7 +46,7 @@ func (lib *Library) AddPath(p *Path) error {
 			return errors.New(fmt.Sprintf("media: duplicate library prefix '%s'", p.Prefix))
 		}
 	}
-	if _, err := os.Stat(p.Path) ; err != nil && os.IsNotExist(err) {
+	if _, err := os.Stat(p.Path) ; p.Local() && !p.ReadOnly && err != nil && os.IsNotExist(err) {
 		log.Warn(fmt.Sprintf("media: library path '%s' does not exist. Creating it now.", p.Path))
 		if err := os.MkdirAll(p.Path, 0o755); err != nil {
 			return fmt.Errorf("error creating library path %s: %w", p.Path, err)
@@ -51,15 +56,49 @@ func (lib *Library) AddPath(p *Path) error {
 	return nil
 }
 
-// Import adds all valid videos from a given path.
+// Import adds all valid videos from a given path (and its subdirectories
+// if the path is recursive).
 func (lib *Library) Import(p *Path) error {
+	if !p.Local() {
+		files, err := p.Files().List("", p.Recursive)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if p.Accepts(path.Base(f.Name)) {
+				// Ignore files that can't be parsed (or are in skipped
+				// directories)
+				lib.Add(path.Join(p.Path, f.Name))
+			}
+		}
+		return nil
+	}
+	if p.Recursive {
+		return filepath.WalkDir(p.Path, func(fp string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if fp != p.Path && p.Skips(d.Name()) {
+					// ignore HLS/DASH directories e.g: #hls
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if p.Accepts(d.Name()) {
+				// Ignore files that can't be parsed
+				lib.Add(fp)
+			}
+			return nil
+		})
+	}
 	files, err := ioutil.ReadDir(p.Path)
 	if err != nil {
 		return err
 	}
 	for _, info := range files {
-		if strings.ContainsAny(info.Name(), "#") {
-			// ignore resized videos e.g: #240p.mp4
+		if info.IsDir() || !p.Accepts(info.Name()) {
+			// ignore other files and resized videos e.g: #240p.mp4
 			continue
 		}
 		err = lib.Add(path.Join(p.Path, info.Name()))
@@ -71,50 +110,172 @@ func (lib *Library) Import(p *Path) error {
 	return nil
 }
 
-// Add adds a single video from a given file path.
-func (lib *Library) Add(fp string) error {
-	lib.mu.Lock()
-	defer lib.mu.Unlock()
+// lookup returns the library path the file at fp belongs to and the name
+// of the file relative to it. Files in subdirectories only belong to
+// recursive paths.
+func (lib *Library) lookup(fp string) (*Path, string, bool) {
 	fp = filepath.ToSlash(fp)
-	d := path.Dir(fp)
-	p, ok := lib.Paths[d]
+	if p, ok := lib.Paths[path.Dir(fp)]; ok {
+		return p, path.Base(fp), true
+	}
+	var (
+		found *Path
+		name  string
+	)
+	for _, p := range lib.Paths {
+		if !p.Recursive || !strings.HasPrefix(fp, p.Path+"/") {
+			continue
+		}
+		// the most specific path wins
+		if found == nil || len(p.Path) > len(found.Path) {
+			found = p
+			name = strings.TrimPrefix(fp, p.Path+"/")
+		}
+	}
+	if found == nil {
+		return nil, "", false
+	}
+	for _, dir := range strings.Split(path.Dir(name), "/") {
+		if found.Skips(dir) {
+			return nil, "", false
+		}
+	}
+	return found, name, true
+}
+
+// Add adds a single video from a given file path. Videos are loaded from
+// the Index if they haven't changed since they were indexed, otherwise they
+// are parsed and indexed. The file is parsed (and probed) without holding
+// the library lock, which is only taken to insert the video.
+func (lib *Library) Add(fp string) error {
+	lib.mu.RLock()
+	p, n, ok := lib.lookup(fp)
+	lib.mu.RUnlock()
 	if !ok {
 		return errors.New("media: path not found")
 	}
-	n := path.Base(fp)
+	fp = path.Join(p.Path, n)
+
+	var (
+		fi      *FileInfo
+		sidecar string
+	)
+	if lib.Index != nil {
+		var err error
+		if fi, err = p.Files().Stat(n); err != nil {
+			return err
+		}
+		sidecar = sidecarStamp(p, n)
+		entry, err := lib.Index.GetIndexed(fp)
+		if err != nil {
+			log.WithError(err).Warn("media: error reading index entry of ", fp)
+		} else if entry != nil && entry.valid(fi, sidecar) {
+			v := entry.Video
+			v.Location = p
+			v.Name = n
+			lib.insert(v)
+			log.Debug("Added (indexed):", v.Path)
+			return nil
+		}
+	}
+
 	v, err := ParseVideo(p, n)
 	if err != nil {
 		return err
 	}
-	lib.Videos[v.ID] = v
+	lib.insert(v)
 	log.Debug("Added:", v.Path)
+
+	if lib.Index != nil {
+		err := lib.Index.PutIndexed(&IndexEntry{
+			Version:  indexVersion,
+			Path:     fp,
+			Size:     fi.Size,
+			Modified: fi.ModTime,
+			Sidecar:  sidecar,
+			Video:    v,
+		})
+		if err != nil {
+			log.WithError(err).Warn("media: error indexing ", fp)
+		}
+	}
 	return nil
 }
 
-// Remove removes a single video from a given file path.
-func (lib *Library) Remove(fp string) {
+// insert adds the video v to the library, replacing any video with the
+// same ID.
+func (lib *Library) insert(v *Video) {
 	lib.mu.Lock()
 	defer lib.mu.Unlock()
-	fp = filepath.ToSlash(fp)
-	d := path.Dir(fp)
-	p, ok := lib.Paths[d]
-	if !ok {
-		return
+	lib.Videos[v.ID] = v
+	lib.search.add(v)
+}
+
+// PruneIndex removes the entries of the Index whose videos are no longer
+// part of the library (e.g: files deleted while tube wasn't running).
+func (lib *Library) PruneIndex() error {
+	if lib.Index == nil {
+		return nil
 	}
-	n := path.Base(fp)
-	// ID is name without extension
-	idx := strings.LastIndex(n, ".")
-	if idx == -1 {
-		idx = len(n)
+	lib.mu.RLock()
+	known := make(map[string]bool, len(lib.Videos))
+	for _, v := range lib.Videos {
+		known[v.Path] = true
+	}
+	lib.mu.RUnlock()
+
+	paths, err := lib.Index.IndexedPaths()
+	if err != nil {
+		return err
+	}
+	for _, fp := range paths {
+		if !known[fp] {
+			if err := lib.Index.DeleteIndexed(fp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Accepts returns true if the file at fp is a video of one of the library
+// paths.
+func (lib *Library) Accepts(fp string) bool {
+	lib.mu.RLock()
+	defer lib.mu.RUnlock()
+	p, n, ok := lib.lookup(fp)
+	if !ok {
+		return false
 	}
-	id := n[:idx]
-	if len(p.Prefix) > 0 {
-		id = path.Join(p.Prefix, id)
+	return p.Accepts(path.Base(n))
+}
+
+// Recursive returns true if the directory dir belongs to a recursive
+// library path, i.e: it must be watched and scanned for videos.
+func (lib *Library) Recursive(dir string) bool {
+	lib.mu.RLock()
+	defer lib.mu.RUnlock()
+	p, _, ok := lib.lookup(path.Join(filepath.ToSlash(dir), "_"))
+	return ok && p.Recursive && !p.Skips(path.Base(dir))
+}
+
+// Remove removes a single video from a given file path, or every video
+// below it if it was a directory.
+func (lib *Library) Remove(fp string) {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	fp = filepath.ToSlash(fp)
+	if p, n, ok := lib.lookup(fp); ok {
+		id := videoID(p, n)
+		v, ok := lib.Videos[id]
+		if ok && v.Path == fp {
+			lib.remove(v)
+		}
 	}
-	v, ok := lib.Videos[id]
-	if ok {
-		delete(lib.Videos, id)
-		log.Debug("Removed:", v.Path)
+	for _, v := range lib.Videos {
+		if strings.HasPrefix(v.Path, fp+"/") {
+			lib.remove(v)
+		}
 	}
 }
 
@@ -131,3 +292,27 @@ func (lib *Library) Playlist() Playlist {
 	By(SortByTimestamp).Sort(pl)
 	return pl
 }
+
+// Search returns the videos matching the query q, most relevant first,
+// restricted to the library path with the given prefix if not empty. Words
+// match any word starting with them (exact matches rank higher), and
+// quoted phrases must appear as is.
+func (lib *Library) Search(q, prefix string) Playlist {
+	// not RLock: the sorted words of the index are rebuilt lazily
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	return lib.search.search(q, prefix)
+}
+
+// remove removes the video v from the library and the Index. The caller
+// must hold lib.mu.
+func (lib *Library) remove(v *Video) {
+	delete(lib.Videos, v.ID)
+	lib.search.remove(v.ID)
+	log.Debug("Removed:", v.Path)
+	if lib.Index != nil {
+		if err := lib.Index.DeleteIndexed(v.Path); err != nil {
+			log.WithError(err).Warn("media: error removing index entry of ", v.Path)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package media
+
+import (
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// videoMimeTypes maps the extensions of common video containers to their
+// MIME types, as these are missing from most system MIME databases.
+var videoMimeTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".avi":  "video/x-msvideo",
+	".ogv":  "video/ogg",
+	".ts":   "video/mp2t",
+	".flv":  "video/x-flv",
+	".wmv":  "video/x-ms-wmv",
+}
+
+// ContentType returns the MIME type of the video file at pth based on its
+// extension.
+func ContentType(pth string) string {
+	ext := strings.ToLower(filepath.Ext(pth))
+	if t, ok := videoMimeTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
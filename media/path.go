@@ -1,8 +1,116 @@
 package media
 
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
 // Path represents a media library path.
 type Path struct {
 	Path                   string
 	Prefix                 string
 	PreserveUploadFilename bool
+	DASH                   bool
+	// Recursive paths include the videos of every subdirectory, with IDs
+	// derived from their path relative to Path, e.g: prefix/sub/dir/name
+	Recursive bool
+	// Extensions are the (lower case) extensions of the video files that
+	// are part of the library, e.g: .mp4
+	Extensions []string
+	// Storage stores the files of the path, the local directory Path if nil.
+	Storage Storage
+	// ReadOnly paths are never written to: writing or deleting any of their
+	// files fails with ErrReadOnly.
+	ReadOnly bool
+	// Sidecars stores the sidecar files generated for the videos of the
+	// path (e.g: thumbnails and probe caches) instead of Storage, if set.
+	Sidecars Storage
+}
+
+// Files returns the Storage of the path.
+func (p *Path) Files() Storage {
+	s := p.Storage
+	if s == nil {
+		s = NewLocalStorage(p.Path)
+	}
+	if p.ReadOnly {
+		return readOnlyStorage{s}
+	}
+	return s
+}
+
+// SidecarFiles returns the Storage sidecar files are written to, or nil if
+// sidecar files can't be written for the path (i.e: it is read-only and has
+// no separate Sidecars storage).
+func (p *Path) SidecarFiles() Storage {
+	if p.Sidecars != nil {
+		return p.Sidecars
+	}
+	if p.ReadOnly {
+		return nil
+	}
+	return p.Files()
+}
+
+// ReadSidecar reads the sidecar file named name from the Sidecars storage of
+// the path, falling back to its Storage.
+func (p *Path) ReadSidecar(name string) ([]byte, error) {
+	if p.Sidecars != nil {
+		data, err := ReadFile(p.Sidecars, name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return data, err
+		}
+	}
+	return ReadFile(p.Files(), name)
+}
+
+// StatSidecar returns the FileInfo of the sidecar file named name, from the
+// Sidecars storage of the path or from its Storage.
+func (p *Path) StatSidecar(name string) (*FileInfo, error) {
+	if p.Sidecars != nil {
+		fi, err := p.Sidecars.Stat(name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fi, err
+		}
+	}
+	return p.Files().Stat(name)
+}
+
+// Local returns true if the files of the path are stored in the local
+// directory Path.
+func (p *Path) Local() bool {
+	_, ok := localStorage(p.Files())
+	return ok
+}
+
+// Source returns the name of the local file, or a (presigned) URL, that
+// ffmpeg can read the file of the path named name from.
+func (p *Path) Source(name string) (string, error) {
+	if l, ok := localStorage(p.Files()); ok {
+		return l.path(name), nil
+	}
+	return p.Files().Presign(name, PresignExpiry)
+}
+
+// Accepts returns true if the file named name is a video of the library
+// path. Derived files (e.g: resized videos named name#240p.mp4) are not.
+func (p *Path) Accepts(name string) bool {
+	if strings.ContainsAny(name, "#") {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range p.Extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Skips returns true if the subdirectory named name is never scanned for
+// videos (e.g: HLS/DASH directories named name#hls or hidden directories).
+func (p *Path) Skips(name string) bool {
+	return strings.ContainsAny(name, "#") || strings.HasPrefix(name, ".")
 }
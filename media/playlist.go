@@ -1,11 +1,27 @@
 package media
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 type Playlist []*Video
 
+// Filter returns the videos of the playlist for which keep returns true.
+func (pl Playlist) Filter(keep func(v *Video) bool) Playlist {
+	res := make(Playlist, 0, len(pl))
+	for _, v := range pl {
+		if keep(v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
 // By is the type of a "less" function that defines the ordering of its Playlist arguments.
 type By func(v1, v2 *Video) bool
 
@@ -48,3 +64,81 @@ func SortByTimestamp(v1, v2 *Video) bool {
 func SortByViews(v1, v2 *Video) bool {
 	return v1.Views > v2.Views
 }
+
+// SortByDuration sorts the playlist by Duration (longest first)
+func SortByDuration(v1, v2 *Video) bool {
+	return v1.Duration > v2.Duration
+}
+
+// Key returns the value a playlist is sorted by (in descending order) for a
+// video, e.g: TimestampKey.
+type Key func(v *Video) int64
+
+// TimestampKey sorts playlists by Timestamp (newest first).
+func TimestampKey(v *Video) int64 { return v.Timestamp.UnixNano() }
+
+// ViewsKey sorts playlists by Views.
+func ViewsKey(v *Video) int64 { return v.Views }
+
+// DurationKey sorts playlists by Duration (longest first).
+func DurationKey(v *Video) int64 { return int64(v.Duration) }
+
+// SortBy sorts the playlist by descending key, then by ID, so that the
+// order is total and cursors are stable.
+func (pl Playlist) SortBy(key Key) {
+	By(func(v1, v2 *Video) bool {
+		k1, k2 := key(v1), key(v2)
+		if k1 != k2 {
+			return k1 > k2
+		}
+		return v1.ID < v2.ID
+	}).Sort(pl)
+}
+
+// Cursor is the position following a video in a playlist sorted with
+// SortBy: its key and ID.
+type Cursor struct {
+	Key int64
+	ID  string
+}
+
+// String returns the cursor as an opaque string.
+func (c *Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", c.Key, c.ID)))
+}
+
+// ParseCursor parses a cursor returned by Cursor.String.
+func ParseCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errors.New("media: invalid cursor")
+	}
+	key, id, ok := strings.Cut(string(data), ":")
+	if !ok {
+		return nil, errors.New("media: invalid cursor")
+	}
+	n, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return nil, errors.New("media: invalid cursor")
+	}
+	return &Cursor{Key: n, ID: id}, nil
+}
+
+// Page returns up to n videos of the playlist (sorted with SortBy by key)
+// following the cursor after (from the start if nil), and the cursor of the
+// next page, or nil if it is the last one.
+func (pl Playlist) Page(key Key, after *Cursor, n int) (Playlist, *Cursor) {
+	start := 0
+	if after != nil {
+		start = sort.Search(len(pl), func(i int) bool {
+			k := key(pl[i])
+			return k < after.Key || (k == after.Key && pl[i].ID > after.ID)
+		})
+	}
+	end := start + n
+	if end >= len(pl) {
+		return pl[start:], nil
+	}
+	last := pl[end-1]
+	return pl[start:end], &Cursor{Key: key(last), ID: last.ID}
+}
@@ -0,0 +1,164 @@
+package media
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.mills.io/prologic/tube/utils"
+)
+
+// probeTimeout is the no. of seconds ffprobe is permitted to run for.
+const probeTimeout = 60
+
+// ProbeInfo is the technical metadata of a media file as reported by ffprobe.
+type ProbeInfo struct {
+	Duration time.Duration `json:"duration"`
+	Width    int           `json:"width"`
+	Height   int           `json:"height"`
+	// Bitrate is the overall bitrate of the file in bits/s.
+	Bitrate    int64   `json:"bitrate"`
+	FrameRate  float64 `json:"frame_rate"`
+	VideoCodec string  `json:"video_codec"`
+	AudioCodec string  `json:"audio_codec"`
+	// Tags are the container metadata tags with lower case keys,
+	// e.g: title, comment
+	Tags map[string]string `json:"tags"`
+}
+
+type ffprobeOutput struct {
+	Format struct {
+		Duration string            `json:"duration"`
+		BitRate  string            `json:"bit_rate"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType    string `json:"codec_type"`
+		CodecName    string `json:"codec_name"`
+		AvgFrameRate string `json:"avg_frame_rate"`
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+	} `json:"streams"`
+}
+
+// Probe runs ffprobe on the media file (or URL) at pth.
+func Probe(pth string) (*ProbeInfo, error) {
+	out, err := utils.RunCmdOutput(
+		probeTimeout,
+		"ffprobe",
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		pth,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error probing %s: %w", pth, err)
+	}
+
+	var res ffprobeOutput
+	if err := json.Unmarshal(out, &res); err != nil {
+		return nil, fmt.Errorf("error decoding ffprobe output for %s: %w", pth, err)
+	}
+
+	info := &ProbeInfo{}
+	if seconds, err := strconv.ParseFloat(res.Format.Duration, 64); err == nil {
+		info.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	info.Bitrate = utils.SafeParseInt64(res.Format.BitRate, 0)
+	info.Tags = make(map[string]string, len(res.Format.Tags))
+	for k, v := range res.Format.Tags {
+		info.Tags[strings.ToLower(k)] = v
+	}
+	for _, s := range res.Streams {
+		switch {
+		case s.CodecType == "video" && info.VideoCodec == "":
+			info.VideoCodec = s.CodecName
+			info.FrameRate = parseFrameRate(s.AvgFrameRate)
+			info.Width = s.Width
+			info.Height = s.Height
+		case s.CodecType == "audio" && info.AudioCodec == "":
+			info.AudioCodec = s.CodecName
+		}
+	}
+
+	return info, nil
+}
+
+// parseFrameRate parses a frame rate reported by ffprobe as a fraction,
+// e.g: 30000/1001
+func parseFrameRate(s string) float64 {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		den = "1"
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// probeCache is the sidecar file caching the ProbeInfo of a media file,
+// valid as long as the file's size and modification time are unchanged.
+type probeCache struct {
+	Size     int64      `json:"size"`
+	Modified time.Time  `json:"modified"`
+	Info     *ProbeInfo `json:"info"`
+}
+
+// probeCacheFile returns the name of the sidecar file caching the ProbeInfo
+// of the media file named name.
+func probeCacheFile(name string) string {
+	return fmt.Sprintf("%s.probe.json", strings.TrimSuffix(name, path.Ext(name)))
+}
+
+// ProbeCached returns the ProbeInfo of the media file of the library path p
+// named name from its sidecar cache if it is still valid, otherwise it runs
+// ffprobe and updates the cache.
+func ProbeCached(p *Path, name string, fi *FileInfo) (*ProbeInfo, error) {
+	fn := probeCacheFile(name)
+	if data, err := p.ReadSidecar(fn); err == nil {
+		var cache probeCache
+		if err := json.Unmarshal(data, &cache); err == nil &&
+			cache.Info != nil &&
+			cache.Size == fi.Size &&
+			cache.Modified.Equal(fi.ModTime) {
+			return cache.Info, nil
+		}
+	}
+
+	src, err := p.Source(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := Probe(src)
+	if err != nil {
+		return nil, err
+	}
+
+	s := p.SidecarFiles()
+	if s == nil {
+		return info, nil
+	}
+	data, err := json.Marshal(&probeCache{
+		Size:     fi.Size,
+		Modified: fi.ModTime,
+		Info:     info,
+	})
+	if err == nil {
+		err = WriteFile(s, fn, data)
+	}
+	if err != nil {
+		log.Printf("Failed to write probe cache for %s: %s", name, err)
+	}
+	return info, nil
+}
@@ -0,0 +1,360 @@
+package media
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unsignedPayload is used as the payload hash of requests whose body is
+// streamed, so that it doesn't have to be read twice.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// emptyPayload is the SHA256 hash of an empty request body.
+const emptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Storage is a Storage backed by a bucket of an S3-compatible object
+// store (e.g: AWS S3 or MinIO). Requests are signed with AWS Signature
+// Version 4.
+type S3Storage struct {
+	// Endpoint is the URL of the object store, e.g: https://s3.amazonaws.com
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix is the key prefix of the files of the Storage in the bucket.
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// PathStyle addresses the bucket in the path of URLs rather than as a
+	// subdomain of the endpoint, as required by most S3-compatible stores.
+	PathStyle bool
+
+	client *http.Client
+}
+
+// NewS3Storage returns a new S3Storage.
+func NewS3Storage(endpoint, region, bucket, prefix, accessKey, secretKey string, pathStyle bool) (*S3Storage, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("media: invalid S3 endpoint %q", endpoint)
+	}
+	if bucket == "" {
+		return nil, fmt.Errorf("media: S3 bucket is required")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &S3Storage{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    region,
+		Bucket:    bucket,
+		Prefix:    prefix,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		PathStyle: pathStyle,
+		client:    &http.Client{},
+	}, nil
+}
+
+// key returns the object key of the named file.
+func (s *S3Storage) key(name string) string {
+	return s.Prefix + strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// url returns the URL of the object key (or of the bucket for an empty key).
+func (s *S3Storage) url(key string) *url.URL {
+	u, _ := url.Parse(s.Endpoint)
+	if s.PathStyle {
+		u.Path = "/" + s.Bucket + "/" + key
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = escapePath(u.Path)
+	return u
+}
+
+// escapePath URI encodes every byte of p except unreserved characters and
+// slashes, as required by Signature Version 4.
+func escapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// escapeQuery URI encodes a query string component for Signature Version 4.
+func escapeQuery(s string) string {
+	return strings.ReplaceAll(escapePath(s), "/", "%2F")
+}
+
+// canonicalQuery returns the query parameters sorted and encoded.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, escapeQuery(k)+"="+escapeQuery(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signature returns the scope of a request made at t and the signature of
+// its canonical request.
+func (s *S3Storage) signature(t time.Time, canonicalRequest string) (string, string) {
+	date := t.Format("20060102")
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.Format("20060102T150405Z"),
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// sign adds the Signature Version 4 Authorization header to req.
+func (s *S3Storage) sign(req *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := fmt.Sprintf(
+		"host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+		req.URL.Host, payloadHash, amzDate,
+	)
+	if r := req.Header.Get("Range"); r != "" {
+		headers = []string{"host", "range", "x-amz-content-sha256", "x-amz-date"}
+		canonicalHeaders = fmt.Sprintf(
+			"host:%s\nrange:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n",
+			req.URL.Host, r, payloadHash, amzDate,
+		)
+	}
+	signedHeaders := strings.Join(headers, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope, signature := s.signature(t, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+// do sends a signed request for the object key (or the bucket for an empty
+// key) and returns the response if its status is 2xx.
+func (s *S3Storage) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := s.url(key)
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	payloadHash := emptyPayload
+	if body != nil {
+		req.ContentLength = size
+		payloadHash = unsignedPayload
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("media: %s %s: %w", method, key, fs.ErrNotExist)
+	}
+	var s3err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+	if xml.Unmarshal(data, &s3err) == nil && s3err.Code != "" {
+		return nil, fmt.Errorf("media: %s %s: %s: %s", method, key, s3err.Code, s3err.Message)
+	}
+	return nil, fmt.Errorf("media: %s %s: %s", method, key, res.Status)
+}
+
+// List implements Storage.
+func (s *S3Storage) List(dir string, recursive bool) ([]FileInfo, error) {
+	prefix := s.Prefix
+	if dir = strings.Trim(path.Clean("/"+dir), "/"); dir != "" {
+		prefix += dir + "/"
+	}
+
+	var files []FileInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if !recursive {
+			query.Set("delimiter", "/")
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		res, err := s.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("media: error decoding S3 listing: %w", err)
+		}
+		for _, c := range result.Contents {
+			if strings.HasSuffix(c.Key, "/") {
+				// directory markers
+				continue
+			}
+			files = append(files, FileInfo{
+				Name:    strings.TrimPrefix(c.Key, s.Prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return files, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Stat implements Storage.
+func (s *S3Storage) Stat(name string) (*FileInfo, error) {
+	res, err := s.do(http.MethodHead, s.key(name), nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+	modtime, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return &FileInfo{Name: name, Size: res.ContentLength, ModTime: modtime}, nil
+}
+
+// OpenRange implements Storage.
+func (s *S3Storage) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	switch {
+	case length == 0:
+		return io.NopCloser(strings.NewReader("")), nil
+	case length > 0:
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	case offset > 0:
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	res, err := s.do(http.MethodGet, s.key(name), nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Write implements Storage.
+func (s *S3Storage) Write(name string, r io.Reader, size int64) error {
+	if size == 0 {
+		// net/http would otherwise treat the body as of unknown length
+		r = http.NoBody
+	}
+	res, err := s.do(http.MethodPut, s.key(name), nil, nil, r, size)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Delete implements Storage.
+func (s *S3Storage) Delete(name string) error {
+	res, err := s.do(http.MethodDelete, s.key(name), nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Presign implements Storage.
+func (s *S3Storage) Presign(name string, expires time.Duration) (string, error) {
+	return s.presign(name, expires, time.Now().UTC()), nil
+}
+
+func (s *S3Storage) presign(name string, expires time.Duration, t time.Time) string {
+	u := s.url(s.key(name))
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.AccessKey + "/" + t.Format("20060102") + "/" + s.Region + "/s3/aws4_request"},
+		"X-Amz-Date":          {t.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		canonicalQuery(query),
+		"host:" + u.Host + "\n",
+		"host",
+		unsignedPayload,
+	}, "\n")
+	_, signature := s.signature(t, canonicalRequest)
+	u.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + signature
+	return u.String()
+}
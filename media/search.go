@@ -0,0 +1,312 @@
+package media
+
+import (
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// BM25 ranking parameters
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+const (
+	// prefixWeight is the weight of words only matching a query word by
+	// prefix, relative to exact matches.
+	prefixWeight = 0.5
+	// phraseBoost is the boost of the words of a matched phrase.
+	phraseBoost = 1.5
+	// fieldGap separates the positions of the words of different fields,
+	// so that phrases never match across fields.
+	fieldGap = 100
+)
+
+// searchField is a searchable field of a video and its weight.
+type searchField struct {
+	text   string
+	weight float64
+}
+
+// searchFields returns the searchable fields of the video v.
+func searchFields(v *Video) []searchField {
+	return []searchField{
+		{v.Title, 3},
+		{strings.Join(v.Tags, " "), 2},
+		{v.Category, 2},
+		{v.Album, 1.5},
+		{v.Description, 1},
+		{strings.TrimSuffix(v.Name, path.Ext(v.Name)), 0.5},
+	}
+}
+
+// foldRune maps accented latin letters to their unaccented form, so that
+// e.g: "limon" finds "Limón".
+func foldRune(r rune) rune {
+	switch r {
+	case 'à', 'á', 'â', 'ã', 'ä', 'å':
+		return 'a'
+	case 'ç':
+		return 'c'
+	case 'è', 'é', 'ê', 'ë':
+		return 'e'
+	case 'ì', 'í', 'î', 'ï':
+		return 'i'
+	case 'ñ':
+		return 'n'
+	case 'ò', 'ó', 'ô', 'õ', 'ö', 'ø':
+		return 'o'
+	case 'ù', 'ú', 'û', 'ü':
+		return 'u'
+	case 'ý', 'ÿ':
+		return 'y'
+	}
+	return r
+}
+
+// tokenize splits s into lower case, unaccented words.
+func tokenize(s string) []string {
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for i, w := range words {
+		words[i] = strings.Map(func(r rune) rune {
+			return foldRune(unicode.ToLower(r))
+		}, w)
+	}
+	return words
+}
+
+// posting is the occurrences of a word in a video.
+type posting struct {
+	// freq is the frequency of the word weighted by the fields it is in.
+	freq      float64
+	positions []int
+}
+
+type searchDoc struct {
+	video  *Video
+	length float64
+	words  []string
+}
+
+// searchIndex is an inverted index of the searchable fields of videos,
+// mapping words to the videos they appear in. It isn't safe for concurrent
+// use: the Library guards it with its lock.
+type searchIndex struct {
+	docs     map[string]*searchDoc
+	postings map[string]map[string]*posting
+	// words is the sorted list of indexed words for prefix matching,
+	// rebuilt lazily after changes.
+	words  []string
+	length float64
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		docs:     make(map[string]*searchDoc),
+		postings: make(map[string]map[string]*posting),
+	}
+}
+
+// add indexes the video v, replacing the previous version of it.
+func (idx *searchIndex) add(v *Video) {
+	idx.remove(v.ID)
+	doc := &searchDoc{video: v}
+	pos := 0
+	for _, f := range searchFields(v) {
+		for _, w := range tokenize(f.text) {
+			ps, ok := idx.postings[w]
+			if !ok {
+				ps = make(map[string]*posting)
+				idx.postings[w] = ps
+				idx.words = nil
+			}
+			p, ok := ps[v.ID]
+			if !ok {
+				p = &posting{}
+				ps[v.ID] = p
+				doc.words = append(doc.words, w)
+			}
+			p.freq += f.weight
+			p.positions = append(p.positions, pos)
+			doc.length += f.weight
+			pos++
+		}
+		pos += fieldGap
+	}
+	idx.docs[v.ID] = doc
+	idx.length += doc.length
+}
+
+// remove removes the video with the given id from the index.
+func (idx *searchIndex) remove(id string) {
+	doc, ok := idx.docs[id]
+	if !ok {
+		return
+	}
+	for _, w := range doc.words {
+		delete(idx.postings[w], id)
+		if len(idx.postings[w]) == 0 {
+			delete(idx.postings, w)
+			idx.words = nil
+		}
+	}
+	delete(idx.docs, id)
+	idx.length -= doc.length
+}
+
+// expand returns the indexed words starting with w.
+func (idx *searchIndex) expand(w string) []string {
+	if idx.words == nil {
+		idx.words = make([]string, 0, len(idx.postings))
+		for word := range idx.postings {
+			idx.words = append(idx.words, word)
+		}
+		sort.Strings(idx.words)
+	}
+	var words []string
+	for i := sort.SearchStrings(idx.words, w); i < len(idx.words) && strings.HasPrefix(idx.words[i], w); i++ {
+		words = append(words, idx.words[i])
+	}
+	return words
+}
+
+// score returns the BM25 score of the word w for the video with the
+// given id.
+func (idx *searchIndex) score(w, id string) float64 {
+	ps := idx.postings[w]
+	p, ok := ps[id]
+	if !ok {
+		return 0
+	}
+	n := float64(len(idx.docs))
+	df := float64(len(ps))
+	idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+	avg := idx.length / n
+	norm := 1 - bm25B
+	if avg > 0 {
+		norm += bm25B * idx.docs[id].length / avg
+	}
+	return idf * p.freq * (bm25K1 + 1) / (p.freq + bm25K1*norm)
+}
+
+// searchClause is a word or a quoted phrase of a query.
+type searchClause struct {
+	words  []string
+	phrase bool
+}
+
+// parseQuery parses the query q into clauses. Quoted text is a phrase, and
+// words joined by punctuation (e.g: "all-hands") are phrases too.
+func parseQuery(q string) []searchClause {
+	var clauses []searchClause
+	for i, part := range strings.Split(q, `"`) {
+		if i%2 == 1 {
+			if words := tokenize(part); len(words) > 0 {
+				clauses = append(clauses, searchClause{words: words, phrase: true})
+			}
+			continue
+		}
+		for _, field := range strings.Fields(part) {
+			if words := tokenize(field); len(words) > 0 {
+				clauses = append(clauses, searchClause{words: words, phrase: len(words) > 1})
+			}
+		}
+	}
+	return clauses
+}
+
+// match returns the scores of the videos matching the clause c.
+func (idx *searchIndex) match(c searchClause) map[string]float64 {
+	scores := make(map[string]float64)
+	if !c.phrase {
+		w := c.words[0]
+		for _, word := range idx.expand(w) {
+			weight := 1.0
+			if word != w {
+				weight = prefixWeight
+			}
+			for id := range idx.postings[word] {
+				// a video matching several words scores as the best one
+				scores[id] = math.Max(scores[id], weight*idx.score(word, id))
+			}
+		}
+		return scores
+	}
+
+	for id, first := range idx.postings[c.words[0]] {
+		found := false
+		for _, start := range first.positions {
+			found = true
+			for i, w := range c.words[1:] {
+				p, ok := idx.postings[w][id]
+				if !ok || !hasPosition(p.positions, start+i+1) {
+					found = false
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			continue
+		}
+		for _, w := range c.words {
+			scores[id] += phraseBoost * idx.score(w, id)
+		}
+	}
+	return scores
+}
+
+// hasPosition returns true if the sorted positions contain pos.
+func hasPosition(positions []int, pos int) bool {
+	i := sort.SearchInts(positions, pos)
+	return i < len(positions) && positions[i] == pos
+}
+
+// search returns the videos matching every clause of the query q, most
+// relevant first, restricted to the library path with the given prefix if
+// not empty.
+func (idx *searchIndex) search(q, prefix string) Playlist {
+	clauses := parseQuery(q)
+	if len(clauses) == 0 {
+		return nil
+	}
+
+	var scores map[string]float64
+	for _, c := range clauses {
+		matches := idx.match(c)
+		if scores == nil {
+			scores = matches
+			continue
+		}
+		for id := range scores {
+			if s, ok := matches[id]; ok {
+				scores[id] += s
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	pl := make(Playlist, 0, len(scores))
+	for id := range scores {
+		v := idx.docs[id].video
+		if prefix != "" && (v.Location == nil || v.Location.Prefix != prefix) {
+			continue
+		}
+		pl = append(pl, v)
+	}
+	By(func(v1, v2 *Video) bool {
+		if scores[v1.ID] != scores[v2.ID] {
+			return scores[v1.ID] > scores[v2.ID]
+		}
+		return SortByTimestamp(v1, v2)
+	}).Sort(pl)
+	return pl
+}
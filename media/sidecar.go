@@ -0,0 +1,136 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dhowden/tag"
+	"gopkg.in/yaml.v3"
+)
+
+// ymlFile and thumbFile return the names of the metadata and thumbnail
+// sidecar files of the video named name.
+func ymlFile(name string) string {
+	return fmt.Sprintf("%s.yml", strings.TrimSuffix(name, path.Ext(name)))
+}
+
+func thumbFile(name string) string {
+	return fmt.Sprintf("%s.jpg", strings.TrimSuffix(name, path.Ext(name)))
+}
+
+// WriteMetadata writes the given fields (e.g: title and description) of the
+// video named name of the library path p to its .yml sidecar, keeping any
+// other key of an existing sidecar. Fields with empty values (empty strings
+// or Tags) are removed, so that the ones read from the video file are used
+// again.
+func WriteMetadata(p *Path, name string, changes map[string]interface{}) error {
+	s := p.SidecarFiles()
+	if s == nil {
+		return ErrReadOnly
+	}
+
+	tags := make(map[string]interface{})
+	data, err := p.ReadSidecar(ymlFile(name))
+	if err == nil {
+		if err := yaml.Unmarshal(data, &tags); err != nil {
+			return fmt.Errorf("error parsing %s: %w", ymlFile(name), err)
+		}
+		if tags == nil {
+			tags = make(map[string]interface{})
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	for key, value := range changes {
+		if isEmpty(value) {
+			delete(tags, key)
+		} else {
+			tags[key] = value
+		}
+	}
+
+	data, err = yaml.Marshal(tags)
+	if err != nil {
+		return err
+	}
+	return WriteFile(s, ymlFile(name), data)
+}
+
+// isEmpty returns true if the metadata field value is empty.
+func isEmpty(value interface{}) bool {
+	switch value := value.(type) {
+	case string:
+		return value == ""
+	case Tags:
+		return len(value) == 0
+	}
+	return value == nil
+}
+
+// WriteThumbnail writes the JPEG thumbnail of the video named name of the
+// library path p to its .jpg sidecar.
+func WriteThumbnail(p *Path, name string, data []byte) error {
+	s := p.SidecarFiles()
+	if s == nil {
+		return ErrReadOnly
+	}
+	return WriteFile(s, thumbFile(name), data)
+}
+
+// OpenThumbnail opens the thumbnail of the video v for reading: its .jpg
+// sidecar or else the picture embedded in the video file, which is written
+// to the .jpg sidecar (if possible) so that it is only extracted once. It
+// returns the modification time and MIME type of the thumbnail, and an
+// error wrapping fs.ErrNotExist if the video has none.
+func OpenThumbnail(v *Video) (io.ReadSeekCloser, time.Time, string, error) {
+	p := v.Location
+	for _, s := range []Storage{p.Sidecars, p.Files()} {
+		if s == nil {
+			continue
+		}
+		f, fi, err := Open(s, thumbFile(v.Name))
+		if err == nil {
+			return f, fi.ModTime, "image/jpeg", nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, time.Time{}, "", err
+		}
+	}
+
+	if v.EmbeddedThumb == "" {
+		return nil, time.Time{}, "", fmt.Errorf("media: %s has no thumbnail: %w", v.Path, fs.ErrNotExist)
+	}
+	f, _, err := Open(p.Files(), v.Name)
+	if err != nil {
+		return nil, time.Time{}, "", err
+	}
+	defer f.Close()
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		return nil, time.Time{}, "", fmt.Errorf("error reading tags of %s: %w", v.Path, err)
+	}
+	pic := m.Picture()
+	if pic == nil {
+		return nil, time.Time{}, "", fmt.Errorf("media: %s has no thumbnail: %w", v.Path, fs.ErrNotExist)
+	}
+	if v.EmbeddedThumb == "image/jpeg" && p.SidecarFiles() != nil {
+		if err := WriteThumbnail(p, v.Name, pic.Data); err != nil {
+			log.Printf("Failed to write thumbnail of %s: %s", v.Path, err)
+		}
+	}
+	return nopCloser{bytes.NewReader(pic.Data)}, v.Timestamp, v.EmbeddedThumb, nil
+}
+
+// nopCloser is an io.ReadSeekCloser over an io.ReadSeeker.
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,292 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// ErrPresignNotSupported is returned by Storage backends that cannot
+// generate URLs for their files.
+var ErrPresignNotSupported = errors.New("media: storage does not support presigned URLs")
+
+// ErrReadOnly is returned when writing to or deleting from a read-only
+// library path.
+var ErrReadOnly = errors.New("media: library path is read-only")
+
+// PresignExpiry is how long URLs generated for ffmpeg and clients are valid.
+const PresignExpiry = 6 * time.Hour
+
+// FileInfo describes a file in a Storage.
+type FileInfo struct {
+	// Name is the slash separated name of the file relative to the root of
+	// the Storage, e.g: sub/dir/name.mp4
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Storage is a backend storing the files of a library path. Files are
+// identified by slash separated names relative to the root of the Storage.
+// Errors for missing files wrap fs.ErrNotExist.
+type Storage interface {
+	// List returns the files in dir ("" for the root), including those of
+	// every subdirectory if recursive.
+	List(dir string, recursive bool) ([]FileInfo, error)
+	// Stat returns the FileInfo of the named file.
+	Stat(name string) (*FileInfo, error)
+	// OpenRange opens the named file for reading length bytes from offset,
+	// or until the end of the file if length is negative.
+	OpenRange(name string, offset, length int64) (io.ReadCloser, error)
+	// Write creates (or replaces) the named file with size bytes from r.
+	Write(name string, r io.Reader, size int64) error
+	// Delete removes the named file.
+	Delete(name string) error
+	// Presign returns a URL that can be used to read the named file
+	// without credentials until it expires.
+	Presign(name string, expires time.Duration) (string, error)
+}
+
+// Open opens the named file of s for reading and seeking, reading only the
+// ranges that are needed from backends other than LocalStorage.
+func Open(s Storage, name string) (io.ReadSeekCloser, *FileInfo, error) {
+	if l, ok := localStorage(s); ok {
+		f, err := os.Open(l.path(name))
+		if err != nil {
+			return nil, nil, err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return f, &FileInfo{Name: name, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+	}
+	fi, err := s.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &rangeReader{s: s, name: name, size: fi.Size}, fi, nil
+}
+
+// ReadFile reads the whole named file of s.
+func ReadFile(s Storage, name string) ([]byte, error) {
+	r, err := s.OpenRange(name, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// WriteFile writes data to the named file of s.
+func WriteFile(s Storage, name string, data []byte) error {
+	return s.Write(name, bytes.NewReader(data), int64(len(data)))
+}
+
+// LocalPath returns the local file the named file of s is stored in, if s
+// is (or wraps) a LocalStorage.
+func LocalPath(s Storage, name string) (string, bool) {
+	l, ok := localStorage(s)
+	if !ok {
+		return "", false
+	}
+	return l.path(name), true
+}
+
+// localStorage returns the LocalStorage s is (or wraps).
+func localStorage(s Storage) (*LocalStorage, bool) {
+	if ro, ok := s.(readOnlyStorage); ok {
+		s = ro.Storage
+	}
+	l, ok := s.(*LocalStorage)
+	return l, ok
+}
+
+// readOnlyStorage wraps the Storage of a read-only library path.
+type readOnlyStorage struct {
+	Storage
+}
+
+// Write implements Storage. It always fails with ErrReadOnly.
+func (readOnlyStorage) Write(name string, r io.Reader, size int64) error {
+	return ErrReadOnly
+}
+
+// Delete implements Storage. It always fails with ErrReadOnly.
+func (readOnlyStorage) Delete(name string) error {
+	return ErrReadOnly
+}
+
+// rangeReader is an io.ReadSeekCloser over a file of a Storage that opens
+// a new range of the file whenever it is seeked.
+type rangeReader struct {
+	s      Storage
+	name   string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.s.OpenRange(r.name, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("media: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("media: negative position %d", offset)
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *rangeReader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+	return nil
+}
+
+// LocalStorage is a Storage backed by a directory of the local filesystem.
+type LocalStorage struct {
+	Root string
+}
+
+// NewLocalStorage returns a new LocalStorage rooted at the directory root.
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+func (l *LocalStorage) path(name string) string {
+	return filepath.Join(l.Root, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+// List implements Storage.
+func (l *LocalStorage) List(dir string, recursive bool) ([]FileInfo, error) {
+	root := l.path(dir)
+	var files []FileInfo
+	err := filepath.WalkDir(root, func(fp string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if fp != root && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(l.Root, fp)
+		if err != nil {
+			return err
+		}
+		files = append(files, FileInfo{
+			Name:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+// Stat implements Storage.
+func (l *LocalStorage) Stat(name string) (*FileInfo, error) {
+	info, err := os.Stat(l.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return &FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// OpenRange implements Storage.
+func (l *LocalStorage) OpenRange(name string, offset, length int64) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if length < 0 {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+// Write implements Storage. The file is written to a temporary file first,
+// so that it only appears once complete.
+func (l *LocalStorage) Write(name string, r io.Reader, size int64) error {
+	fn := l.path(name)
+	if err := os.MkdirAll(filepath.Dir(fn), 0o755); err != nil {
+		return err
+	}
+	tf, err := os.CreateTemp(filepath.Dir(fn), ".tube-write-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+	if err := tf.Chmod(0o644); err != nil {
+		tf.Close()
+		return err
+	}
+	if _, err := io.Copy(tf, r); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tf.Name(), fn)
+}
+
+// Delete implements Storage.
+func (l *LocalStorage) Delete(name string) error {
+	return os.Remove(l.path(name))
+}
+
+// Presign implements Storage. Local files have no URL.
+func (l *LocalStorage) Presign(name string, expires time.Duration) (string, error) {
+	return "", ErrPresignNotSupported
+}
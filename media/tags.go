@@ -0,0 +1,72 @@
+package media
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Tags are the (normalized) tags of a video. In .yml sidecars they are
+// either a list or a comma separated string.
+type Tags []string
+
+// NormalizeTag returns the canonical form of the tag t: lower case, with
+// surrounding whitespace removed and inner whitespace collapsed.
+func NormalizeTag(t string) string {
+	return strings.ToLower(strings.Join(strings.Fields(t), " "))
+}
+
+// ParseTags parses a comma separated list of tags, dropping empty and
+// duplicate ones.
+func ParseTags(s string) Tags {
+	return newTags(strings.Split(s, ","))
+}
+
+func newTags(tags []string) Tags {
+	var res Tags
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		t = NormalizeTag(t)
+		if t != "" && !seen[t] {
+			seen[t] = true
+			res = append(res, t)
+		}
+	}
+	return res
+}
+
+// String returns the tags as a comma separated list.
+func (t Tags) String() string {
+	return strings.Join(t, ", ")
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (t *Tags) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*t = ParseTags(value.Value)
+		return nil
+	}
+	var tags []string
+	if err := value.Decode(&tags); err != nil {
+		return err
+	}
+	*t = newTags(tags)
+	return nil
+}
+
+// HasTag returns true if the video is tagged with the tag t.
+func (v *Video) HasTag(t string) bool {
+	t = NormalizeTag(t)
+	for _, tag := range v.Tags {
+		if tag == t {
+			return true
+		}
+	}
+	return false
+}
+
+// InCategory returns true if the video belongs to the category c (ignoring
+// case).
+func (v *Video) InCategory(c string) bool {
+	return v.Category != "" && strings.EqualFold(v.Category, strings.TrimSpace(c))
+}
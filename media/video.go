@@ -1,16 +1,15 @@
 package media
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"log"
-	"os"
 	"path"
 	"path/filepath"
 	"strings"
 	"time"
 
-	"git.mills.io/prologic/tube/utils"
 	"github.com/dhowden/tag"
 	"gopkg.in/yaml.v3"
 )
@@ -21,28 +20,46 @@ type Video struct {
 	Title       string
 	Album       string
 	Description string
-	Thumb       []byte
-	ThumbType   string
-	Modified    string
-	Size        int64
-	Path        string
-	Timestamp   time.Time
+	Tags        Tags
+	// Category defaults to the Album.
+	Category string
+	// Owner is the username of the user who uploaded or imported the video
+	// (if known), and Visibility who can see it.
+	Owner      string
+	Visibility Visibility
+	// EmbeddedThumb is the MIME type of the picture embedded in the video
+	// file (if any), used as thumbnail when there's no .jpg sidecar.
+	EmbeddedThumb string
+	Modified      string
+	Size          int64
+	Path          string
+	Timestamp     time.Time
+	// Location is the library path the video belongs to, and Name the name
+	// of its file relative to it.
+	Location *Path  `yaml:"-" json:"-"`
+	Name     string `yaml:"-"`
+
+	// Technical metadata reported by ffprobe (zero values when unknown)
+	Duration   time.Duration
+	Width      int
+	Height     int
+	VideoCodec string
+	AudioCodec string
+	Bitrate    int64
+	FrameRate  float64
 
 	Views int64
 }
 
 func getTagsFromYml(v *Video) error {
-	ymlFileName := fmt.Sprintf("%s.yml", strings.TrimSuffix(v.Path, filepath.Ext(v.Path)))
-	if !utils.FileExists(ymlFileName) {
+	data, err := v.Location.ReadSidecar(ymlFile(v.Name))
+	if errors.Is(err, fs.ErrNotExist) {
 		return nil
-	}
-
-	ymlFile, err := ioutil.ReadFile(ymlFileName)
-	if err != nil {
+	} else if err != nil {
 		return err
 	}
 
-	err = yaml.Unmarshal(ymlFile, v)
+	err = yaml.Unmarshal(data, v)
 	if err != nil {
 		return err
 	}
@@ -51,72 +68,98 @@ func getTagsFromYml(v *Video) error {
 	return nil
 }
 
+// videoID returns the ID of the video file named name (relative to the
+// library path p): its name without extension, prepended with the prefix.
+func videoID(p *Path, name string) string {
+	id := strings.TrimSuffix(name, path.Ext(name))
+	if len(p.Prefix) > 0 {
+		// if there's a prefix prepend it to the ID
+		id = path.Join(p.Prefix, id)
+	}
+	return id
+}
+
 // ParseVideo parses a video file's metadata and returns a Video.
 func ParseVideo(p *Path, name string) (*Video, error) {
 	pth := path.Join(p.Path, name)
-	f, err := os.Open(pth)
+	f, info, err := Open(p.Files(), name)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	info, err := f.Stat()
-	if err != nil {
-		return nil, err
-	}
-	size := info.Size()
-	timestamp := info.ModTime()
+	size := info.Size
+	timestamp := info.ModTime
 	modified := timestamp.Format("2006-01-02 03:04 PM")
-	// ID is name without extension
-	idx := strings.LastIndex(name, ".")
-	if idx == -1 {
-		idx = len(name)
-	}
-	id := name[:idx]
-	if len(p.Prefix) > 0 {
-		// if there's a prefix prepend it to the ID
-		id = path.Join(p.Prefix, name[:idx])
-	}
-	m, err := tag.ReadFrom(f)
-	if err != nil {
-		return nil, err
+	id := videoID(p, name)
+	var title, album, description string
+	var pic *tag.Picture
+	var probe *ProbeInfo
+	if m, err := tag.ReadFrom(f); err == nil {
+		title = m.Title()
+		album = m.Album()
+		description = m.Comment()
+		pic = m.Picture()
+	} else {
+		// Fallback to ffprobe for containers tag can't parse (e.g: MKV)
+		probe, err = ProbeCached(p, name, info)
+		if err != nil {
+			return nil, fmt.Errorf("error reading tags of %s: %w", pth, err)
+		}
+		title = probe.Tags["title"]
+		album = probe.Tags["album"]
+		description = probe.Tags["comment"]
+		if description == "" {
+			description = probe.Tags["description"]
+		}
 	}
-	title := m.Title()
 	// Default title is filename
 	if title == "" {
-		title = strings.TrimSuffix(name, filepath.Ext(name))
+		title = strings.TrimSuffix(path.Base(name), filepath.Ext(name))
 	}
 	v := &Video{
 		ID:          id,
 		Title:       title,
-		Album:       m.Album(),
-		Description: m.Comment(),
+		Album:       album,
+		Description: description,
 		Modified:    modified,
 		Size:        size,
 		Path:        pth,
 		Timestamp:   timestamp,
+		Location:    p,
+		Name:        name,
+	}
+	if probe == nil {
+		if probe, err = ProbeCached(p, name, info); err != nil {
+			log.Println("Failed to probe", v.Path, err)
+		}
+	}
+	if probe != nil {
+		v.Duration = probe.Duration
+		v.Width = probe.Width
+		v.Height = probe.Height
+		v.VideoCodec = probe.VideoCodec
+		v.AudioCodec = probe.AudioCodec
+		v.Bitrate = probe.Bitrate
+		v.FrameRate = probe.FrameRate
 	}
+
 	// read yml if exists
 	err = getTagsFromYml(v)
 	if err != nil {
 		log.Println("Failed to read yml for", v.Path)
 	}
-
-	// Add thumbnail from embedded tags (if exists)
-	pic := m.Picture()
-	if pic != nil {
-		v.Thumb = pic.Data
-		v.ThumbType = pic.MIMEType
+	if v.Category == "" {
+		v.Category = v.Album
 	}
+	v.setVisibility()
 
-	// Add thumbnail from external file (if exists)
-	if utils.FileExists(fmt.Sprintf("%s.jpg", strings.TrimSuffix(pth, filepath.Ext(pth)))) {
-		data, err := ioutil.ReadFile(fmt.Sprintf("%s.jpg", strings.TrimSuffix(pth, filepath.Ext(pth))))
-		if err != nil {
-			log.Println("Failed to read thumbnail file for", v.Path)
-			return nil, err
+	// Thumbnails are read lazily (see OpenThumbnail), from the .jpg sidecar
+	// or else the picture embedded in the video file.
+	if pic != nil {
+		v.EmbeddedThumb = pic.MIMEType
+		if v.EmbeddedThumb == "" {
+			v.EmbeddedThumb = "image/jpeg"
 		}
-		v.Thumb = data
-		v.ThumbType = "image/jpeg"
 	}
 
 	return v, nil
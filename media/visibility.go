@@ -0,0 +1,54 @@
+package media
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Visibility is who can see a video.
+type Visibility string
+
+const (
+	// Public videos are listed in playlists, search results and feeds.
+	Public Visibility = "public"
+	// Unlisted videos can be watched by anyone with their link, but aren't
+	// listed.
+	Unlisted Visibility = "unlisted"
+	// Private videos can only be watched by their owner and admins.
+	Private Visibility = "private"
+)
+
+// Visibilities are the valid visibilities, most visible first.
+var Visibilities = []Visibility{Public, Unlisted, Private}
+
+// ParseVisibility parses a visibility (case insensitive), defaulting to
+// Public if empty.
+func ParseVisibility(s string) (Visibility, error) {
+	switch v := Visibility(strings.ToLower(strings.TrimSpace(s))); v {
+	case "":
+		return Public, nil
+	case Public, Unlisted, Private:
+		return v, nil
+	default:
+		return "", fmt.Errorf("invalid visibility %q", s)
+	}
+}
+
+// Listed returns true if the video is listed in playlists, search results
+// and feeds, i.e: if it is public.
+func (v *Video) Listed() bool {
+	return v.Visibility == Public
+}
+
+// setVisibility normalizes the visibility read from the .yml sidecar of
+// the video. Invalid visibilities make it private, rather than exposing a
+// video whose sidecar has a typo.
+func (v *Video) setVisibility() {
+	vis, err := ParseVisibility(string(v.Visibility))
+	if err != nil {
+		log.Printf("%s of %s, making it private", err, v.Path)
+		vis = Private
+	}
+	v.Visibility = vis
+}
@@ -0,0 +1,33 @@
+/* Fill in the position of the frame shown in the player as thumbnail */
+function useCurrentFrame() {
+  var video = document.getElementById("edit-video");
+  document.getElementById("edit-thumbnail-at").value = video.currentTime.toFixed(3);
+}
+
+function saveVideo() {
+  var form = document.getElementById("edit-form");
+  var message = document.getElementById("edit-message");
+  var button = document.getElementById("edit-button");
+
+  button.disabled = true;
+  message.classList.remove("error");
+  message.innerText = "Saving...";
+
+  var xhr = new XMLHttpRequest();
+  xhr.open("POST", form.action);
+  xhr.onload = function() {
+    button.disabled = false;
+    if (xhr.status >= 200 && xhr.status < 300) {
+      window.location.href = xhr.getResponseHeader("Location") || "/";
+    } else {
+      message.classList.add("error");
+      message.innerText = xhr.responseText;
+    }
+  };
+  xhr.onerror = function() {
+    button.disabled = false;
+    message.classList.add("error");
+    message.innerText = "Error saving video";
+  };
+  xhr.send(new FormData(form));
+}
@@ -12,6 +12,7 @@ let url = null
 
 const importForm = document.getElementById('import-form')
 const importInput = document.getElementById('import-input')
+const importVisibility = document.getElementById('import-visibility')
 const importMessageLabel = document.getElementById('import-message')
 const importButtonWrapper = document.getElementById('import-button-wrapper')
 const importButton = document.getElementById('import-button')
@@ -65,6 +66,12 @@ const secondsToTime = (secs) => {
     return `${hr}:${min}:${sec}`
 }
 
+const escapeHTML = (text) => {
+    const div = document.createElement('div')
+    div.innerText = text
+    return div.innerHTML
+}
+
 const bytesToSize = (bytes) => {
     const sizes = ['Bytes', 'KB', 'MB']
     if (bytes == 0) return 'n/a'
@@ -122,6 +129,7 @@ const startImporting = () => {
 
     const formData = new FormData()
     formData.append('url', url)
+    formData.append('visibility', importVisibility.value)
     const xhr = new XMLHttpRequest()
 
     xhr.upload.addEventListener('progress', importProgress, false)
@@ -180,11 +188,49 @@ function importProgress(e) { // import process in progress
 const importFinish = (e) => { // import successfully finished
     const message = e.target.responseText
     const isSuccess = e.target.status < 400
+    const jobURL = e.target.getResponseHeader('Location')
+
+    if (isSuccess && jobURL && window.EventSource) {
+        followJob(jobURL)
+        return
+    }
 
     setProgress(isSuccess ? 100 : 0)
     setMessage(message, !isSuccess)
     setImportState(false)
-    if (isSuccess) removeFile(null, true)
+}
+
+const followJob = (jobURL) => { // follow the progress of the processing job
+    isProcessing = true
+    setProgress(0)
+    setMessage('Waiting for the video to be processed...')
+
+    const source = new EventSource(jobURL)
+    source.onmessage = (e) => {
+        const job = JSON.parse(e.data)
+        const progress = Math.round(job.progress)
+        switch (job.state) {
+        case 'done':
+            source.close()
+            setProgress(100)
+            setMessage('Video successfully processed!')
+            setImportState(false)
+            break
+        case 'failed':
+            source.close()
+            setProgress(0)
+            setMessage(`Processing failed: ${escapeHTML(job.error)}`, true)
+            setImportState(false)
+            break
+        case 'queued':
+            setProgress(progress)
+            setMessage(job.error ? `Retrying after error: ${escapeHTML(job.error)}` : 'Waiting for the video to be processed...')
+            break
+        default:
+            setProgress(progress)
+            setMessage(`Processing video (${escapeHTML(job.phase || job.state)})... ${progress}%`)
+        }
+    }
 }
 
 const importError = () => { // import error
@@ -0,0 +1,79 @@
+/* Load the next pages of the playlist as it is scrolled to the bottom */
+(function() {
+  var more = document.getElementById("playlist-more");
+  if (!more || !window.IntersectionObserver || !window.fetch) {
+    return;
+  }
+  var playlist = document.getElementById("playlist");
+  var query = more.dataset.query;
+  var playing = more.dataset.playing;
+  var loading = false;
+
+  function formatDuration(seconds) {
+    var s = Math.round(seconds);
+    var pad = function(n) { return n < 10 ? "0" + n : "" + n; };
+    if (s >= 3600) {
+      return Math.floor(s / 3600) + ":" + pad(Math.floor(s / 60) % 60) + ":" + pad(s % 60);
+    }
+    return Math.floor(s / 60) + ":" + pad(s % 60);
+  }
+
+  function item(video) {
+    var a = document.createElement("a");
+    a.href = video.url + "?" + query;
+    if (video.id === playing) {
+      a.className = "playing";
+    }
+    var img = document.createElement("img");
+    img.src = video.thumbnail;
+    img.loading = "lazy";
+    var div = document.createElement("div");
+    var h1 = document.createElement("h1");
+    h1.innerText = video.title;
+    var h2 = document.createElement("h2");
+    h2.innerText = video.views + " views • " + video.modified +
+      (video.duration ? " • " + formatDuration(video.duration) : "");
+    div.appendChild(h1);
+    div.appendChild(h2);
+    a.appendChild(img);
+    a.appendChild(div);
+    return a;
+  }
+
+  function load() {
+    if (loading || !more.dataset.next) {
+      return;
+    }
+    loading = true;
+    fetch("/playlist?" + query + "&after=" + encodeURIComponent(more.dataset.next))
+      .then(function(res) {
+        if (!res.ok) {
+          throw new Error(res.statusText);
+        }
+        return res.json();
+      })
+      .then(function(page) {
+        page.videos.forEach(function(video) {
+          playlist.insertBefore(item(video), more);
+        });
+        if (page.next) {
+          more.dataset.next = page.next;
+        } else {
+          observer.disconnect();
+          more.remove();
+        }
+        loading = false;
+      })
+      .catch(function() {
+        /* fall back to the link to the next page */
+        observer.disconnect();
+      });
+  }
+
+  var observer = new IntersectionObserver(function(entries) {
+    if (entries[0].isIntersecting) {
+      load();
+    }
+  }, { root: playlist, rootMargin: "200px" });
+  observer.observe(more);
+})();
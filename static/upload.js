@@ -16,6 +16,9 @@ const videoInput = document.getElementById('video-input')
 const targetLibraryPath = document.getElementById('target-library-path')
 const videoTitle = document.getElementById('video-title')
 const videoDescription = document.getElementById('video-description')
+const videoTags = document.getElementById('video-tags')
+const videoCategory = document.getElementById('video-category')
+const videoVisibility = document.getElementById('video-visibility')
 const uploadMessageLabel = document.getElementById('upload-message')
 const uploadFileContainer = document.getElementById('upload-file')
 const uploadFilenameLabel = document.getElementById('upload-filename')
@@ -71,6 +74,12 @@ const secondsToTime = (secs) => {
     return `${hr}:${min}:${sec}`
 }
 
+const escapeHTML = (text) => {
+    const div = document.createElement('div')
+    div.innerText = text
+    return div.innerHTML
+}
+
 const bytesToSize = (bytes) => {
     const sizes = ['Bytes', 'KB', 'MB']
     if (bytes == 0) return 'n/a'
@@ -168,6 +177,9 @@ const startUploading = () => {
     formData.append('target_library_path', targetLibraryPath.value)
     formData.append('video_title', videoTitle.value)
     formData.append('video_description', videoDescription.value)
+    formData.append('video_tags', videoTags.value)
+    formData.append('video_category', videoCategory.value)
+    formData.append('video_visibility', videoVisibility.value)
     const xhr = new XMLHttpRequest()
 
     xhr.upload.addEventListener('progress', uploadProgress, false)
@@ -226,6 +238,12 @@ function uploadProgress(e) { // upload process in progress
 const uploadFinish = (e) => { // upload successfully finished
     const message = e.target.responseText
     const isSuccess = e.target.status < 400
+    const jobURL = e.target.getResponseHeader('Location')
+
+    if (isSuccess && jobURL && window.EventSource) {
+        followJob(jobURL)
+        return
+    }
 
     setProgress(isSuccess ? 100 : 0)
     setMessage(message, !isSuccess)
@@ -233,6 +251,40 @@ const uploadFinish = (e) => { // upload successfully finished
     if (isSuccess) removeFile(null, true)
 }
 
+const followJob = (jobURL) => { // follow the progress of the processing job
+    isProcessing = true
+    setProgress(0)
+    setMessage('Waiting for the video to be processed...')
+
+    const source = new EventSource(jobURL)
+    source.onmessage = (e) => {
+        const job = JSON.parse(e.data)
+        const progress = Math.round(job.progress)
+        switch (job.state) {
+        case 'done':
+            source.close()
+            setProgress(100)
+            setMessage('Video successfully processed!')
+            setUploadState(false)
+        removeFile(null, true)
+            break
+        case 'failed':
+            source.close()
+            setProgress(0)
+            setMessage(`Processing failed: ${escapeHTML(job.error)}`, true)
+            setUploadState(false)
+            break
+        case 'queued':
+            setProgress(progress)
+            setMessage(job.error ? `Retrying after error: ${escapeHTML(job.error)}` : 'Waiting for the video to be processed...')
+            break
+        default:
+            setProgress(progress)
+            setMessage(`Processing video (${escapeHTML(job.phase || job.state)})... ${progress}%`)
+        }
+    }
+}
+
 const uploadError = () => { // upload error
     setMessage('An error occurred while uploading the file.', true)
     setProgress(0)
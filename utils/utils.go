@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
@@ -8,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -78,3 +81,78 @@ func RunCmd(timeout int, command string, args ...string) error {
 
 	return nil
 }
+
+// RunCmdOutput runs a command and returns its standard output.
+func RunCmdOutput(timeout int, command string, args ...string) ([]byte, error) {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cmd.Output error: %w\n%s", err, stderr.Bytes())
+	}
+
+	return out, nil
+}
+
+// RunCmdProgress runs an ffmpeg command reporting the position (out_time)
+// of the output to progress as it is being written. The command is run with
+// "-progress pipe:1" so its standard output must not be used for anything else.
+func RunCmdProgress(timeout int, progress func(time.Duration), command string, args ...string) error {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command, append([]string{"-progress", "pipe:1", "-nostats"}, args...)...)
+	cmd.Stderr = &stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("cmd.StdoutPipe error: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cmd.Start error: %w", err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key != "out_time_us" {
+			continue
+		}
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			continue
+		}
+		progress(time.Duration(us) * time.Microsecond)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("cmd.Wait error: %w\n%s", err, stderr.Bytes())
+	}
+
+	return nil
+}